@@ -0,0 +1,35 @@
+package stf
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+// AnnotateFunc draw on a decoded frame before it is encoded again,
+// e.g. burn in the time, seq or device name for debug recordings
+type AnnotateFunc func(img draw.Image, f Frame)
+
+// SetAnnotateFrame decode every delivered jpeg frame, call fn on it and encode it again.
+// Seq is already set when fn called. It cost as much cpu as SetTargetBitrate. nil to disable
+func (s *jpgTcpSucker) SetAnnotateFrame(fn AnnotateFunc) {
+	s.annotate = fn
+}
+
+// annotateJPEG return frame data annotated by fn, or the data itself if decoding failed
+func annotateJPEG(frame Frame, quality int, fn AnnotateFunc) []byte {
+	img, err := jpeg.Decode(bytes.NewReader(frame.Data))
+	if err != nil {
+		return frame.Data
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(b) // jpeg decode to YCbCr which can not be drawn on
+	draw.Draw(rgba, b, img, b.Min, draw.Src)
+	fn(rgba, frame)
+	buf := bytes.NewBuffer(nil)
+	if err := jpeg.Encode(buf, rgba, &jpeg.Options{Quality: quality}); err != nil {
+		return frame.Data
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,48 @@
+package stf
+
+import (
+	"bytes"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnotateFrame(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	s.SetChecksum(true)
+	var seqs []uint64
+	s.SetAnnotateFrame(func(img draw.Image, f Frame) {
+		seqs = append(seqs, f.Seq)
+		draw.Draw(img, image.Rect(0, 0, 16, 16), &image.Uniform{color.White}, image.ZP, draw.Src)
+	})
+	input := makeJpeg(t, 64, 64, color.Black)
+	s.deliver(Frame{Data: input}, time.Now())
+	frame := <-s.FrameC
+	assert.Equal(t, []uint64{1}, seqs)
+	assert.NotEqual(t, input, frame.Data)
+	assert.Equal(t, crc32.ChecksumIEEE(frame.Data), frame.Checksum)
+
+	img, err := jpeg.Decode(bytes.NewReader(frame.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, _, _ := img.At(8, 8).RGBA()
+	assert.True(t, r > 0xf000, "annotated region not drawn")
+	r, _, _, _ = img.At(40, 40).RGBA()
+	assert.True(t, r < 0x1000, "outside the annotated region changed")
+
+	// png frames are not touched
+	s.deliver(Frame{Data: []byte("png"), Format: FormatPNG}, time.Now())
+	assert.Equal(t, []byte("png"), (<-s.FrameC).Data)
+	assert.Equal(t, 1, len(seqs))
+
+	s.SetAnnotateFrame(nil)
+	s.deliver(Frame{Data: input}, time.Now())
+	assert.Equal(t, input, (<-s.FrameC).Data)
+}
@@ -0,0 +1,135 @@
+package stf
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	adb "github.com/openatx/go-adb"
+	"github.com/pkg/errors"
+)
+
+const remoteApkPath = "/data/local/tmp/go-stf-install.apk"
+
+// AppManager install, launch and clean apps of a device
+type AppManager struct {
+	progress ProgressFunc
+	shell    func(cmd string, args ...string) (string, error)
+	upload   func(dst string, rd io.Reader) error
+	download func(ctx context.Context, dst, url string) error
+
+	*adb.Device
+}
+
+// NewAppManager create an app manager of device
+func NewAppManager(device *adb.Device) *AppManager {
+	a := &AppManager{Device: device}
+	a.shell = a.RunCommand
+	a.upload = func(dst string, rd io.Reader) error {
+		wc, err := a.OpenWrite(dst, 0644, time.Now())
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(wc, rd); err != nil {
+			wc.Close()
+			return err
+		}
+		return wc.Close()
+	}
+	a.download = func(ctx context.Context, dst, url string) error {
+		return PushFileFromHTTPContext(ctx, a.Device, dst, 0644, url, a.progress)
+	}
+	return a
+}
+
+// SetProgress set the callback to report apk pushing and downloading
+func (a *AppManager) SetProgress(progress ProgressFunc) {
+	a.progress = progress
+}
+
+// InstallAPK push the apk at local path to the device and install it, an installed app is replaced
+func (a *AppManager) InstallAPK(apkPath string) error {
+	f, err := os.Open(apkPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size := int64(-1)
+	if info, err := f.Stat(); err == nil {
+		size = info.Size()
+	}
+	return a.InstallAPKReader(f, path.Base(apkPath), size)
+}
+
+// InstallAPKReader is InstallAPK reading the apk from rd, size is -1 if unknown
+func (a *AppManager) InstallAPKReader(rd io.Reader, name string, size int64) error {
+	if a.progress != nil {
+		rd = &progressReader{rd: rd, filename: name, total: size, progress: a.progress}
+	}
+	if err := a.upload(remoteApkPath, rd); err != nil {
+		return errors.Wrap(err, "push apk")
+	}
+	return a.pmInstall()
+}
+
+// InstallFromURL download the apk to the device and install it
+func (a *AppManager) InstallFromURL(ctx context.Context, url string) error {
+	if err := a.download(ctx, remoteApkPath, url); err != nil {
+		return errors.Wrap(err, "download apk")
+	}
+	return a.pmInstall()
+}
+
+func (a *AppManager) pmInstall() error {
+	defer a.shell("rm", remoteApkPath)
+	return a.pm("install", "-r", "-t", remoteApkPath)
+}
+
+// Uninstall remove the app of package pkg
+func (a *AppManager) Uninstall(pkg string) error {
+	return a.pm("uninstall", pkg)
+}
+
+// ClearData delete all data of the app, like clearing it in settings
+func (a *AppManager) ClearData(pkg string) error {
+	return a.pm("clear", pkg)
+}
+
+// pm run a pm command which print Success or Failure [REASON]
+func (a *AppManager) pm(args ...string) error {
+	out, err := a.shell("pm", args...)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(out, "Success") {
+		return errors.Errorf("pm %s: %s", args[0], strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// LaunchActivity start an activity given as pkg/activity, or the launcher activity if only pkg is given
+func (a *AppManager) LaunchActivity(component string) error {
+	var out string
+	var err error
+	if strings.Contains(component, "/") {
+		out, err = a.shell("am", "start", "-n", component)
+	} else {
+		out, err = a.shell("monkey", "-p", component, "-c", "android.intent.category.LAUNCHER", "1")
+	}
+	if err != nil {
+		return err
+	}
+	if strings.Contains(out, "Error") || strings.Contains(out, "monkey aborted") {
+		return errors.Errorf("launch %s: %s", component, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// ForceStop kill the app and its services
+func (a *AppManager) ForceStop(pkg string) error {
+	_, err := a.shell("am", "force-stop", pkg)
+	return err
+}
@@ -0,0 +1,88 @@
+package stf
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeAppManager return an AppManager whose shell output come from outputs by command line
+func newFakeAppManager(outputs map[string]string) (*AppManager, *[]string) {
+	a := NewAppManager(nil)
+	var cmds []string
+	a.shell = func(cmd string, args ...string) (string, error) {
+		line := strings.Join(append([]string{cmd}, args...), " ")
+		cmds = append(cmds, line)
+		return outputs[line], nil
+	}
+	return a, &cmds
+}
+
+func TestAppManagerInstall(t *testing.T) {
+	a, cmds := newFakeAppManager(map[string]string{
+		"pm install -r -t " + remoteApkPath: "Success\n",
+	})
+	var uploaded []byte
+	a.upload = func(dst string, rd io.Reader) error {
+		assert.Equal(t, remoteApkPath, dst)
+		uploaded, _ = ioutil.ReadAll(rd)
+		return nil
+	}
+	var done, total int64
+	a.SetProgress(func(filename string, bytesDone, bytesTotal int64) {
+		assert.Equal(t, "app.apk", filename)
+		done, total = bytesDone, bytesTotal
+	})
+
+	dir, err := ioutil.TempDir("", "apk")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	apk := filepath.Join(dir, "app.apk")
+	ioutil.WriteFile(apk, []byte("fake apk"), 0644)
+	assert.NoError(t, a.InstallAPK(apk))
+	assert.Equal(t, []byte("fake apk"), uploaded)
+	assert.Equal(t, int64(8), done)
+	assert.Equal(t, int64(8), total)
+	assert.Equal(t, []string{"pm install -r -t " + remoteApkPath, "rm " + remoteApkPath}, *cmds)
+
+	var url string
+	a.download = func(ctx context.Context, dst, u string) error {
+		url = u
+		return nil
+	}
+	assert.NoError(t, a.InstallFromURL(context.Background(), "http://example.com/app.apk"))
+	assert.Equal(t, "http://example.com/app.apk", url)
+
+	a, _ = newFakeAppManager(map[string]string{
+		"pm install -r -t " + remoteApkPath: "Failure [INSTALL_FAILED_OLDER_SDK]\n",
+	})
+	a.upload = func(dst string, rd io.Reader) error { return nil }
+	err = a.InstallAPKReader(strings.NewReader("fake apk"), "app.apk", -1)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "INSTALL_FAILED_OLDER_SDK")
+}
+
+func TestAppManagerCommands(t *testing.T) {
+	a, cmds := newFakeAppManager(map[string]string{
+		"pm uninstall com.example":                                    "Success",
+		"pm clear com.example":                                        "Success",
+		"am start -n com.example/.Main":                               "Starting: Intent { cmp=com.example/.Main }",
+		"am start -n com.example/.Missing":                            "Error type 3\nError: Activity class {com.example/com.example.Missing} does not exist.",
+		"monkey -p com.example -c android.intent.category.LAUNCHER 1": "Events injected: 1",
+	})
+	assert.NoError(t, a.Uninstall("com.example"))
+	assert.NoError(t, a.ClearData("com.example"))
+	assert.NoError(t, a.LaunchActivity("com.example/.Main"))
+	assert.Error(t, a.LaunchActivity("com.example/.Missing"))
+	assert.NoError(t, a.LaunchActivity("com.example"))
+	assert.NoError(t, a.ForceStop("com.example"))
+	assert.Equal(t, "am force-stop com.example", (*cmds)[len(*cmds)-1])
+
+	assert.Error(t, a.Uninstall("com.missing"), "no Success in output")
+}
@@ -0,0 +1,127 @@
+package stf
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	adb "github.com/openatx/go-adb"
+	"github.com/pkg/errors"
+)
+
+// Backend create capturers of one capturing method
+type Backend struct {
+	Name string
+	// Probe return nil if the backend can capture the screen of device
+	Probe func(device *adb.Device) error
+	New   func(device *adb.Device) Capturer
+}
+
+// ErrUnknownBackend is returned by NewCapturer when no backend is registered with the name
+var ErrUnknownBackend = errors.New("unknown capture backend")
+
+var (
+	backendsMu sync.RWMutex
+	backends   []Backend // in the order they are tried by NewCapturer
+)
+
+func init() {
+	RegisterBackend(Backend{
+		Name:  "minicap",
+		Probe: probeMinicap,
+		New:   func(device *adb.Device) Capturer { return NewSTFCapturer(device) },
+	})
+	RegisterBackend(Backend{
+		Name:  "uiautomator",
+		Probe: probeUiautomator,
+		New:   func(device *adb.Device) Capturer { return NewUiautomatorCapturer(device) },
+	})
+	RegisterBackend(Backend{
+		Name:  "screencap",
+		Probe: func(device *adb.Device) error { return nil },
+		New: func(device *adb.Device) Capturer {
+			return NewSTFCapturer(device, WithStreamMode(ScreencapMode))
+		},
+	})
+	RegisterBackend(Backend{
+		Name:  "screenrecord",
+		Probe: func(device *adb.Device) error { return probeSDK(device, 21) }, // --output-format=h264 since android 5.0
+		New:   func(device *adb.Device) Capturer { return NewH264Capturer(device) },
+	})
+}
+
+// RegisterBackend add a backend tried after the registered ones, a backend of the same name is replaced
+func RegisterBackend(b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	for i := range backends {
+		if backends[i].Name == b.Name {
+			backends[i] = b
+			return
+		}
+	}
+	backends = append(backends, b)
+}
+
+// Backends return names of the registered backends in the order they are tried
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for _, b := range backends {
+		names = append(names, b.Name)
+	}
+	return names
+}
+
+// NewCapturer create a capturer with the backend of name, or with the first backend
+// whose probe passed if name is empty, and return the name of the backend used.
+// Backends producing images are tried before screenrecord
+func NewCapturer(device *adb.Device, name string) (Capturer, string, error) {
+	backendsMu.RLock()
+	candidates := append([]Backend(nil), backends...)
+	backendsMu.RUnlock()
+	var errs []error
+	for _, b := range candidates {
+		if name != "" && b.Name != name {
+			continue
+		}
+		if err := b.Probe(device); err != nil {
+			errs = append(errs, errors.Wrap(err, b.Name))
+			continue
+		}
+		return b.New(device), b.Name, nil
+	}
+	if name != "" && len(errs) == 0 {
+		return nil, "", errors.Wrap(ErrUnknownBackend, name)
+	}
+	if len(errs) == 0 {
+		return nil, "", ErrNoCaptureMethod
+	}
+	return nil, "", errors.Wrap(ErrNoCaptureMethod, wrapMultiError(errs...).Error())
+}
+
+// probeMinicap push minicap and run minicap -i as Start does, slow-minicap is accepted too
+func probeMinicap(device *adb.Device) error {
+	return newMinicapDaemon(nil, device).prepare(context.Background())
+}
+
+// probeSDK return an error if the sdk of device is lower than minSDK
+func probeSDK(device *adb.Device, minSDK int) error {
+	props, err := device.Properties()
+	if err != nil {
+		return err
+	}
+	_, sdkStr, err := deviceAbiSdk(props)
+	if err != nil {
+		return err
+	}
+	sdk, err := strconv.Atoi(sdkStr)
+	if err != nil {
+		return errors.Wrap(err, "parse sdk")
+	}
+	if sdk < minSDK {
+		return errors.Errorf("sdk %d is lower than %d", sdk, minSDK)
+	}
+	return nil
+}
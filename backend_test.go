@@ -0,0 +1,46 @@
+package stf
+
+import (
+	"testing"
+
+	adb "github.com/openatx/go-adb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackends(t *testing.T) {
+	backendsMu.Lock()
+	saved := backends
+	backends = append([]Backend(nil), saved...)
+	backendsMu.Unlock()
+	defer func() {
+		backendsMu.Lock()
+		backends = saved
+		backendsMu.Unlock()
+	}()
+	assert.Equal(t, []string{"minicap", "uiautomator", "screencap", "screenrecord"}, Backends())
+
+	fail := func(device *adb.Device) error { return errors.New("not supported") }
+	ok := func(device *adb.Device) error { return nil }
+	RegisterBackend(Backend{Name: "minicap", Probe: fail, New: func(*adb.Device) Capturer { return nil }})
+	RegisterBackend(Backend{Name: "uiautomator", Probe: fail, New: func(*adb.Device) Capturer { return nil }})
+	RegisterBackend(Backend{Name: "fake", Probe: ok, New: func(*adb.Device) Capturer { return NewH264Capturer(nil) }})
+	assert.Equal(t, []string{"minicap", "uiautomator", "screencap", "screenrecord", "fake"}, Backends(), "replaced in place")
+
+	capturer, name, err := NewCapturer(nil, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "screencap", name, "first backend whose probe passed")
+	assert.Equal(t, ScreencapMode, capturer.(*STFCapturer).Config().StreamMode)
+
+	capturer, name, err = NewCapturer(nil, "fake")
+	assert.NoError(t, err)
+	assert.Equal(t, "fake", name)
+	assert.IsType(t, &H264Capturer{}, capturer)
+
+	_, _, err = NewCapturer(nil, "minicap")
+	assert.Equal(t, ErrNoCaptureMethod, errors.Cause(err))
+	assert.Contains(t, err.Error(), "not supported")
+
+	_, _, err = NewCapturer(nil, "scrcpy")
+	assert.Equal(t, ErrUnknownBackend, errors.Cause(err))
+}
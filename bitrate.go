@@ -0,0 +1,102 @@
+package stf
+
+import (
+	"bytes"
+	"image/jpeg"
+	"sync"
+	"time"
+)
+
+const (
+	minRecompressQuality     = 10
+	maxRecompressQuality     = 90
+	recompressQualityStep    = 5
+	defaultRecompressQuality = 80
+)
+
+// bitrateController adjust the jpeg quality of host side recompression
+// so the output bitrate converge on the target
+type bitrateController struct {
+	mu      sync.Mutex
+	target  int     // bits per second, 0 means disabled
+	quality int     // jpeg quality used to recompress
+	bps     float64 // estimated output bits per second
+	last    time.Time
+}
+
+func (c *bitrateController) setTarget(bps int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.target = bps
+	if c.quality == 0 {
+		c.quality = defaultRecompressQuality
+	}
+}
+
+func (c *bitrateController) enabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.target > 0
+}
+
+// observe record an output frame of size bytes at t, then step the quality
+func (c *bitrateController) observe(size int, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.last.IsZero() {
+		if interval := t.Sub(c.last).Seconds(); interval > 0 {
+			rate := float64(size*8) / interval
+			if c.bps == 0 {
+				c.bps = rate
+			} else {
+				c.bps += (rate - c.bps) / 8
+			}
+		}
+	}
+	c.last = t
+	if c.target <= 0 || c.bps == 0 {
+		return
+	}
+	switch {
+	case c.bps > float64(c.target)*1.1 && c.quality > minRecompressQuality:
+		c.quality -= recompressQualityStep
+	case c.bps < float64(c.target)*0.9 && c.quality < maxRecompressQuality:
+		c.quality += recompressQualityStep
+	}
+}
+
+func (c *bitrateController) currentQuality() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.quality
+}
+
+func (c *bitrateController) estimated() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(c.bps)
+}
+
+// recompress encode the jpeg again with quality, return data itself if it fails
+func recompress(data []byte, quality int) []byte {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// SetTargetBitrate recompress frames on the host to keep the output around bps bits per second.
+// Decoding and encoding every frame cost much cpu. 0 to disable
+func (s *jpgTcpSucker) SetTargetBitrate(bps int) {
+	s.bitrate.setTarget(bps)
+}
+
+// EstimatedBitrate return the output bits per second measured when target bitrate is set
+func (s *jpgTcpSucker) EstimatedBitrate() int {
+	return s.bitrate.estimated()
+}
@@ -0,0 +1,41 @@
+package stf
+
+import (
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBitrateController(t *testing.T) {
+	c := &bitrateController{}
+	c.setTarget(800000) // 100KB/s
+	assert.Equal(t, defaultRecompressQuality, c.currentQuality())
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		now = now.Add(100 * time.Millisecond)
+		c.observe(50000, now) // 500KB/s
+	}
+	assert.True(t, c.currentQuality() < defaultRecompressQuality)
+	assert.InDelta(t, 4000000, c.estimated(), 1)
+
+	for i := 0; i < 100; i++ {
+		now = now.Add(100 * time.Millisecond)
+		c.observe(50000, now)
+	}
+	assert.Equal(t, minRecompressQuality, c.currentQuality(), "quality is bounded")
+
+	for i := 0; i < 100; i++ {
+		now = now.Add(100 * time.Millisecond)
+		c.observe(1000, now) // 10KB/s
+	}
+	assert.Equal(t, maxRecompressQuality, c.currentQuality())
+}
+
+func TestRecompress(t *testing.T) {
+	data := makeJpeg(t, 64, 64, color.White)
+	assert.NotEmpty(t, recompress(data, 10))
+	assert.Equal(t, fakeJpeg, recompress(fakeJpeg, 10))
+}
@@ -0,0 +1,312 @@
+package stf
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	adb "github.com/openatx/go-adb"
+	"github.com/pkg/errors"
+)
+
+// Process call fn for every frame in a pool of workers goroutines.
+// Frames are handled concurrently, so there is no order guarantee across workers.
+// When all workers are busy, at most workers frames are queued and the oldest is dropped.
+// Block until ctx done and all running fn returned.
+func (s *STFCapturer) Process(ctx context.Context, workers int, fn func(Frame)) error {
+	if workers <= 0 {
+		return errors.New("workers must be greater than 0")
+	}
+	subC := s.Subscribe()
+	defer s.Unsubscribe(subC)
+
+	queueC := make(chan Frame, workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for frame := range queueC {
+				fn(frame)
+			}
+		}()
+	}
+	defer func() {
+		close(queueC)
+		wg.Wait()
+	}()
+
+	for {
+		select {
+		case frame, ok := <-subC:
+			if !ok {
+				return nil
+			}
+			pushDropOldest(queueC, frame)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// screenshotWait is how long Screenshot wait for a frame before falling back to screencap
+const screenshotWait = 500 * time.Millisecond
+
+// Screenshot return the latest frame if the capturer is started, the next frame is waited shortly
+// if none delivered yet. Otherwise, or if no frame came, the screenshot is taken by screencap
+func (s *STFCapturer) Screenshot(ctx context.Context) (image.Image, error) {
+	if s.minicapDaemon.IsStarted() {
+		frame, ok, err := s.streamFrame(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return frame.Image()
+		}
+	}
+	type result struct {
+		img image.Image
+		err error
+	}
+	resultC := make(chan result, 1) // screencap can not be cancelled, never block it
+	go func() {
+		img, err := s.minicapDaemon.screencap()
+		resultC <- result{img, err}
+	}()
+	select {
+	case r := <-resultC:
+		return r.img, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Screenshot take one screenshot of device by screencap -p,
+// use STFCapturer.Screenshot to get it from minicap when capturing
+func Screenshot(device *adb.Device) (image.Image, error) {
+	return Screencap(device)
+}
+
+// streamFrame return the latest frame, or the next one if delivered within screenshotWait
+func (s *STFCapturer) streamFrame(ctx context.Context) (Frame, bool, error) {
+	if frame, ok := s.LastFrame(); ok {
+		return frame, true, nil
+	}
+	C := s.Subscribe()
+	defer s.Unsubscribe(C)
+	select {
+	case frame, ok := <-C:
+		return frame, ok, nil
+	case <-time.After(screenshotWait):
+		return Frame{}, false, nil
+	case <-ctx.Done():
+		return Frame{}, false, ctx.Err()
+	}
+}
+
+// CaptureN collect the first n frames, then stop the capturer
+func (s *STFCapturer) CaptureN(ctx context.Context, n int) (frames []Frame, err error) {
+	if n <= 0 {
+		return nil, errors.New("n must be greater than 0")
+	}
+	defer func() {
+		if stopErr := s.Stop(); err == nil {
+			err = stopErr
+		}
+	}()
+	frames = make([]Frame, 0, n)
+	for len(frames) < n {
+		select {
+		case frame := <-s.FrameC:
+			frames = append(frames, frame)
+		case <-ctx.Done():
+			return frames, ctx.Err()
+		}
+	}
+	return frames, nil
+}
+
+// Run start the capturer and block until ctx done or capturing failed, then stop it.
+// It return nil when ctx done, so with signal.NotifyContext in main Ctrl-C shutdown cleanly
+func (s *STFCapturer) Run(ctx context.Context) error {
+	if err := s.StartContext(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil // cancelled while preparing
+		}
+		return err
+	}
+	err := s.Wait()
+	if ctx.Err() != nil && s.Err() == ctx.Err() {
+		return nil // stopped by StartContext
+	}
+	s.Stop() // the other half may still be running
+	if err == nil {
+		err = s.Err() // the half stopped for it returned first
+	}
+	return err
+}
+
+// Filter return a channel of frames passing predicate, e.g. to wait for a region turning red.
+// predicate run on its own goroutine, a slow predicate only drop frames for this filter.
+// The channel is closed when ctx done
+func (s *STFCapturer) Filter(ctx context.Context, predicate func(Frame) bool) <-chan Frame {
+	subC := s.Subscribe()
+	outC := make(chan Frame)
+	go func() {
+		defer close(outC)
+		defer s.Unsubscribe(subC)
+		for {
+			select {
+			case frame, ok := <-subC:
+				if !ok {
+					return
+				}
+				if !predicate(frame) {
+					continue
+				}
+				select {
+				case outC <- frame:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return outC
+}
+
+// ReadFrame copy the next frame into dst and return its size, it block until a frame arrived
+// or the capturer quit. If dst is too small, io.ErrShortBuffer is returned with n the size
+// needed, the frame is kept for the next call, so the caller can grow dst and call again.
+// Must be called after Start
+func (s *STFCapturer) ReadFrame(dst []byte) (n int, meta FrameMeta, err error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if s.pending == nil {
+		if s.waitErrC == nil {
+			s.waitErrC = make(chan error, 1)
+			go func(errC chan error) {
+				errC <- s.Wait()
+			}(s.waitErrC)
+		}
+		select {
+		case frame := <-s.FrameC:
+			s.pending = &frame
+		case err = <-s.waitErrC:
+			s.waitErrC = nil
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, meta, err
+		}
+	}
+	frame := s.pending
+	if len(dst) < len(frame.Data) {
+		return len(frame.Data), frame.Meta(), io.ErrShortBuffer
+	}
+	s.pending = nil
+	return copy(dst, frame.Data), frame.Meta(), nil
+}
+
+func pushDropOldest(C chan Frame, frame Frame) {
+	for {
+		select {
+		case C <- frame:
+			return
+		default:
+		}
+		select {
+		case <-C:
+		default:
+		}
+	}
+}
+
+// DumpFrames write frames from C into dir as <seq>.jpg, or .png for png frames, until C closed, or ctx done
+// and ctx.Err() is returned
+func DumpFrames(ctx context.Context, C <-chan Frame, dir string) error {
+	return dumpFrames(ctx, C, dir, false)
+}
+
+// DumpFramesWithIndex is DumpFrames which also write index.jsonl,
+// one json line per frame, so external tools can rebuild the timeline
+func DumpFramesWithIndex(ctx context.Context, C <-chan Frame, dir string) error {
+	return dumpFrames(ctx, C, dir, true)
+}
+
+type frameIndex struct {
+	Seq       uint64    `json:"seq"`
+	Filename  string    `json:"filename"`
+	Timestamp time.Time `json:"timestamp"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Rotation  int       `json:"rotation"`
+}
+
+const indexFlushInterval = time.Second
+
+func dumpFrames(ctx context.Context, C <-chan Frame, dir string, withIndex bool) (err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var index *bufio.Writer
+	if withIndex {
+		f, err := os.Create(filepath.Join(dir, "index.jsonl"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		index = bufio.NewWriter(f)
+		defer func() {
+			if er := index.Flush(); err == nil && er != nil {
+				err = errors.Wrap(er, "write index")
+			}
+		}()
+	}
+	ticker := time.NewTicker(indexFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case frame, ok := <-C:
+			if !ok {
+				return nil
+			}
+			filename := fmt.Sprintf("%06d%s", frame.Seq, frame.Format.Ext())
+			if err = ioutil.WriteFile(filepath.Join(dir, filename), frame.Data, 0644); err != nil {
+				return errors.Wrap(err, "write frame")
+			}
+			if index == nil {
+				continue
+			}
+			line, _ := json.Marshal(frameIndex{
+				Seq:       frame.Seq,
+				Filename:  filename,
+				Timestamp: frame.Time,
+				Width:     frame.Width,
+				Height:    frame.Height,
+				Rotation:  frame.Rotation,
+			})
+			if _, err = index.Write(append(line, '\n')); err != nil {
+				return errors.Wrap(err, "write index")
+			}
+		case <-ticker.C:
+			if index != nil {
+				if err = index.Flush(); err != nil {
+					return errors.Wrap(err, "write index")
+				}
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
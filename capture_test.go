@@ -0,0 +1,555 @@
+package stf
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	adb "github.com/openatx/go-adb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeCapturer return a STFCapturer whose sucker read from a fake minicap server
+func newFakeCapturer(t *testing.T, frames ...[]byte) *STFCapturer {
+	sucker := newJpgTcpSucker(nil)
+	sucker.port = fakeMinicapServer(t, 0, frames...)
+	return &STFCapturer{
+		minicapDaemon: newMinicapDaemon(nil, nil),
+		jpgTcpSucker:  sucker,
+	}
+}
+
+// startFakeCapturer act as STFCapturer.Start without a device
+func startFakeCapturer(t *testing.T, frames ...[]byte) *STFCapturer {
+	cap := newFakeCapturer(t, frames...)
+	startFake(cap)
+	return cap
+}
+
+// startFake start a capturer of newFakeCapturer
+func startFake(cap *STFCapturer) {
+	m := cap.minicapDaemon
+	m.safeDo(_ACTION_START, func() error {
+		m.resetError()
+		m.quitC = make(chan bool, 1)
+		go func() {
+			<-m.quitC
+			m.doneNilError()
+		}()
+		return nil
+	})
+	sucker := cap.jpgTcpSucker
+	sucker.safeDo(_ACTION_START, func() error {
+		sucker.resetError()
+		sucker.quitC = make(chan bool, 1)
+		go sucker.keepReadFromTcp(context.Background())
+		return nil
+	})
+}
+
+// fakeLaunches record the minicap command line of every launch
+type fakeLaunches struct {
+	mu      sync.Mutex
+	args    []string
+	running bool
+}
+
+func (l *fakeLaunches) isRunning() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.running
+}
+
+func (l *fakeLaunches) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.args...)
+}
+
+// newDevicelessCapturer return a STFCapturer which can Start without a device,
+// the sucker read from port
+func newDevicelessCapturer(t *testing.T, port int) (*STFCapturer, *fakeLaunches) {
+	cap := NewSTFCapturer(nil)
+	m := cap.minicapDaemon
+	m.props = map[string]string{
+		"ro.product.cpu.abi":   "arm64-v8a",
+		"ro.build.version.sdk": "25",
+	}
+	m.shell = func(cmd string, args ...string) (string, error) { return "", nil }
+	m.exists = func(path string) bool { return false }
+	m.push = func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}
+	m.probe = func() error {
+		time.Sleep(10 * time.Millisecond)
+		m.configMu.Lock()
+		m.binaryPath = "/data/local/tmp/minicap"
+		m.configMu.Unlock()
+		return nil
+	}
+	launches := &fakeLaunches{}
+	var stopC chan bool
+	m.capture = func() error {
+		launches.mu.Lock()
+		launches.args = append(launches.args, strings.Join(m.buildCaptureArgs(), " "))
+		stopC = make(chan bool)
+		myStopC := stopC
+		launches.running = true
+		launches.mu.Unlock()
+		<-myStopC
+		launches.mu.Lock()
+		launches.running = false
+		launches.mu.Unlock()
+		return nil
+	}
+	m.kill = func() error {
+		launches.mu.Lock()
+		defer launches.mu.Unlock()
+		if stopC != nil {
+			close(stopC)
+			stopC = nil
+		}
+		return nil
+	}
+	cap.jpgTcpSucker.forward = func(adb.ForwardSpec) (int, error) {
+		time.Sleep(5 * time.Millisecond)
+		return port, nil
+	}
+	return cap, launches
+}
+
+// waitSubscribed wait until n subscribers attached
+func waitSubscribed(t *testing.T, s *STFCapturer, n int) {
+	deadline := time.Now().Add(time.Second)
+	for s.SubscriberCount() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d subscribers, got %d", n, s.SubscriberCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	cap := newFakeCapturer(t, fakeJpeg, fakeJpeg, fakeJpeg, fakeJpeg)
+
+	var mu sync.Mutex
+	var running, maxRunning, handled int
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error, 1)
+	go func() {
+		errC <- cap.Process(ctx, 4, func(f Frame) {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(200 * time.Millisecond)
+			mu.Lock()
+			running--
+			handled++
+			mu.Unlock()
+		})
+	}()
+	waitSubscribed(t, cap, 1)
+	go cap.readFromTcp(context.Background())
+
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-errC)
+	assert.True(t, maxRunning > 1, "frames should be handled in parallel")
+	assert.True(t, handled > 1)
+	assert.Error(t, cap.Process(context.Background(), 0, func(Frame) {}))
+}
+
+func TestCaptureN(t *testing.T) {
+	cap := startFakeCapturer(t, fakeJpeg, fakeJpeg, fakeJpeg, fakeJpeg, fakeJpeg, fakeJpeg)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	frames, err := cap.CaptureN(ctx, 5)
+	assert.NoError(t, err)
+	assert.Len(t, frames, 5)
+	for i, frame := range frames {
+		assert.Equal(t, uint64(i+1), frame.Seq)
+	}
+	assert.False(t, cap.jpgTcpSucker.IsStarted())
+
+	_, err = cap.CaptureN(ctx, 0)
+	assert.Error(t, err)
+}
+
+func TestDumpFramesWithIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-stf-dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	C := make(chan Frame, 4)
+	for i := 1; i <= 3; i++ {
+		C <- Frame{Data: fakeJpeg, Seq: uint64(i), Time: time.Now(), Width: 720, Height: 1280, Rotation: 90}
+	}
+	C <- Frame{Data: []byte("\x89PNG"), Seq: 4, Time: time.Now(), Width: 720, Height: 1280, Rotation: 90, Format: FormatPNG}
+	close(C)
+	assert.NoError(t, DumpFramesWithIndex(context.Background(), C, dir))
+
+	f, err := os.Open(filepath.Join(dir, "index.jsonl"))
+	assert.NoError(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var seq uint64
+	for scanner.Scan() {
+		seq++
+		var idx frameIndex
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &idx))
+		assert.Equal(t, seq, idx.Seq)
+		assert.Equal(t, 90, idx.Rotation)
+		data, err := ioutil.ReadFile(filepath.Join(dir, idx.Filename))
+		assert.NoError(t, err)
+		if seq == 4 {
+			assert.Equal(t, "000004.png", idx.Filename)
+			assert.Equal(t, []byte("\x89PNG"), data)
+			continue
+		}
+		assert.Equal(t, fmt.Sprintf("%06d.jpg", seq), idx.Filename)
+		assert.Equal(t, fakeJpeg, data)
+	}
+	assert.Equal(t, uint64(4), seq)
+
+	// the index is flushed when cancelled too
+	ctx, cancel := context.WithCancel(context.Background())
+	C = make(chan Frame, 1)
+	C <- Frame{Data: fakeJpeg, Seq: 4}
+	sub := filepath.Join(dir, "cancelled")
+	errC := GoFunc(func() error {
+		return DumpFramesWithIndex(ctx, C, sub)
+	})
+	for len(C) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-errC)
+	index, err := ioutil.ReadFile(filepath.Join(sub, "index.jsonl"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(index), `"seq":4`)
+
+	C = make(chan Frame, 1)
+	C <- Frame{Data: fakeJpeg, Seq: 1}
+	close(C)
+	assert.Error(t, DumpFrames(context.Background(), C, filepath.Join(dir, "000001.jpg")), "dir is a file")
+}
+
+func TestMaxDuration(t *testing.T) {
+	cap := startFakeCapturer(t, fakeJpeg, fakeJpeg)
+	cap.events = make(chan Event, 10)
+	cap.SetMaxDuration(100 * time.Millisecond)
+	cap.armMaxDuration()
+	select {
+	case ev := <-cap.Events():
+		assert.Equal(t, EventMaxDurationReached, ev.Type)
+	case <-time.After(time.Second):
+		t.Fatal("max duration not reached")
+	}
+	deadline := time.Now().Add(time.Second)
+	for cap.minicapDaemon.IsStarted() || cap.jpgTcpSucker.IsStarted() {
+		if time.Now().After(deadline) {
+			t.Fatal("capturer not stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cap = startFakeCapturer(t, fakeJpeg)
+	cap.events = make(chan Event, 10)
+	cap.SetMaxDuration(100 * time.Millisecond)
+	cap.armMaxDuration()
+	assert.NoError(t, cap.Stop())
+	select {
+	case ev := <-cap.Events():
+		t.Fatalf("timer should be cancelled by Stop, got %v", ev)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	cap := startFakeCapturer(t, fakeJpeg, fakeJpeg)
+	defer cap.Stop()
+
+	small := make([]byte, 4)
+	n, meta, err := cap.ReadFrame(small)
+	assert.Equal(t, io.ErrShortBuffer, err)
+	assert.Equal(t, len(fakeJpeg), n)
+	assert.Equal(t, uint64(1), meta.Seq)
+
+	buf := make([]byte, 1024)
+	n, meta, err = cap.ReadFrame(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, fakeJpeg, buf[:n])
+	assert.Equal(t, uint64(1), meta.Seq, "short frame is kept")
+	assert.Equal(t, 720, meta.Width)
+
+	n, meta, err = cap.ReadFrame(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, len(fakeJpeg), n)
+	assert.Equal(t, uint64(2), meta.Seq)
+}
+
+func TestFilter(t *testing.T) {
+	cap := newFakeCapturer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	C := cap.Filter(ctx, func(f Frame) bool {
+		return f.Seq%2 == 0
+	})
+	for i := 1; i <= 4; i += 2 {
+		cap.pub(Frame{Data: fakeJpeg, Seq: uint64(i)})
+		cap.pub(Frame{Data: fakeJpeg, Seq: uint64(i + 1)})
+		assert.Equal(t, uint64(i+1), (<-C).Seq)
+	}
+	cancel()
+	_, ok := <-C
+	assert.False(t, ok)
+	waitSubscribed(t, cap, 0)
+}
+
+func TestAutoRotate(t *testing.T) {
+	cap, launches := newDevicelessCapturer(t, fakeMinicapServer(t, 0, fakeJpeg))
+	var mu sync.Mutex
+	orientation := "0"
+	cap.minicapDaemon.shell = func(cmd string, args ...string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cmd == "dumpsys" {
+			return "SurfaceOrientation: " + orientation, nil
+		}
+		return "", nil
+	}
+	cap.EnableAutoRotate(10 * time.Millisecond)
+	cap.SetRestartDebounce(50 * time.Millisecond)
+	assert.NoError(t, cap.Start())
+	defer cap.Stop()
+
+	// the rotate animation report some values before settled
+	for _, o := range []string{"1", "0", "1"} {
+		mu.Lock()
+		orientation = o
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	args := launches.get()
+	assert.Equal(t, 2, len(args), "restarts should be debounced: %v", args)
+	assert.Contains(t, args[len(args)-1], "@720x720/90")
+}
+
+func TestSuspendAwaken(t *testing.T) {
+	cap, launches := newDevicelessCapturer(t, fakeMinicapServer(t, 0, fakeJpeg))
+	assert.Error(t, cap.Suspend(), "not started")
+	assert.False(t, cap.jpgTcpSucker.isPaused(), "a failed Suspend does not pause")
+	assert.NoError(t, cap.Start())
+	defer cap.Stop()
+	waitFor := func(running bool) {
+		deadline := time.Now().Add(time.Second)
+		for launches.isRunning() != running {
+			if time.Now().After(deadline) {
+				t.Fatalf("minicap running should be %v", running)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor(true)
+
+	assert.NoError(t, cap.Suspend())
+	waitFor(false)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, len(launches.get()), "not relaunched while suspended")
+	assert.True(t, cap.jpgTcpSucker.isPaused())
+
+	assert.NoError(t, cap.Awaken())
+	waitFor(true)
+	assert.Equal(t, 2, len(launches.get()))
+	assert.False(t, cap.jpgTcpSucker.isPaused())
+}
+
+func TestDegradedModeRecovered(t *testing.T) {
+	cap, _ := newDevicelessCapturer(t, fakeMinicapServer(t, 0, fakeJpeg, fakeJpeg))
+	m := cap.minicapDaemon
+	capture := m.capture
+	var mu sync.Mutex
+	broken := true
+	m.capture = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if broken {
+			return errors.New("minicap quit")
+		}
+		return capture()
+	}
+	m.screencap = func() (image.Image, error) {
+		return image.NewRGBA(image.Rect(0, 0, 72, 128)), nil
+	}
+	m.SetRestartPolicy(RestartPolicy{MaxAttempts: 5, Backoff: time.Millisecond})
+	m.SetScreencapFallback(2, 10*time.Millisecond)
+	C := cap.Subscribe()
+	assert.NoError(t, cap.Start())
+	select {
+	case <-C:
+	case <-time.After(time.Second):
+		t.Fatal("no frame from screencap fallback")
+	}
+	assert.True(t, cap.jpgTcpSucker.isPaused(), "the sucker is paused while degraded")
+	cap.Unsubscribe(C)
+	assert.NoError(t, cap.Stop())
+
+	mu.Lock()
+	broken = false
+	mu.Unlock()
+	C = cap.Subscribe()
+	defer cap.Unsubscribe(C)
+	assert.NoError(t, cap.Start())
+	defer cap.Stop()
+	assert.False(t, cap.jpgTcpSucker.isPaused(), "a new Start is not degraded")
+	select {
+	case frame := <-C:
+		assert.Equal(t, fakeJpeg, frame.Data, "frames come from minicap again")
+	case <-time.After(2 * time.Second):
+		t.Fatal("no frame after started again")
+	}
+}
+
+func TestRun(t *testing.T) {
+	cap, launches := newDevicelessCapturer(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for !launches.isRunning() {
+			time.Sleep(5 * time.Millisecond)
+		}
+		cancel()
+	}()
+	select {
+	case err := <-GoFunc(func() error { return cap.Run(ctx) }):
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run not return after ctx cancelled")
+	}
+	assert.False(t, cap.minicapDaemon.IsStarted())
+	assert.False(t, cap.jpgTcpSucker.IsStarted())
+}
+
+func TestRunCancelledWhilePreparing(t *testing.T) {
+	cap, launches := newDevicelessCapturer(t, 0)
+	cap.minicapDaemon.push = func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	select {
+	case err := <-GoFunc(func() error { return cap.Run(ctx) }):
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run not return after ctx cancelled while pushing minicap")
+	}
+	assert.False(t, launches.isRunning())
+	assert.False(t, cap.minicapDaemon.IsStarted())
+}
+
+func TestRunCaptureError(t *testing.T) {
+	cap, _ := newDevicelessCapturer(t, 0)
+	cap.minicapDaemon.capture = func() error {
+		return &net.OpError{Op: "read", Net: "tcp", Err: net.ErrClosed} // adb connection closed
+	}
+	select {
+	case err := <-GoFunc(func() error { return cap.Run(context.Background()) }):
+		assert.Equal(t, ErrDeviceDisconnected, errors.Cause(err))
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run not return after capture failed")
+	}
+}
+
+func TestScreenshot(t *testing.T) {
+	frames := make([][]byte, 20)
+	for i := range frames {
+		frames[i] = makeJpeg(t, 72, 128, color.White)
+	}
+	cap := startFakeCapturer(t, frames...)
+	cap.minicapDaemon.screencap = func() (image.Image, error) {
+		t.Error("screencap should not be used when capturing")
+		return nil, errors.New("screencap")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	img, err := cap.Screenshot(ctx)
+	assert.NoError(t, err)
+	if assert.NotNil(t, img) {
+		assert.Equal(t, image.Rect(0, 0, 72, 128), img.Bounds())
+	}
+	assert.NoError(t, cap.Stop())
+
+	// started but minicap send nothing, screencap after a short wait
+	cap, _ = newDevicelessCapturer(t, 0)
+	cap.minicapDaemon.screencap = func() (image.Image, error) {
+		return image.NewRGBA(image.Rect(0, 0, 10, 20)), nil
+	}
+	assert.NoError(t, cap.Start())
+	img, err = cap.Screenshot(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 10, 20), img.Bounds())
+	assert.NoError(t, cap.Stop())
+
+	cap = NewSTFCapturer(nil)
+	cap.minicapDaemon.screencap = func() (image.Image, error) {
+		return image.NewRGBA(image.Rect(0, 0, 10, 20)), nil
+	}
+	img, err = cap.Screenshot(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 10, 20), img.Bounds())
+
+	blockC := make(chan bool)
+	defer close(blockC)
+	cap.minicapDaemon.screencap = func() (image.Image, error) {
+		<-blockC
+		return nil, nil
+	}
+	shortCtx, cancelShort := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelShort()
+	_, err = cap.Screenshot(shortCtx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestStartContext(t *testing.T) {
+	cap, launches := newDevicelessCapturer(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, cap.StartContext(ctx))
+	for !launches.isRunning() {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.NoError(t, cap.Err())
+	cancel()
+	select {
+	case <-GoFunc(cap.Wait):
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait not return after ctx cancelled")
+	}
+	assert.Equal(t, context.Canceled, cap.Err())
+	assert.False(t, cap.minicapDaemon.IsStarted())
+
+	// stopped before ctx done, the capturer can be started again
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, cap.StartContext(ctx))
+	assert.NoError(t, cap.Stop())
+	assert.NoError(t, cap.Err())
+}
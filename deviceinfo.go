@@ -0,0 +1,272 @@
+package stf
+
+import (
+	"bufio"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	adb "github.com/openatx/go-adb"
+	"github.com/pkg/errors"
+)
+
+// BatteryInfo is the battery part of DeviceInfo, the same as the battery of an openstf device
+type BatteryInfo struct {
+	Status  string  `json:"status"` // charging, discharging, not-charging, full or unknown
+	Health  string  `json:"health"`
+	Source  string  `json:"source"` // ac, usb, wireless, or empty when not plugged
+	Level   int     `json:"level"`
+	Scale   int     `json:"scale"`
+	Temp    float64 `json:"temp"`    // celsius
+	Voltage float64 `json:"voltage"` // volt
+}
+
+// NetworkInfo is the network part of DeviceInfo
+type NetworkInfo struct {
+	Connected bool   `json:"connected"`
+	Type      string `json:"type"` // WIFI, MOBILE, ... of the connected network
+}
+
+// UsageInfo is the cpu and memory usage of the device
+type UsageInfo struct {
+	CPU          float64 `json:"cpu"` // 0.0-1.0, since last Refresh or since boot at first
+	MemTotal     int64   `json:"memTotal"`
+	MemAvailable int64   `json:"memAvailable"` // kB
+}
+
+// DeviceFields is the fields of an openstf device
+type DeviceFields struct {
+	Serial       string      `json:"serial"`
+	Manufacturer string      `json:"manufacturer"`
+	Model        string      `json:"model"`
+	Version      string      `json:"version"`
+	SDK          string      `json:"sdk"`
+	ABI          string      `json:"abi"`
+	Display      DisplayInfo `json:"display"`
+	Battery      BatteryInfo `json:"battery"`
+	Network      NetworkInfo `json:"network"`
+	Usage        UsageInfo   `json:"usage"`
+}
+
+// DeviceInfo collect the fields of an openstf device, call Refresh to update them.
+// Use Snapshot or json.Marshal while Refresh may run in another goroutine
+type DeviceInfo struct {
+	DeviceFields
+
+	mu       sync.Mutex
+	props    func() (map[string]string, error)
+	shell    func(cmd string, args ...string) (string, error)
+	cpuTotal int64 // /proc/stat of last Refresh
+	cpuIdle  int64
+}
+
+// NewDeviceInfo create the info of device, it is empty until Refresh called
+func NewDeviceInfo(device *adb.Device) *DeviceInfo {
+	return &DeviceInfo{
+		props: device.Properties,
+		shell: device.RunCommand,
+	}
+}
+
+// Refresh read all fields from the device. Fields are updated even if some part failed,
+// the error is about the failed parts
+func (i *DeviceInfo) Refresh() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	props, err := i.props()
+	if err != nil {
+		return errors.Wrap(err, "read properties")
+	}
+	i.Serial = props["ro.serialno"]
+	i.Manufacturer = props["ro.product.manufacturer"]
+	i.Model = props["ro.product.model"]
+	i.Version = props["ro.build.version.release"]
+	i.SDK = props["ro.build.version.sdk"]
+	if abi, _, err := deviceAbiSdk(props); err == nil {
+		i.ABI = abi
+	}
+
+	var errs []error
+	for _, part := range []struct {
+		name  string
+		cmd   []string
+		parse func(out string) error
+	}{
+		{"display", []string{"wm", "size"}, func(out string) (err error) {
+			i.Display.Width, i.Display.Height, err = parseWmSize(out)
+			return
+		}},
+		{"density", []string{"wm", "density"}, i.parseWmDensity},
+		{"rotation", []string{"dumpsys", "input"}, func(out string) (err error) {
+			i.Display.Rotation, err = parseDisplayRotation(out)
+			return
+		}},
+		{"battery", []string{"dumpsys", "battery"}, func(out string) error {
+			i.Battery = parseBattery(out)
+			return nil
+		}},
+		{"network", []string{"dumpsys", "connectivity"}, func(out string) error {
+			i.Network = parseNetwork(out)
+			return nil
+		}},
+		{"cpu", []string{"cat", "/proc/stat"}, i.parseProcStat},
+		{"memory", []string{"cat", "/proc/meminfo"}, func(out string) error {
+			i.Usage.MemTotal, i.Usage.MemAvailable = parseMeminfo(out)
+			return nil
+		}},
+	} {
+		out, err := i.shell(part.cmd[0], part.cmd[1:]...)
+		if err == nil {
+			err = part.parse(out)
+		}
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, part.name))
+		}
+	}
+	return wrapMultiError(errs...)
+}
+
+// Snapshot return a copy of the fields, consistent even while Refresh is running
+func (i *DeviceInfo) Snapshot() DeviceFields {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.DeviceFields
+}
+
+// MarshalJSON marshal a Snapshot, the fields are flat as in openstf
+func (i *DeviceInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(i.Snapshot())
+}
+
+var wmSizePattern = regexp.MustCompile(`(?:Physical|Override) size:\s*(\d+)x(\d+)`)
+
+// parseWmSize read "Physical size: 1080x1920", the override size is used if set
+func parseWmSize(out string) (width, height int, err error) {
+	matches := wmSizePattern.FindAllStringSubmatch(out, -1)
+	if len(matches) == 0 {
+		return 0, 0, errors.New("no size in wm size output")
+	}
+	last := matches[len(matches)-1]
+	width, _ = strconv.Atoi(last[1])
+	height, _ = strconv.Atoi(last[2])
+	return
+}
+
+var wmDensityPattern = regexp.MustCompile(`(?:Physical|Override) density:\s*(\d+)`)
+
+// parseWmDensity read "Physical density: 480", density is dpi/160 as android DisplayMetrics
+func (i *DeviceInfo) parseWmDensity(out string) error {
+	matches := wmDensityPattern.FindAllStringSubmatch(out, -1)
+	if len(matches) == 0 {
+		return errors.New("no density in wm density output")
+	}
+	dpi, _ := strconv.Atoi(matches[len(matches)-1][1])
+	i.Display.Xdpi, i.Display.Ydpi = float32(dpi), float32(dpi)
+	i.Display.Density = float32(dpi) / 160
+	return nil
+}
+
+// names of BatteryManager constants, as openstf reports them
+var (
+	batteryStatuses = map[int]string{1: "unknown", 2: "charging", 3: "discharging", 4: "not-charging", 5: "full"}
+	batteryHealths  = map[int]string{1: "unknown", 2: "good", 3: "overheat", 4: "dead", 5: "over-voltage",
+		6: "unspecified-failure", 7: "cold"}
+)
+
+// parseBattery read the output of dumpsys battery
+func parseBattery(out string) (b BatteryInfo) {
+	b.Status, b.Health = "unknown", "unknown"
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		n, _ := strconv.Atoi(value)
+		switch key {
+		case "AC powered", "USB powered", "Wireless powered":
+			if value == "true" {
+				b.Source = strings.ToLower(strings.Fields(key)[0])
+			}
+		case "status":
+			if s, ok := batteryStatuses[n]; ok {
+				b.Status = s
+			}
+		case "health":
+			if h, ok := batteryHealths[n]; ok {
+				b.Health = h
+			}
+		case "level":
+			b.Level = n
+		case "scale":
+			b.Scale = n
+		case "temperature":
+			b.Temp = float64(n) / 10
+		case "voltage":
+			b.Voltage = float64(n) / 1000
+		}
+	}
+	return
+}
+
+var connectedNetworkPattern = regexp.MustCompile(`type: (\w+)\[[^\]]*\], state: CONNECTED`)
+
+// parseNetwork find the connected network in dumpsys connectivity
+func parseNetwork(out string) NetworkInfo {
+	if m := connectedNetworkPattern.FindStringSubmatch(out); m != nil {
+		return NetworkInfo{Connected: true, Type: m[1]}
+	}
+	return NetworkInfo{}
+}
+
+// parseProcStat compute the cpu usage from the first line of /proc/stat
+func (i *DeviceInfo) parseProcStat(out string) error {
+	line := strings.SplitN(out, "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return errors.New("no cpu line in /proc/stat")
+	}
+	var total, idle int64
+	for idx, field := range fields[1:] {
+		n, _ := strconv.ParseInt(field, 10, 64)
+		total += n
+		if idx == 3 || idx == 4 { // idle and iowait
+			idle += n
+		}
+	}
+	dTotal, dIdle := total-i.cpuTotal, idle-i.cpuIdle
+	i.cpuTotal, i.cpuIdle = total, idle
+	if dTotal > 0 {
+		i.Usage.CPU = 1 - float64(dIdle)/float64(dTotal)
+	}
+	return nil
+}
+
+// parseMeminfo return MemTotal and MemAvailable in kB, MemFree is used before android 4.4
+func parseMeminfo(out string) (total, available int64) {
+	var free int64 = -1
+	available = -1
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		n, _ := strconv.ParseInt(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			total = n
+		case "MemAvailable:":
+			available = n
+		case "MemFree:":
+			free = n
+		}
+	}
+	if available == -1 {
+		available = free
+	}
+	return
+}
@@ -0,0 +1,148 @@
+package stf
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	dumpsysBattery = `Current Battery Service state:
+  AC powered: false
+  USB powered: true
+  Wireless powered: false
+  status: 2
+  health: 2
+  present: true
+  level: 85
+  scale: 100
+  voltage: 4213
+  temperature: 287
+  technology: Li-ion
+`
+	dumpsysConnectivity = `NetworkAgentInfos:
+  NetworkAgentInfo{ ni{[type: MOBILE[LTE], state: DISCONNECTED/DISCONNECTED, reason: (unspecified)]}  network{100} }
+  NetworkAgentInfo{ ni{[type: WIFI[], state: CONNECTED/CONNECTED, reason: (unspecified), extra: "ssid"]}  network{101} }
+`
+	procMeminfo = `MemTotal:        3809036 kB
+MemFree:          146392 kB
+MemAvailable:    1601804 kB
+Buffers:           36572 kB
+`
+)
+
+func newFakeDeviceInfo(outputs map[string]string) *DeviceInfo {
+	return &DeviceInfo{
+		props: func() (map[string]string, error) {
+			return map[string]string{
+				"ro.serialno":              "EP7333W7XB",
+				"ro.product.manufacturer":  "Sony",
+				"ro.product.model":         "E6653",
+				"ro.build.version.release": "7.1.1",
+				"ro.build.version.sdk":     "25",
+				"ro.product.cpu.abi":       "arm64-v8a",
+			}, nil
+		},
+		shell: func(cmd string, args ...string) (string, error) {
+			if len(args) > 0 {
+				cmd += " " + args[0]
+			}
+			out, ok := outputs[cmd]
+			if !ok {
+				return "", errors.New("not found")
+			}
+			return out, nil
+		},
+	}
+}
+
+func TestDeviceInfoRefresh(t *testing.T) {
+	outputs := map[string]string{
+		"wm size":              "Physical size: 1080x1920\nOverride size: 720x1280\n",
+		"wm density":           "Physical density: 480\n",
+		"dumpsys input":        "    SurfaceOrientation: 1\n",
+		"dumpsys battery":      dumpsysBattery,
+		"dumpsys connectivity": dumpsysConnectivity,
+		"cat /proc/stat":       "cpu  100 0 100 700 100 0 0 0 0 0\ncpu0 50 0 50 350 50 0 0 0 0 0\n",
+		"cat /proc/meminfo":    procMeminfo,
+	}
+	info := newFakeDeviceInfo(outputs)
+	assert.NoError(t, info.Refresh())
+	assert.Equal(t, "EP7333W7XB", info.Serial)
+	assert.Equal(t, "Sony", info.Manufacturer)
+	assert.Equal(t, "E6653", info.Model)
+	assert.Equal(t, "7.1.1", info.Version)
+	assert.Equal(t, "25", info.SDK)
+	assert.Equal(t, "arm64-v8a", info.ABI)
+
+	assert.Equal(t, 720, info.Display.Width, "override size is used")
+	assert.Equal(t, 1280, info.Display.Height)
+	assert.Equal(t, float32(3), info.Display.Density)
+	assert.Equal(t, 90, info.Display.Rotation)
+
+	assert.Equal(t, BatteryInfo{Status: "charging", Health: "good", Source: "usb",
+		Level: 85, Scale: 100, Temp: 28.7, Voltage: 4.213}, info.Battery)
+	assert.Equal(t, NetworkInfo{Connected: true, Type: "WIFI"}, info.Network)
+
+	assert.InDelta(t, 0.2, info.Usage.CPU, 0.001)
+	assert.Equal(t, int64(3809036), info.Usage.MemTotal)
+	assert.Equal(t, int64(1601804), info.Usage.MemAvailable)
+
+	// usage since the last refresh
+	outputs["cat /proc/stat"] = "cpu  150 0 150 800 100 0 0 0 0 0\n"
+	assert.NoError(t, info.Refresh())
+	assert.InDelta(t, 0.5, info.Usage.CPU, 0.001)
+
+	data, err := json.Marshal(info)
+	assert.NoError(t, err)
+	var fields map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &fields))
+	for _, key := range []string{"serial", "manufacturer", "model", "version", "sdk", "abi", "display", "battery", "network"} {
+		assert.Contains(t, fields, key)
+	}
+	assert.Equal(t, 85.0, fields["battery"].(map[string]interface{})["level"])
+	assert.Equal(t, info.DeviceFields, info.Snapshot())
+}
+
+func TestDeviceInfoConcurrentMarshal(t *testing.T) {
+	info := newFakeDeviceInfo(map[string]string{
+		"dumpsys battery": dumpsysBattery,
+	})
+	doneC := make(chan bool)
+	go func() {
+		defer close(doneC)
+		for i := 0; i < 20; i++ {
+			info.Refresh()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		_, err := json.Marshal(info)
+		assert.NoError(t, err)
+		info.Snapshot()
+	}
+	<-doneC
+	assert.Equal(t, 85, info.Snapshot().Battery.Level)
+}
+
+func TestDeviceInfoRefreshPartial(t *testing.T) {
+	info := newFakeDeviceInfo(map[string]string{
+		"dumpsys battery": dumpsysBattery,
+	})
+	err := info.Refresh()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "display")
+	assert.Equal(t, "E6653", info.Model)
+	assert.Equal(t, 85, info.Battery.Level, "parts are read even if others failed")
+}
+
+func TestParseMeminfoWithoutAvailable(t *testing.T) {
+	total, available := parseMeminfo("MemTotal: 1000 kB\nMemFree: 300 kB\n")
+	assert.Equal(t, int64(1000), total)
+	assert.Equal(t, int64(300), available)
+}
+
+func TestParseNetworkDisconnected(t *testing.T) {
+	assert.Equal(t, NetworkInfo{}, parseNetwork("  NetworkAgentInfo{ ni{[type: WIFI[], state: DISCONNECTED/DISCONNECTED]} }"))
+}
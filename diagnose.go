@@ -0,0 +1,197 @@
+package stf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	adb "github.com/openatx/go-adb"
+	"github.com/pkg/errors"
+)
+
+// DiagnosticStep is the result of one check done by Diagnose
+type DiagnosticStep struct {
+	Name     string        `json:"name"`
+	OK       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// DiagnosticReport tell which step of screen capturing is broken on a device
+type DiagnosticReport struct {
+	Steps []DiagnosticStep `json:"steps"`
+	ABI   string           `json:"abi"`
+	SDK   string           `json:"sdk"`
+	FPS   float64          `json:"fps"`
+}
+
+// OK return true if all steps passed
+func (r DiagnosticReport) OK() bool {
+	for _, step := range r.Steps {
+		if !step.OK {
+			return false
+		}
+	}
+	return len(r.Steps) > 0
+}
+
+func (r DiagnosticReport) String() string {
+	lines := make([]string, 0, len(r.Steps)+1)
+	for _, step := range r.Steps {
+		status := "ok"
+		if !step.OK {
+			status = "FAIL " + step.Error
+		}
+		lines = append(lines, fmt.Sprintf("%-12s %8v %s", step.Name, step.Duration.Round(time.Millisecond), status))
+	}
+	lines = append(lines, fmt.Sprintf("abi=%s sdk=%s fps=%.1f", r.ABI, r.SDK, r.FPS))
+	return strings.Join(lines, "\n")
+}
+
+const diagnoseFPSWindow = 2 * time.Second
+
+// Diagnose run every step of screen capturing once and report which one failed.
+// The error is the one of the first failed step, following steps are not run
+func Diagnose(ctx context.Context, device *adb.Device) (DiagnosticReport, error) {
+	m := newMinicapDaemon(nil, device)
+	s := newJpgTcpSucker(device)
+	return diagnose(ctx, m, s, diagnoseFPSWindow)
+}
+
+func diagnose(ctx context.Context, m *minicapDaemon, s *jpgTcpSucker, fpsWindow time.Duration) (report DiagnosticReport, err error) {
+	step := func(name string, f func() error) error {
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		err = f()
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		result := DiagnosticStep{Name: name, OK: err == nil, Duration: time.Since(start)}
+		if err != nil {
+			result.Error = err.Error()
+			err = errors.Wrap(err, name)
+		}
+		report.Steps = append(report.Steps, result)
+		return err
+	}
+
+	step("abi/sdk", func() (err error) {
+		report.ABI, report.SDK, err = m.detectAbiSdk()
+		return
+	})
+	step("binaries", func() error {
+		return m.pushFiles(ctx, false)
+	})
+	step("minicap -i", m.probe)
+	step("forward", func() (err error) {
+		s.forwardSpec = minicapForwardSpec(m.binaryPath)
+		s.port, err = s.prepareForward(ctx)
+		return
+	})
+	if err != nil {
+		return
+	}
+	defer s.removeForward(adb.ForwardSpec{Protocol: adb.FProtocolTcp, PortOrName: strconv.Itoa(s.port)})
+
+	captureErrC := make(chan error, 1)
+	go func() {
+		captureErrC <- m.capture()
+	}()
+	defer m.kill()
+	wait := s.bannerTimeout
+	if wait <= 0 {
+		wait = defaultBannerTimeout
+	}
+	var conn net.Conn
+	var bufrd *bufio.Reader
+	var banner []byte
+	step("banner", func() (err error) {
+		deadline := time.Now().Add(wait)
+		for {
+			conn, bufrd, banner, err = s.dialBanner(ctx)
+			if err == nil || time.Now().After(deadline) {
+				return
+			}
+			select {
+			case err = <-captureErrC:
+				return errors.Wrap(err, "minicap quit")
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	C := s.Subscribe()
+	defer s.Unsubscribe(C)
+	readErrC := make(chan error, 1)
+	go func() {
+		readErrC <- s.readFrames(io.MultiReader(bytes.NewReader(banner), bufrd))
+	}()
+	step("first frame", func() error {
+		select {
+		case <-C:
+			return nil
+		case err := <-readErrC:
+			if err == nil {
+				err = io.EOF
+			}
+			return errors.Wrap(err, "read frames")
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+			return errors.New("no frame received")
+		}
+	})
+	step("fps", func() error {
+		start, frames := time.Now(), 0
+		timeout := time.After(fpsWindow)
+		for {
+			select {
+			case <-C:
+				frames++
+			case <-readErrC:
+				report.FPS = float64(frames) / time.Since(start).Seconds()
+				return nil // the screen may stop changing
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timeout:
+				report.FPS = float64(frames) / time.Since(start).Seconds()
+				return nil
+			}
+		}
+	})
+	return
+}
+
+// dialBanner connect to the forwarded port and read the raw minicap banner
+func (s *jpgTcpSucker) dialBanner(ctx context.Context) (conn net.Conn, bufrd *bufio.Reader, banner []byte, err error) {
+	conn, err = s.dial(ctx)
+	if err != nil {
+		return
+	}
+	if s.bannerTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.bannerTimeout))
+	}
+	bufrd = bufio.NewReader(conn)
+	raw := bytes.NewBuffer(nil)
+	if _, err = readBanner(io.TeeReader(bufrd, raw)); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	banner = raw.Bytes()
+	return
+}
@@ -0,0 +1,74 @@
+package stf
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	adb "github.com/openatx/go-adb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeDiagnose(port int) (*minicapDaemon, *jpgTcpSucker, *[]adb.ForwardSpec) {
+	m := newMinicapDaemon(nil, nil)
+	m.props = map[string]string{
+		"ro.product.cpu.abi":   "arm64-v8a",
+		"ro.build.version.sdk": "25",
+	}
+	m.SetNoPush(true)
+	m.exists = func(path string) bool { return true }
+	m.probe = func() error { return nil }
+	stopC := make(chan bool)
+	m.capture = func() error {
+		<-stopC
+		return nil
+	}
+	m.kill = func() error {
+		close(stopC)
+		return nil
+	}
+	s := newJpgTcpSucker(nil)
+	var removed []adb.ForwardSpec
+	s.forward = func(remote adb.ForwardSpec) (int, error) {
+		if remote != minicapForwardSpec(m.binaryPath) {
+			return 0, errors.New("forward to the wrong socket")
+		}
+		return port, nil
+	}
+	s.removeForward = func(local adb.ForwardSpec) error {
+		removed = append(removed, local)
+		return nil
+	}
+	return m, s, &removed
+}
+
+func TestDiagnose(t *testing.T) {
+	frames := make([][]byte, 30)
+	for i := range frames {
+		frames[i] = fakeJpeg
+	}
+	port := fakeMinicapServer(t, 0, frames...)
+	m, s, removed := newFakeDiagnose(port)
+	m.probe = func() error {
+		m.binaryPath = "/data/local/tmp/slow-minicap"
+		return nil
+	}
+	report, err := diagnose(context.Background(), m, s, 100*time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), report.String())
+	assert.Equal(t, 7, len(report.Steps))
+	assert.Equal(t, "arm64-v8a", report.ABI)
+	assert.Equal(t, "25", report.SDK)
+	assert.True(t, report.FPS > 0)
+	assert.Equal(t, []adb.ForwardSpec{{Protocol: adb.FProtocolTcp, PortOrName: strconv.Itoa(port)}}, *removed)
+
+	m, s, _ = newFakeDiagnose(0)
+	m.probe = func() error { return errors.New("minicap -i crashed") }
+	report, err = diagnose(context.Background(), m, s, 100*time.Millisecond)
+	assert.Error(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, 3, len(report.Steps), "stop at the failed step")
+	assert.Equal(t, "minicap -i", report.Steps[2].Name)
+}
@@ -0,0 +1,119 @@
+package stf
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var rotationPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`SurfaceOrientation:\s*(\d)`),               // dumpsys input
+	regexp.MustCompile(`mCurrentRotation=(?:ROTATION_)?(\d+)`),     // dumpsys window displays, android 10+
+	regexp.MustCompile(`\bmRotation=(?:ROTATION_)?(\d+)`),          // dumpsys window displays
+	regexp.MustCompile(`\bmCurrentOrientation=(?:ROTATION_)?(\d)`), // dumpsys display
+}
+
+// parseDisplayRotation find the display rotation in dumpsys output, return 0, 90, 180 or 270
+func parseDisplayRotation(out string) (int, error) {
+	for _, pattern := range rotationPatterns {
+		matches := pattern.FindStringSubmatch(out)
+		if matches == nil {
+			continue
+		}
+		v, _ := strconv.Atoi(matches[1])
+		switch {
+		case v >= 0 && v <= 3:
+			return v * 90, nil
+		case v == 90 || v == 180 || v == 270:
+			return v, nil
+		}
+		return 0, errors.New("unknown rotation " + matches[0])
+	}
+	return 0, errors.New("no rotation found in dumpsys output")
+}
+
+var refreshRatePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\bmRefreshRate=([\d.]+)`),             // dumpsys display, DisplayModeRecord
+	regexp.MustCompile(`DisplayInfo\{[^}]*?,\s*([\d.]+) fps`), // dumpsys display, mBaseDisplayInfo
+	regexp.MustCompile(`refresh-rate\s*:\s*([\d.]+)`),         // dumpsys SurfaceFlinger
+}
+
+// parseRefreshRate find the display refresh rate (Hz) in dumpsys output
+func parseRefreshRate(out string) (float64, error) {
+	for _, pattern := range refreshRatePatterns {
+		matches := pattern.FindStringSubmatch(out)
+		if matches == nil {
+			continue
+		}
+		v, err := strconv.ParseFloat(matches[1], 64)
+		if err != nil || v <= 0 || v > 1000 {
+			return 0, errors.New("invalid refresh rate " + matches[0])
+		}
+		return v, nil
+	}
+	return 0, errors.New("no refresh rate found in dumpsys output")
+}
+
+// RefreshRate read the display refresh rate in Hz through dumpsys
+func (m *minicapDaemon) RefreshRate() (float64, error) {
+	var err error
+	for _, service := range []string{"display", "SurfaceFlinger"} {
+		var out string
+		out, err = m.shell("dumpsys", service)
+		if err != nil {
+			continue
+		}
+		var rate float64
+		if rate, err = parseRefreshRate(out); err == nil {
+			return rate, nil
+		}
+	}
+	return 0, errors.Wrap(err, "refresh rate")
+}
+
+// DeviceRotation read the current display rotation through dumpsys
+func (m *minicapDaemon) DeviceRotation() (int, error) {
+	var err error
+	for _, args := range [][]string{{"input"}, {"window", "displays"}} {
+		var out string
+		out, err = m.shell("dumpsys", args...)
+		if err != nil {
+			continue
+		}
+		var r int
+		if r, err = parseDisplayRotation(out); err == nil {
+			return r, nil
+		}
+	}
+	return 0, errors.Wrap(err, "device rotation")
+}
+
+// PollDeviceRotation read the device rotation every interval and restart minicap
+// when it changed, so frames follow the device without a rotation watcher.
+// Block until ctx is done
+func (m *minicapDaemon) PollDeviceRotation(ctx context.Context, interval time.Duration) error {
+	return m.pollRotation(ctx, interval, m.SetRotation)
+}
+
+// pollRotation call onChange with the device rotation when it changed
+func (m *minicapDaemon) pollRotation(ctx context.Context, interval time.Duration, onChange func(int)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := m.currentRotation()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		r, err := m.DeviceRotation()
+		if err != nil || r == last {
+			continue
+		}
+		last = r
+		onChange(r)
+	}
+}
@@ -0,0 +1,51 @@
+package stf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDisplayRotation(t *testing.T) {
+	cases := []struct {
+		out      string
+		rotation int
+	}{
+		{"  Viewport: displayId=0\n    SurfaceOrientation: 1\n    Translation: ...", 90},
+		{"Display: mDisplayId=0\n  mRotation=2 mAltOrientation=false", 180},
+		{"  mCurrentRotation=ROTATION_270 mLastOrientation=-1", 270},
+		{"  mCurrentRotation=0", 0},
+		{"DisplayDeviceInfo mCurrentOrientation=3", 270},
+	}
+	for _, c := range cases {
+		r, err := parseDisplayRotation(c.out)
+		assert.NoError(t, err, c.out)
+		assert.Equal(t, c.rotation, r, c.out)
+	}
+
+	_, err := parseDisplayRotation("Can't find service: input")
+	assert.Error(t, err)
+	_, err = parseDisplayRotation("SurfaceOrientation: 7")
+	assert.Error(t, err)
+}
+
+func TestParseRefreshRate(t *testing.T) {
+	cases := []struct {
+		out  string
+		rate float64
+	}{
+		{"  DisplayModeRecord{mMode={id=2, width=1080, height=2400, fps=120.0}}\n  mRefreshRate=120.0", 120},
+		{`mBaseDisplayInfo=DisplayInfo{"Built-in Screen", displayId 0, real 1440 x 3200, 120.00001 fps, supportedRefreshRates [60.0, 120.00001]}`, 120.00001},
+		{"Display 0 HWC layers:\n  refresh-rate              : 90.000000 fps", 90},
+	}
+	for _, c := range cases {
+		rate, err := parseRefreshRate(c.out)
+		assert.NoError(t, err, c.out)
+		assert.Equal(t, c.rate, rate, c.out)
+	}
+
+	_, err := parseRefreshRate("Can't find service: display")
+	assert.Error(t, err)
+	_, err = parseRefreshRate("mRefreshRate=0.0")
+	assert.Error(t, err)
+}
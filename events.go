@@ -0,0 +1,45 @@
+package stf
+
+import "time"
+
+type EventType int
+
+const (
+	// EventMinicapRestart minicap quit unexpectedly and is relaunched, Err is why it quit
+	EventMinicapRestart EventType = iota
+	// EventDegradedMode minicap keep failing, frames come from screencap polling
+	EventDegradedMode
+	// EventMaxDurationReached the capturer is stopped by SetMaxDuration
+	EventMaxDurationReached
+	// EventSecureDisplay the display is secure (DRM), frames are probably black
+	EventSecureDisplay
+	// EventDeviceDisconnected the adb connection is closed, the capturer stopped
+	EventDeviceDisconnected
+	// EventFrameSizeAnomaly a frame is much smaller or larger than the average, Seq and Size are set
+	EventFrameSizeAnomaly
+	// EventTouchDisconnected the minitouch socket is dead, Err is the write error
+	EventTouchDisconnected
+	// EventTouchReconnected the minitouch socket is connected again
+	EventTouchReconnected
+)
+
+// Event report something happened inside the capturer
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Message string
+	Err     error
+	Seq     uint64 // frame of EventFrameSizeAnomaly
+	Size    int    // frame size of EventFrameSizeAnomaly
+}
+
+// emitEvent never block, events are dropped when nobody reading
+func emitEvent(C chan Event, typ EventType, message string, err error) {
+	if C == nil {
+		return
+	}
+	select {
+	case C <- Event{Type: typ, Time: time.Now(), Message: message, Err: err}:
+	default:
+	}
+}
@@ -0,0 +1,217 @@
+package stf
+
+import (
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// Frame is a jpeg image read from minicap with some metadata
+type Frame struct {
+	Data     []byte
+	Seq      uint64    // increase by one for every frame read, gap means dropped
+	Time     time.Time // time when the frame was read
+	Rotation int       // 0, 90, 180, 270
+	Width    int       // virtual width from the minicap banner
+	Height   int       // virtual height from the minicap banner
+	Checksum uint32    // crc32 (IEEE) of Data, 0 if checksum disabled
+	Format   FrameFormat
+}
+
+// FrameFormat is the image format of Frame.Data
+type FrameFormat int
+
+const (
+	FormatJPEG FrameFormat = iota // from minicap
+	FormatPNG                     // from screencap in ScreencapMode
+	FormatH264                    // one NAL unit without start code, from H264Capturer
+)
+
+// MimeType return the content type of the format
+func (f FrameFormat) MimeType() string {
+	switch f {
+	case FormatPNG:
+		return "image/png"
+	case FormatH264:
+		return "video/h264"
+	}
+	return "image/jpeg"
+}
+
+// Ext return the file extension of the format, with the leading dot
+func (f FrameFormat) Ext() string {
+	switch f {
+	case FormatPNG:
+		return ".png"
+	case FormatH264:
+		return ".h264"
+	}
+	return ".jpg"
+}
+
+// FrameMeta is Frame without Data
+type FrameMeta struct {
+	Seq      uint64
+	Time     time.Time
+	Rotation int
+	Width    int
+	Height   int
+	Checksum uint32
+	Format   FrameFormat
+}
+
+// Meta return the metadata of the frame
+func (f Frame) Meta() FrameMeta {
+	return FrameMeta{
+		Seq:      f.Seq,
+		Time:     f.Time,
+		Rotation: f.Rotation,
+		Width:    f.Width,
+		Height:   f.Height,
+		Checksum: f.Checksum,
+		Format:   f.Format,
+	}
+}
+
+// Dropped return the number of frames missed between prev and f, which are received in order
+func (f Frame) Dropped(prev Frame) uint64 {
+	if f.Seq <= prev.Seq+1 {
+		return 0
+	}
+	return f.Seq - prev.Seq - 1
+}
+
+// Latency return how long ago the frame was read from minicap
+func (f Frame) Latency() time.Duration {
+	return time.Since(f.Time)
+}
+
+// Reoriented return true if the rotation or the size changed since prev,
+// consumers should resize their view
+func (f Frame) Reoriented(prev Frame) bool {
+	return f.Rotation != prev.Rotation || f.Width != prev.Width || f.Height != prev.Height
+}
+
+// DataURI return the frame as data:image/jpeg;base64,... which can be used in html directly
+func (f Frame) DataURI() string {
+	return "data:" + f.Format.MimeType() + ";base64," + base64.StdEncoding.EncodeToString(f.Data)
+}
+
+// FrameHub broadcast frames to multiple subscribers
+type FrameHub struct {
+	mu          sync.Mutex
+	subscribers map[chan Frame]bool
+	changedC    chan bool
+	last        *Frame // the latest published frame
+}
+
+func newFrameHub() *FrameHub {
+	return &FrameHub{
+		subscribers: make(map[chan Frame]bool),
+		changedC:    make(chan bool, 1),
+	}
+}
+
+func (h *FrameHub) Subscribe() chan Frame {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	C := make(chan Frame, 3)
+	h.subscribers[C] = true
+	h.notify()
+	return C
+}
+
+// unsubscribe will also close channel
+func (h *FrameHub) Unsubscribe(C chan Frame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.subscribers[C] {
+		return
+	}
+	delete(h.subscribers, C)
+	close(C)
+	h.notify()
+}
+
+func (h *FrameHub) notify() {
+	select {
+	case h.changedC <- true:
+	default:
+	}
+}
+
+// SubscriberCount return the number of channels subscribed and not unsubscribed yet,
+// OnFrame callbacks are counted too
+func (h *FrameHub) SubscriberCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+// LastFrame return the latest published frame, false if none published since the last reset
+func (h *FrameHub) LastFrame() (Frame, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.last == nil {
+		return Frame{}, false
+	}
+	return *h.last, true
+}
+
+// resetLastFrame forget the latest frame, e.g. it is from the last run
+func (h *FrameHub) resetLastFrame() {
+	h.mu.Lock()
+	h.last = nil
+	h.mu.Unlock()
+}
+
+// pub never block, slow subscriber will miss frames
+func (h *FrameHub) pub(f Frame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = &f
+	for subC := range h.subscribers {
+		select {
+		case subC <- f:
+		default:
+		}
+	}
+}
+
+// waitSubscribers block until someone subscribed, return false if quitC received
+func (h *FrameHub) waitSubscribers(quitC chan bool) bool {
+	for h.SubscriberCount() == 0 {
+		select {
+		case <-h.changedC:
+		case <-quitC:
+			return false
+		}
+	}
+	return true
+}
+
+// waitIdle block until all subscribers gone or doneC closed
+func (h *FrameHub) waitIdle(doneC chan bool) bool {
+	for h.SubscriberCount() > 0 {
+		select {
+		case <-h.changedC:
+		case <-doneC:
+			return false
+		}
+	}
+	return true
+}
+
+// OnFrame call fn with every frame in a dedicated goroutine until the returned cancel called.
+// A slow fn never block reading, but it will miss frames
+func (h *FrameHub) OnFrame(fn func(Frame)) (cancel func()) {
+	subC := h.Subscribe()
+	go func() {
+		for frame := range subC {
+			fn(frame)
+		}
+	}()
+	return func() {
+		h.Unsubscribe(subC)
+	}
+}
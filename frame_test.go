@@ -0,0 +1,105 @@
+package stf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameDataURI(t *testing.T) {
+	frame := Frame{Data: fakeJpeg}
+	uri := frame.DataURI()
+	prefix := "data:image/jpeg;base64,"
+	assert.True(t, strings.HasPrefix(uri, prefix))
+	data, err := base64.StdEncoding.DecodeString(uri[len(prefix):])
+	assert.NoError(t, err)
+	assert.Equal(t, fakeJpeg, data)
+
+	frame.Format = FormatPNG
+	assert.True(t, strings.HasPrefix(frame.DataURI(), "data:image/png;base64,"))
+}
+
+func TestFrameMetadata(t *testing.T) {
+	prev := Frame{Seq: 10, Width: 720, Height: 1280, Time: time.Now()}
+	assert.Equal(t, uint64(0), Frame{Seq: 11}.Dropped(prev))
+	assert.Equal(t, uint64(3), Frame{Seq: 14}.Dropped(prev))
+	assert.Equal(t, uint64(0), Frame{Seq: 1}.Dropped(prev), "seq restarted")
+
+	assert.True(t, Frame{Time: time.Now().Add(-time.Second)}.Latency() >= time.Second)
+
+	assert.False(t, Frame{Width: 720, Height: 1280}.Reoriented(prev))
+	assert.True(t, Frame{Width: 1280, Height: 720, Rotation: 90}.Reoriented(prev))
+}
+
+func TestOnFrame(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	calledC := make(chan int, 6)
+	for i := 0; i < 2; i++ {
+		i := i
+		s.OnFrame(func(f Frame) {
+			calledC <- i
+		})
+	}
+	stream := bytes.NewBuffer(nil)
+	writeMinicapBanner(stream, 720, 1280, 0)
+	for i := 0; i < 3; i++ {
+		writeMinicapFrame(stream, fakeJpeg)
+	}
+	s.readFrames(stream)
+
+	counts := make([]int, 2)
+	for n := 0; n < 6; n++ {
+		select {
+		case i := <-calledC:
+			counts[i]++
+		case <-time.After(time.Second):
+			t.Fatalf("callbacks called %v times", counts)
+		}
+	}
+	assert.Equal(t, []int{3, 3}, counts)
+}
+
+func TestSubscriberCount(t *testing.T) {
+	h := newFrameHub()
+	assert.Equal(t, 0, h.SubscriberCount())
+	C1 := h.Subscribe()
+	C2 := h.Subscribe()
+	cancel := h.OnFrame(func(Frame) {})
+	assert.Equal(t, 3, h.SubscriberCount())
+	h.Unsubscribe(C1)
+	h.Unsubscribe(C1) // twice is no-op
+	assert.Equal(t, 2, h.SubscriberCount())
+	cancel()
+	h.Unsubscribe(C2)
+	assert.Equal(t, 0, h.SubscriberCount())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.Unsubscribe(h.Subscribe())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 0, h.SubscriberCount())
+}
+
+func TestFrameHubLastFrame(t *testing.T) {
+	h := newFrameHub()
+	_, ok := h.LastFrame()
+	assert.False(t, ok)
+	h.pub(Frame{Seq: 1})
+	h.pub(Frame{Seq: 2})
+	frame, ok := h.LastFrame()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), frame.Seq)
+	h.resetLastFrame()
+	_, ok = h.LastFrame()
+	assert.False(t, ok)
+}
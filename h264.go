@@ -0,0 +1,236 @@
+package stf
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	adb "github.com/openatx/go-adb"
+	"github.com/pkg/errors"
+)
+
+// Capturer is a screen capturing backend, frames are received from Frames between Start and Stop
+type Capturer interface {
+	Servicer
+	Frames() <-chan Frame
+}
+
+// Frames return the channel of frames, the same as FrameC
+func (s *STFCapturer) Frames() <-chan Frame {
+	return s.FrameC
+}
+
+const (
+	defaultH264BitRate = 4000000
+	maxNALUnitSize     = 4 << 20 // a key frame of a 4k screen fit in it
+	// screenrecordTimeLimit is when screenrecord quit by itself, a run close to it is relaunched
+	// even if it sent nothing
+	screenrecordTimeLimit = 3*time.Minute - 10*time.Second
+)
+
+// H264Capturer stream the screen as h264 with screenrecord, which use much less bandwidth than jpeg.
+// Every Frame is one NAL unit with Format FormatH264. screenrecord quit after 3 minutes,
+// it is relaunched until Stop called, so there is a new SPS/PPS at that time
+type H264Capturer struct {
+	C       chan Frame
+	bitRate int
+	size    string // WxH passed by --size, empty for the display size
+	seq     uint64
+	open    func() (io.ReadCloser, error) // launch screenrecord
+	mu      sync.Mutex
+	stream  io.ReadCloser
+	quitC   chan bool
+
+	*adb.Device
+	errorMixin
+	safeMixin
+}
+
+// NewH264Capturer create a h264 capturer of device
+func NewH264Capturer(device *adb.Device) *H264Capturer {
+	s := &H264Capturer{
+		C:       make(chan Frame, 30),
+		bitRate: defaultH264BitRate,
+		Device:  device,
+	}
+	s.open = func() (io.ReadCloser, error) {
+		return s.OpenCommand("screenrecord", s.screenrecordArgs()...)
+	}
+	return s
+}
+
+// SetBitRate set the bit rate in bits per second, it take effect at next Start
+func (s *H264Capturer) SetBitRate(bitRate int) {
+	if bitRate > 0 {
+		s.bitRate = bitRate
+	}
+}
+
+// SetSize scale the video to width x height, 0 to use the display size. It take effect at next Start
+func (s *H264Capturer) SetSize(width, height int) {
+	if width <= 0 || height <= 0 {
+		s.size = ""
+		return
+	}
+	s.size = strconv.Itoa(width) + "x" + strconv.Itoa(height)
+}
+
+func (s *H264Capturer) screenrecordArgs() []string {
+	args := []string{"--output-format=h264", "--bit-rate", strconv.Itoa(s.bitRate)}
+	if s.size != "" {
+		args = append(args, "--size", s.size)
+	}
+	return append(args, "-")
+}
+
+// Frames return the channel of NAL units, the same as C
+func (s *H264Capturer) Frames() <-chan Frame {
+	return s.C
+}
+
+func (s *H264Capturer) Start() error {
+	return s.safeDo(_ACTION_START, func() error {
+		s.resetError()
+		stream, err := s.open()
+		if err != nil {
+			return errors.Wrap(err, "screenrecord")
+		}
+		s.setStream(stream)
+		s.quitC = make(chan bool)
+		go s.run(stream)
+		return nil
+	})
+}
+
+func (s *H264Capturer) Stop() error {
+	return s.safeDo(_ACTION_STOP, func() error {
+		close(s.quitC)
+		s.setStream(nil)
+		return s.Wait()
+	})
+}
+
+// setStream close the current screenrecord output and replace it
+func (s *H264Capturer) setStream(stream io.ReadCloser) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stream != nil {
+		s.stream.Close()
+	}
+	s.stream = stream
+}
+
+// run read NAL units and relaunch screenrecord when it quit at the time limit.
+// A screenrecord which quit early without any NAL unit failed, its output is returned as the error
+func (s *H264Capturer) run(stream io.ReadCloser) {
+	var err error
+	defer func() {
+		s.doneError(err)
+	}()
+	for {
+		launchedAt := time.Now()
+		head := &headWriter{max: 512}
+		var units int
+		units, err = s.readNALUnits(io.TeeReader(stream, head))
+		select {
+		case <-s.quitC:
+			err = nil
+			return
+		default:
+		}
+		if err != nil {
+			err = errors.Wrap(err, "read screenrecord")
+			return
+		}
+		if units == 0 && time.Since(launchedAt) < screenrecordTimeLimit {
+			err = errors.Errorf("screenrecord quit without output: %s", strings.TrimSpace(head.buf.String()))
+			return
+		}
+		if stream, err = s.open(); err != nil {
+			err = errors.Wrap(err, "relaunch screenrecord")
+			return
+		}
+		select {
+		case <-s.quitC: // stopped while relaunching
+			stream.Close()
+			return
+		default:
+		}
+		s.setStream(stream)
+	}
+}
+
+// headWriter keep the first max bytes written to it
+type headWriter struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if n := w.max - w.buf.Len(); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf.Write(p[:n])
+	}
+	return len(p), nil
+}
+
+// readNALUnits deliver NAL units in rd until it ended, return how many were read
+func (s *H264Capturer) readNALUnits(rd io.Reader) (units int, err error) {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), maxNALUnitSize)
+	scanner.Split(splitNALUnits)
+	for scanner.Scan() {
+		units++
+		s.seq++
+		frame := Frame{
+			Data:   append([]byte(nil), scanner.Bytes()...),
+			Seq:    s.seq,
+			Time:   time.Now(),
+			Format: FormatH264,
+		}
+		select {
+		case s.C <- frame:
+		case <-s.quitC:
+			return units, nil
+		}
+	}
+	return units, scanner.Err()
+}
+
+var nalStartCode = []byte{0, 0, 1}
+
+// splitNALUnits is a bufio.SplitFunc for h264 annex-b streams,
+// tokens are NAL units without the start code
+func splitNALUnits(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := bytes.Index(data, nalStartCode)
+	if start == -1 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		if len(data) > 2 {
+			return len(data) - 2, nil, nil // keep bytes which may be a part of the start code
+		}
+		return 0, nil, nil
+	}
+	start += len(nalStartCode)
+	end := bytes.Index(data[start:], nalStartCode)
+	if end == -1 {
+		if !atEOF {
+			return start - len(nalStartCode), nil, nil
+		}
+		end = len(data)
+	} else {
+		end += start
+	}
+	unit := bytes.TrimRight(data[start:end], "\x00") // a NAL unit never end with 0, they belong to 00 00 00 01
+	if len(unit) == 0 {
+		return end, nil, nil
+	}
+	return end, unit, nil
+}
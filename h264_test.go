@@ -0,0 +1,84 @@
+package stf
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var fakeH264 = []byte("\x00\x00\x00\x01\x67sps\x00\x00\x00\x01\x68pps\x00\x00\x01\x65idr\x00\x00\x00\x00\x01\x41p")
+
+func TestSplitNALUnits(t *testing.T) {
+	scanner := bufio.NewScanner(iotest.OneByteReader(bytes.NewReader(append([]byte("junk"), fakeH264...))))
+	scanner.Split(splitNALUnits)
+	var units []string
+	for scanner.Scan() {
+		units = append(units, scanner.Text())
+	}
+	assert.NoError(t, scanner.Err())
+	assert.Equal(t, []string{"\x67sps", "\x68pps", "\x65idr", "\x41p"}, units)
+}
+
+func TestH264Capturer(t *testing.T) {
+	s := NewH264Capturer(nil)
+	s.SetBitRate(1000000)
+	s.SetSize(720, 1280)
+	assert.Equal(t, []string{"--output-format=h264", "--bit-rate", "1000000", "--size", "720x1280", "-"}, s.screenrecordArgs())
+
+	var _ Capturer = s
+	var _ Capturer = NewSTFCapturer(nil)
+
+	launches := 0
+	pr, pw := io.Pipe()
+	s.open = func() (io.ReadCloser, error) {
+		launches++
+		if launches == 1 {
+			return ioutil.NopCloser(bytes.NewReader(fakeH264)), nil // quit at the time limit
+		}
+		go pw.Write(fakeH264[:12]) // sps and the start code of pps
+		return pr, nil
+	}
+	assert.NoError(t, s.Start())
+	var units []Frame
+	for len(units) < 5 {
+		select {
+		case f := <-s.Frames():
+			units = append(units, f)
+		case <-time.After(time.Second):
+			t.Fatal("no NAL unit received")
+		}
+	}
+	assert.Equal(t, []byte("\x67sps"), units[0].Data)
+	assert.Equal(t, FormatH264, units[0].Format)
+	assert.Equal(t, "video/h264", units[0].Format.MimeType())
+	assert.Equal(t, uint64(5), units[4].Seq)
+	assert.Equal(t, []byte("\x67sps"), units[4].Data, "screenrecord is relaunched")
+	assert.NoError(t, s.Stop())
+	assert.Equal(t, 2, launches)
+}
+
+func TestH264CapturerFailed(t *testing.T) {
+	s := NewH264Capturer(nil)
+	launches := 0
+	s.open = func() (io.ReadCloser, error) {
+		launches++
+		return ioutil.NopCloser(strings.NewReader("ERROR: unsupported format h264\n")), nil
+	}
+	assert.NoError(t, s.Start())
+	select {
+	case err := <-GoFunc(s.Wait):
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "unsupported format h264")
+	case <-time.After(time.Second):
+		t.Fatal("screenrecord failing at once should not be relaunched forever")
+	}
+	assert.Equal(t, 1, launches)
+	s.Stop()
+}
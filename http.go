@@ -0,0 +1,71 @@
+package stf
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const multipartBoundary = "--frame-boundary"
+
+// MJPEGHandler serve frames as multipart/x-mixed-replace, which browsers show in an <img>.
+// Every viewer has its own subscription, a slow viewer miss frames without slowing down others.
+// Frames of ScreencapMode are sent as png
+func (s *STFCapturer) MJPEGHandler() http.Handler {
+	return s.multipartHandler(func(f Frame) ([]byte, string, error) {
+		return f.Data, f.Format.MimeType(), nil
+	})
+}
+
+// WebPHandler is MJPEGHandler sending webp images, which are smaller.
+// It response 501 if built without the webp tag, see EncodeWebP
+func (s *STFCapturer) WebPHandler(quality int) http.Handler {
+	return s.multipartHandler(func(f Frame) ([]byte, string, error) {
+		data, err := f.EncodeWebP(quality)
+		return data, "image/webp", err
+	})
+}
+
+func (s *STFCapturer) multipartHandler(encode func(Frame) (data []byte, contentType string, err error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		C := s.Subscribe()
+		defer s.Unsubscribe(C)
+		flusher, _ := w.(http.Flusher)
+		headerSent := false
+		for {
+			select {
+			case frame, ok := <-C:
+				if !ok {
+					return
+				}
+				data, contentType, err := encode(frame)
+				if err == ErrWebPUnsupported && !headerSent {
+					http.Error(w, err.Error(), http.StatusNotImplemented)
+					return
+				}
+				if err != nil {
+					continue
+				}
+				if !headerSent {
+					w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+multipartBoundary)
+					headerSent = true
+				}
+				_, err = fmt.Fprintf(w, "--%s\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n",
+					multipartBoundary, contentType, len(data))
+				if err == nil {
+					_, err = w.Write(data) // data may be shared with other viewers, never append to it
+				}
+				if err == nil {
+					_, err = w.Write([]byte("\r\n"))
+				}
+				if err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
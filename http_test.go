@@ -0,0 +1,127 @@
+package stf
+
+import (
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMJPEGHandler(t *testing.T) {
+	cap := newFakeCapturer(t)
+	ts := httptest.NewServer(cap.MJPEGHandler())
+	defer ts.Close()
+
+	go func() {
+		waitSubscribed(t, cap, 1)
+		for i := 1; i <= 2; i++ {
+			cap.pub(Frame{Data: fakeJpeg, Seq: uint64(i)})
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/x-mixed-replace", mediaType)
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for i := 0; i < 2; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "image/jpeg", part.Header.Get("Content-Type"))
+		data := make([]byte, len(fakeJpeg))
+		_, err = part.Read(data)
+		assert.NoError(t, err)
+		assert.Equal(t, fakeJpeg, data)
+	}
+}
+
+func TestMJPEGHandlerSharedFrame(t *testing.T) {
+	cap := newFakeCapturer(t)
+	ts := httptest.NewServer(cap.MJPEGHandler())
+	defer ts.Close()
+
+	// spare capacity after the jpeg, appending the CRLF would write into it
+	data := make([]byte, len(fakeJpeg), len(fakeJpeg)+2)
+	copy(data, fakeJpeg)
+	go func() {
+		waitSubscribed(t, cap, 1)
+		cap.pub(Frame{Data: data, Seq: 1})
+	}()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if _, err = multipart.NewReader(resp.Body, params["boundary"]).NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte{0, 0}, data[len(data):len(data)+2])
+}
+
+func TestMJPEGHandlerViewers(t *testing.T) {
+	cap := newFakeCapturer(t)
+	ts := httptest.NewServer(cap.MJPEGHandler())
+	defer ts.Close()
+
+	png := []byte("\x89PNG\r\n\x1a\nfake")
+	go func() {
+		waitSubscribed(t, cap, 2)
+		cap.pub(Frame{Data: fakeJpeg, Seq: 1})
+		time.Sleep(10 * time.Millisecond)
+		cap.pub(Frame{Data: png, Seq: 2, Format: FormatPNG})
+	}()
+	respC := make(chan *http.Response, 2)
+	for i := 0; i < 2; i++ {
+		go func() { // headers are sent with the first frame
+			resp, err := http.Get(ts.URL)
+			assert.NoError(t, err)
+			respC <- resp
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		resp := <-respC
+		if resp == nil {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		mr := multipart.NewReader(resp.Body, params["boundary"])
+		for _, want := range []string{"image/jpeg", "image/png"} {
+			part, err := mr.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, want, part.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestWebPHandlerUnsupported(t *testing.T) {
+	if _, err := (Frame{}).EncodeWebP(80); err != ErrWebPUnsupported {
+		t.Skip("built with webp")
+	}
+	cap := newFakeCapturer(t)
+	ts := httptest.NewServer(cap.WebPHandler(80))
+	defer ts.Close()
+	go func() {
+		waitSubscribed(t, cap, 1)
+		cap.pub(Frame{Data: fakeJpeg})
+	}()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+}
@@ -0,0 +1,168 @@
+package stf
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/pkg/errors"
+)
+
+// ErrWebPUnsupported is returned by EncodeWebP when built without the webp tag.
+// WebP encoding use libwebp through cgo, so it is opt-in to keep the package cgo free
+var ErrWebPUnsupported = errors.New("webp not supported, build with -tags webp and libwebp installed")
+
+// JPEGDimensions read width and height from the SOF segment without decoding the image
+func JPEGDimensions(data []byte) (w, h int, err error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 0, 0, errors.New("not a jpeg, no SOI marker")
+	}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return 0, 0, errors.Errorf("invalid jpeg marker at %d", i)
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xff: // fill byte
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7): // no length
+			i += 2
+			continue
+		case marker == 0xd9 || marker == 0xda: // EOI, SOS
+			return 0, 0, errors.New("no SOF segment found")
+		}
+		length := int(data[i+2])<<8 | int(data[i+3])
+		isSOF := marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc
+		if isSOF {
+			if i+9 > len(data) {
+				break
+			}
+			h = int(data[i+5])<<8 | int(data[i+6])
+			w = int(data[i+7])<<8 | int(data[i+8])
+			return w, h, nil
+		}
+		i += 2 + length
+	}
+	return 0, 0, errors.New("jpeg truncated before SOF segment")
+}
+
+// scaleImage resize img to width w keeping the aspect ratio, nearest neighbor is enough for thumbnails
+func scaleImage(img image.Image, w int) *image.RGBA {
+	b := img.Bounds()
+	h := b.Dy() * w / b.Dx()
+	if h <= 0 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		sy := b.Min.Y + y*b.Dy()/h
+		for x := 0; x < w; x++ {
+			sx := b.Min.X + x*b.Dx()/w
+			dst.Set(x, y, img.At(sx, sy))
+		}
+	}
+	return dst
+}
+
+// FramesToContactSheet tile frames into a png grid with cols columns,
+// every frame is scaled to thumbW width, cell height fit the tallest thumbnail
+func FramesToContactSheet(frames []Frame, cols int, thumbW int) ([]byte, error) {
+	if len(frames) == 0 {
+		return nil, errors.New("no frames")
+	}
+	if cols <= 0 || thumbW <= 0 {
+		return nil, errors.New("cols and thumbW must be greater than 0")
+	}
+	if cols > len(frames) {
+		cols = len(frames)
+	}
+	thumbs := make([]*image.RGBA, 0, len(frames))
+	cellH := 0
+	for _, frame := range frames {
+		img, err := jpeg.Decode(bytes.NewReader(frame.Data))
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode frame %d", frame.Seq)
+		}
+		thumb := scaleImage(img, thumbW)
+		if thumb.Bounds().Dy() > cellH {
+			cellH = thumb.Bounds().Dy()
+		}
+		thumbs = append(thumbs, thumb)
+	}
+	rows := (len(thumbs) + cols - 1) / cols
+	sheet := image.NewRGBA(image.Rect(0, 0, cols*thumbW, rows*cellH))
+	for i, thumb := range thumbs {
+		pt := image.Pt(i%cols*thumbW, i/cols*cellH)
+		draw.Draw(sheet, thumb.Bounds().Add(pt), thumb, image.ZP, draw.Src)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := png.Encode(buf, sheet); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Image decode the frame, jpeg or png according to Format
+func (f Frame) Image() (image.Image, error) {
+	switch f.Format {
+	case FormatJPEG:
+		return jpeg.Decode(bytes.NewReader(f.Data))
+	case FormatPNG:
+		return png.Decode(bytes.NewReader(f.Data))
+	}
+	return nil, errors.Errorf("can not decode %s frame", f.Format.MimeType())
+}
+
+// diffTolerance is the max difference of a color channel (0-255) still treated as the same pixel,
+// jpeg is lossy so the same screen rarely decode to the exact same pixels
+const diffTolerance = 24
+
+// DiffFrames decode a and b and compare them pixel by pixel.
+// diff is a dimmed gray copy of a with changed pixels painted red,
+// changedRatio is the fraction of changed pixels. Frames must have the same size
+func DiffFrames(a, b Frame) (diff image.Image, changedRatio float64, err error) {
+	imgA, err := jpeg.Decode(bytes.NewReader(a.Data))
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "decode frame %d", a.Seq)
+	}
+	imgB, err := jpeg.Decode(bytes.NewReader(b.Data))
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "decode frame %d", b.Seq)
+	}
+	ba, bb := imgA.Bounds(), imgB.Bounds()
+	if ba.Dx() != bb.Dx() || ba.Dy() != bb.Dy() {
+		return nil, 0, errors.Errorf("frame size differ: %dx%d != %dx%d", ba.Dx(), ba.Dy(), bb.Dx(), bb.Dy())
+	}
+	out := image.NewRGBA(image.Rect(0, 0, ba.Dx(), ba.Dy()))
+	changed := 0
+	for y := 0; y < ba.Dy(); y++ {
+		for x := 0; x < ba.Dx(); x++ {
+			ca := imgA.At(ba.Min.X+x, ba.Min.Y+y)
+			cb := imgB.At(bb.Min.X+x, bb.Min.Y+y)
+			if colorDiffer(ca, cb) {
+				changed++
+				out.Set(x, y, color.RGBA{255, 0, 0, 255})
+				continue
+			}
+			gray := color.GrayModel.Convert(ca).(color.Gray)
+			out.Set(x, y, color.Gray{gray.Y / 3})
+		}
+	}
+	return out, float64(changed) / float64(ba.Dx()*ba.Dy()), nil
+}
+
+func colorDiffer(a, b color.Color) bool {
+	r1, g1, b1, _ := a.RGBA()
+	r2, g2, b2, _ := b.RGBA()
+	for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8)} {
+		if d > diffTolerance || d < -diffTolerance {
+			return true
+		}
+	}
+	return false
+}
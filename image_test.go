@@ -0,0 +1,115 @@
+package stf
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// makeJpeg return a jpeg filled with c
+func makeJpeg(t *testing.T, w, h int, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.ZP, draw.Src)
+	buf := bytes.NewBuffer(nil)
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFramesToContactSheet(t *testing.T) {
+	frames := []Frame{
+		{Data: makeJpeg(t, 72, 128, color.White)},
+		{Data: makeJpeg(t, 128, 72, color.Black)},
+		{Data: makeJpeg(t, 72, 128, color.White)},
+	}
+	data, err := FramesToContactSheet(frames, 2, 36)
+	assert.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, 72, img.Bounds().Dx())
+	assert.Equal(t, 128, img.Bounds().Dy()) // two rows of 64
+
+	_, err = FramesToContactSheet(nil, 2, 36)
+	assert.Error(t, err)
+	_, err = FramesToContactSheet([]Frame{{Data: fakeJpeg}}, 2, 36)
+	assert.Error(t, err)
+}
+
+func TestJPEGDimensions(t *testing.T) {
+	w, h, err := JPEGDimensions(makeJpeg(t, 72, 128, color.White))
+	assert.NoError(t, err)
+	assert.Equal(t, 72, w)
+	assert.Equal(t, 128, h)
+
+	_, _, err = JPEGDimensions(fakeJpeg)
+	assert.Error(t, err)
+	_, _, err = JPEGDimensions([]byte("not jpeg"))
+	assert.Error(t, err)
+	data := makeJpeg(t, 72, 128, color.White)
+	_, _, err = JPEGDimensions(data[:20])
+	assert.Error(t, err)
+}
+
+func TestEncodeWebP(t *testing.T) {
+	frame := Frame{Data: makeJpeg(t, 64, 48, color.RGBA{255, 0, 0, 255})}
+	data, err := frame.EncodeWebP(80)
+	if err == ErrWebPUnsupported {
+		t.Skip("build with -tags webp to test webp")
+	}
+	assert.NoError(t, err)
+	if assert.True(t, len(data) > 12) {
+		assert.Equal(t, "RIFF", string(data[0:4]))
+		assert.Equal(t, "WEBP", string(data[8:12]))
+	}
+}
+
+func TestDiffFrames(t *testing.T) {
+	red := Frame{Data: makeJpeg(t, 40, 20, color.RGBA{200, 30, 30, 255})}
+	diff, ratio, err := DiffFrames(red, red)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, ratio)
+	assert.Equal(t, image.Rect(0, 0, 40, 20), diff.Bounds())
+
+	// right half turn blue
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{200, 30, 30, 255}}, image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(20, 0, 40, 20), &image.Uniform{color.RGBA{30, 30, 200, 255}}, image.ZP, draw.Src)
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, jpeg.Encode(buf, img, &jpeg.Options{Quality: 95}))
+	half := Frame{Data: buf.Bytes()}
+
+	diff, ratio, err = DiffFrames(red, half)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.5, ratio, 0.1)
+	r, _, _, _ := diff.At(35, 10).RGBA()
+	assert.Equal(t, uint32(0xffff), r)
+	r, _, _, _ = diff.At(5, 10).RGBA()
+	assert.True(t, r < 0xffff/2)
+
+	_, _, err = DiffFrames(red, Frame{Data: makeJpeg(t, 20, 20, color.White)})
+	assert.Error(t, err)
+	_, _, err = DiffFrames(red, Frame{Data: []byte("garbage")})
+	assert.Error(t, err)
+}
+
+func TestFrameImage(t *testing.T) {
+	img, err := Frame{Data: makeJpeg(t, 8, 4, color.Black)}.Image()
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 8, 4), img.Bounds())
+
+	buf := bytes.NewBuffer(nil)
+	png.Encode(buf, image.NewGray(image.Rect(0, 0, 3, 5)))
+	img, err = Frame{Data: buf.Bytes(), Format: FormatPNG}.Image()
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 3, 5), img.Bounds())
+
+	_, err = Frame{Data: []byte{0, 0, 1, 0x65}, Format: FormatH264}.Image()
+	assert.Error(t, err)
+}
@@ -0,0 +1,158 @@
+package stf
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	adb "github.com/openatx/go-adb"
+	"github.com/pkg/errors"
+)
+
+// InputController send input events to a device. Coordinates are percents (0.0-1.0)
+// of the screen in its current rotation, as STFTouch uses
+type InputController interface {
+	Servicer
+	SetRotation(r int)
+	Tap(xP, yP float64) error
+	Swipe(x1P, y1P, x2P, y2P float64, dur time.Duration) error
+	Text(text string) error
+	KeyEvent(keycode int) error
+}
+
+// android KeyEvent codes, for KeyEvent
+const (
+	KeyHome      = 3
+	KeyBack      = 4
+	KeyPower     = 26
+	KeyEnter     = 66
+	KeyDel       = 67
+	KeyMenu      = 82
+	KeyAppSwitch = 187
+)
+
+var (
+	_ InputController = (*STFTouch)(nil)
+	_ InputController = (*ShellInput)(nil)
+)
+
+// ShellInput is an InputController running the input command of android.
+// It is slow (every event start a java process) but need no binary, so it works before
+// minitouch is available and on emulators
+type ShellInput struct {
+	shell func(cmd string, args ...string) (string, error)
+
+	mu            sync.Mutex
+	width, height int // pixels in natural orientation
+	rotation      int
+
+	errorMixin
+	safeMixin
+}
+
+// NewShellInput create an input controller of device, Start it to read the screen size
+func NewShellInput(device *adb.Device) *ShellInput {
+	return &ShellInput{shell: device.RunCommand}
+}
+
+// Start read the screen size from wm size
+func (s *ShellInput) Start() error {
+	return s.safeDo(_ACTION_START, func() error {
+		out, err := s.shell("wm", "size")
+		if err != nil {
+			return errors.Wrap(err, "wm size")
+		}
+		width, height, err := parseWmSize(out)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.width, s.height = width, height
+		s.mu.Unlock()
+		s.resetError()
+		return nil
+	})
+}
+
+// Stop make Wait return, nothing is running in background
+func (s *ShellInput) Stop() error {
+	return s.safeDo(_ACTION_STOP, func() error {
+		s.doneNilError()
+		return s.Wait()
+	})
+}
+
+func (s *ShellInput) SetRotation(r int) {
+	s.mu.Lock()
+	s.rotation = r
+	s.mu.Unlock()
+}
+
+// pixel convert percents into the pixels input expects, which follow the rotation
+func (s *ShellInput) pixel(xP, yP float64) (x, y string) {
+	s.mu.Lock()
+	width, height := s.width, s.height
+	if s.rotation == 90 || s.rotation == 270 {
+		width, height = height, width
+	}
+	s.mu.Unlock()
+	return strconv.Itoa(int(float64(width) * xP)), strconv.Itoa(int(float64(height) * yP))
+}
+
+// Tap touch (xP, yP) and release it
+func (s *ShellInput) Tap(xP, yP float64) error {
+	x, y := s.pixel(xP, yP)
+	return s.input("tap", x, y)
+}
+
+// Swipe move from (x1P, y1P) to (x2P, y2P) in dur, dur is ignored before android 4.4
+func (s *ShellInput) Swipe(x1P, y1P, x2P, y2P float64, dur time.Duration) error {
+	x1, y1 := s.pixel(x1P, y1P)
+	x2, y2 := s.pixel(x2P, y2P)
+	return s.input("swipe", x1, y1, x2, y2, strconv.Itoa(int(dur/time.Millisecond)))
+}
+
+// Text type text into the focused view, only ascii is supported by input
+func (s *ShellInput) Text(text string) error {
+	return inputText(s.shell, text)
+}
+
+// KeyEvent press and release the key of keycode, e.g. KeyHome
+func (s *ShellInput) KeyEvent(keycode int) error {
+	return inputKeyEvent(s.shell, keycode)
+}
+
+func (s *ShellInput) input(args ...string) error {
+	return runInput(s.shell, args...)
+}
+
+// runInput run input, which print errors instead of failing
+func runInput(shell func(cmd string, args ...string) (string, error), args ...string) error {
+	out, err := shell("input", args...)
+	if err != nil {
+		return err
+	}
+	if out = strings.TrimSpace(out); strings.Contains(out, "Error") || strings.Contains(out, "Exception") {
+		return errors.Errorf("input %s: %s", args[0], out)
+	}
+	return nil
+}
+
+// inputTextReplacer escape text for input text, which read %s as a space, through the device shell
+var inputTextReplacer = strings.NewReplacer(
+	" ", "%s", "\\", "\\\\", "'", "\\'", "\"", "\\\"", "`", "\\`", "$", "\\$",
+	"&", "\\&", "|", "\\|", ";", "\\;", "<", "\\<", ">", "\\>",
+	"(", "\\(", ")", "\\)", "*", "\\*", "~", "\\~", "#", "\\#",
+)
+
+func inputText(shell func(cmd string, args ...string) (string, error), text string) error {
+	if text == "" {
+		return nil
+	}
+	return runInput(shell, "text", inputTextReplacer.Replace(text))
+}
+
+func inputKeyEvent(shell func(cmd string, args ...string) (string, error), keycode int) error {
+	return runInput(shell, "keyevent", strconv.Itoa(keycode))
+}
@@ -0,0 +1,76 @@
+package stf
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeShell record commands and answer wm size
+type fakeShell struct {
+	cmds []string
+	out  string // output of input commands
+}
+
+func (f *fakeShell) run(cmd string, args ...string) (string, error) {
+	line := strings.Join(append([]string{cmd}, args...), " ")
+	if line == "wm size" {
+		return "Physical size: 1080x1920\n", nil
+	}
+	f.cmds = append(f.cmds, line)
+	return f.out, nil
+}
+
+func TestShellInput(t *testing.T) {
+	shell := &fakeShell{}
+	s := &ShellInput{shell: shell.run}
+	assert.NoError(t, s.Start())
+
+	assert.NoError(t, s.Tap(0.5, 0.25))
+	assert.NoError(t, s.Swipe(0.1, 0.5, 0.9, 0.5, 300*time.Millisecond))
+	s.SetRotation(90)
+	assert.NoError(t, s.Tap(0.5, 0.25))
+	assert.NoError(t, s.KeyEvent(KeyHome))
+	assert.NoError(t, s.Text("hi it's $5"))
+	assert.NoError(t, s.Text(""))
+	assert.Equal(t, []string{
+		"input tap 540 480",
+		"input swipe 108 960 972 960 300",
+		"input tap 960 270",
+		"input keyevent 3",
+		`input text hi%sit\'s%s\$5`,
+	}, shell.cmds)
+
+	shell.out = "Error: Unknown command: tap"
+	assert.Error(t, s.Tap(0.5, 0.5))
+
+	waitC := GoFunc(s.Wait)
+	assert.NoError(t, s.Stop())
+	select {
+	case err := <-waitC:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Wait not returned after Stop")
+	}
+}
+
+func TestRemoteControlInputController(t *testing.T) {
+	shell := &fakeShell{}
+	r := newFakeRemoteControl(t, nil)
+	r.SetInputController(&ShellInput{shell: shell.run})
+	assert.NoError(t, r.Start())
+	defer r.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if width, _, _ := r.Screen(); width != 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, r.Tap(360, 320))
+	assert.Equal(t, []string{"input tap 540 480"}, shell.cmds)
+	assert.NoError(t, r.Close())
+}
@@ -3,20 +3,27 @@ package stf
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"net"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"io/ioutil"
 
+	"image"
 	"image/jpeg"
+	"image/png"
 
 	adb "github.com/openatx/go-adb"
 	"github.com/pkg/errors"
@@ -29,6 +36,90 @@ const (
 	QUALITY_240P  = 4
 )
 
+const defaultMinicapLogLines = 20
+
+// defaultMinicapFrameRate is passed by -r, it is the max frame rate of minicap itself
+const defaultMinicapFrameRate = 60
+
+// ErrMinicapLinkFailed means the dynamic linker refused minicap, usually minicap.so is built for another abi
+var ErrMinicapLinkFailed = errors.New("minicap link failed")
+
+// ErrMinicapLaunchFailed means the minicap output closed before it printed the PID line,
+// e.g. the device killed the shell. It is not returned when minicap die after launched
+var ErrMinicapLaunchFailed = errors.New("minicap launch failed")
+
+var linkerErrorPatterns = []string{
+	"CANNOT LINK EXECUTABLE",
+	"dlopen failed",
+	"wrong ELF class",
+	"has unexpected e_machine",
+	"cannot locate symbol",
+}
+
+func isLinkerError(line string) bool {
+	for _, pattern := range linkerErrorPatterns {
+		if strings.Contains(line, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrNoCaptureMethod means neither minicap nor slow-minicap works on the device
+var ErrNoCaptureMethod = errors.New("no suitable screen capture method found")
+
+// ErrDeviceDisconnected means the adb connection to the device was closed, e.g. by the owner
+// of the adb client or the adb server quit. Relaunching minicap can not help
+var ErrDeviceDisconnected = errors.New("device disconnected")
+
+// disconnectedErrCodes are the adb errors of a gone device or adb server
+var disconnectedErrCodes = []adb.ErrCode{adb.ServerNotAvailable, adb.DeviceNotFound, adb.ConnectionResetError}
+
+func isDisconnectedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	cause := errors.Cause(err)
+	if cause == ErrDeviceDisconnected || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNREFUSED) { // adb server is gone
+		return true
+	}
+	for _, code := range disconnectedErrCodes {
+		if adb.HasErrCode(cause, code) {
+			return true
+		}
+	}
+	// the adb server report an offline device as a plain failure
+	return adb.HasErrCode(cause, adb.AdbError) && strings.Contains(cause.Error(), "device offline")
+}
+
+// RestartPolicy control relaunching minicap after it quit unexpectedly
+type RestartPolicy struct {
+	MaxAttempts int           // 0 means never relaunch
+	Backoff     time.Duration // wait before the first relaunch, doubled every attempt
+}
+
+// attempts are counted again if minicap survived so long
+const restartResetAfter = 30 * time.Second
+
+// StreamMode is how frames are transferred from minicap
+type StreamMode int
+
+const (
+	// SocketMode read frames from minicap socket (-S) through adb forward
+	SocketMode StreamMode = iota
+	// StdoutMode read frames from minicap stdout through the adb shell pipe,
+	// no forward needed, but it requires a minicap build which write frames
+	// to stdout when -S is absent
+	StdoutMode
+	// ScreencapMode poll screencap and deliver lossless png frames (Format is FormatPNG),
+	// for tests need exact pixels. minicap is not used at all, frames are slow
+	ScreencapMode
+)
+
+// defaultScreencapInterval is the poll interval of ScreencapMode
+const defaultScreencapInterval = time.Second
+
 type minicapInfo struct {
 	Id       int     `json:"id"`
 	Width    int     `json:"width"`
@@ -42,6 +133,46 @@ type minicapInfo struct {
 	Rotation int     `json:"rotation"`
 }
 
+// DisplayInfo is the display reported by minicap -i
+type DisplayInfo minicapInfo
+
+// IsSecureDisplay return true if the display is secure (DRM), it can not be captured
+// and minicap only send black frames
+func (d DisplayInfo) IsSecureDisplay() bool {
+	return d.Secure
+}
+
+// parseMinicapInfo parse output of minicap -i
+// some devices print log lines around the json, so only the first json object is used
+func parseMinicapInfo(out string) (mi minicapInfo, err error) {
+	start := strings.IndexByte(out, '{')
+	if start == -1 {
+		return mi, errors.New("no json found in minicap -i output: " + strconv.Quote(out))
+	}
+	depth, inString, escaped := 0, false, false
+	for i := start; i < len(out); i++ {
+		c := out[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				err = json.Unmarshal([]byte(out[start:i+1]), &mi)
+				return
+			}
+		}
+	}
+	return mi, errors.New("incomplete json in minicap -i output: " + strconv.Quote(out))
+}
+
 type minicapDaemon struct {
 	width, height       int
 	maxWidth, maxHeight int
@@ -49,8 +180,54 @@ type minicapDaemon struct {
 	port                int
 	quitC               chan bool
 	rotationC           chan int
+	suspendC            chan bool
 	binaryPath          string
+	logs                *lineRing
+	streamMode          StreamMode
+	frameReader         func(io.Reader) error // parse frames in StdoutMode
+	repush              func() error          // push binaries again when link failed
+	repushed            bool
+	capture             func() error // run minicap until it quit
+	kill                func() error
+	restartPolicy       RestartPolicy
+	restartDebounce     time.Duration
+	events              chan Event
+	props               map[string]string
+	abi, sdk            string
+	fallbackThreshold   int
+	fallbackInterval    time.Duration
+	failures            int           // minicap failed to start or quit in a row, for the screencap fallback
+	screencapInterval   time.Duration // poll interval of ScreencapMode
+	screencap           func() (image.Image, error)
+	onDegraded          func()                 // called before falling back to screencap
+	onRestart           func()                 // called before minicap is restarted on purpose
+	onDisconnected      func()                 // called when quit because of ErrDeviceDisconnected
+	frameSink           func(Frame, time.Time) // receive screencap frames
+	cancelMu            sync.Mutex
+	cancelStart         context.CancelFunc
+	progress            ProgressFunc
+	noPush              bool
+	exists              func(path string) bool
+	shell               func(cmd string, args ...string) (string, error)
+	cleanupOnStart      bool
+	forcePush           bool
+	startedAt           time.Time
+	pushedAt            time.Time
+	preparedAt          time.Time
+	push                func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error
+	info                DisplayInfo
+	probe               func() error // find a working minicap binary
+	caps                minicapCaps
+	frameRate           int // passed by -r when minicap support it
+	jpegQuality         int // passed by -Q when minicap support it, 0 means minicap default
+	captureLayer        string
+	pidMu               sync.Mutex
+	pid                 int // of the running minicap, 0 if not running
+	// configMu guard maxWidth, maxHeight, jpegQuality, rotation, binaryPath, caps, captureLayer,
+	// restartPolicy and restartDebounce, callers and probe change them while the capture goroutine read them
+	configMu sync.Mutex
 
+	binarySource
 	*adb.Device
 	errorMixin
 	safeMixin
@@ -60,29 +237,88 @@ func newMinicapDaemon(rotationC chan int, device *adb.Device) *minicapDaemon {
 	if rotationC == nil {
 		rotationC = make(chan int)
 	}
-	return &minicapDaemon{
+	m := &minicapDaemon{
 		rotationC: rotationC,
+		suspendC:  make(chan bool),
 		Device:    device,
 		maxWidth:  720,
 		maxHeight: 720,
+		logs:      newLineRing(defaultMinicapLogLines),
+		frameRate: defaultMinicapFrameRate,
+
+		screencapInterval: defaultScreencapInterval,
+	}
+	m.repush = func() error {
+		return m.pushFiles(context.Background(), true)
+	}
+	m.capture = m.runScreenCapture
+	m.kill = m.killMinicap
+	m.exists = m.isRemoteExists
+	m.shell = m.RunCommand
+	m.push = m.pushData
+	m.probe = m.probeBinary
+	m.screencap = func() (image.Image, error) {
+		return Screencap(m.Device)
 	}
+	return m
 }
 
 func (m *minicapDaemon) Start() error {
+	return m.StartContext(context.Background())
+}
+
+// StartContext is Start whose binaries downloading and probing is cancelled when ctx done
+func (m *minicapDaemon) StartContext(ctx context.Context) error {
 	return m.safeDo(_ACTION_START,
 		func() error {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			m.cancelMu.Lock()
+			m.cancelStart = cancel
+			m.cancelMu.Unlock()
+			defer func() {
+				m.cancelMu.Lock()
+				m.cancelStart = nil
+				m.cancelMu.Unlock()
+			}()
 			m.resetError()
+			m.startedAt = time.Now()
 			m.quitC = make(chan bool, 1)
-			m.killMinicap()
-			if err := m.prepareSafe(); err != nil {
+			m.repushed = false
+			m.failures = 0
+			if m.streamMode == ScreencapMode {
+				goLabeled(m.Device, "screencap", m.runPNGScreencap)
+				return nil
+			}
+			if m.cleanupOnStart {
+				if err := m.CleanupStale(); err != nil {
+					return errors.Wrap(err, "cleanup stale minicap")
+				}
+			} else {
+				m.killMinicap()
+			}
+			if err := m.prepareSafe(ctx); err != nil {
+				if ctx.Err() == nil && m.shouldDegrade() {
+					goLabeled(m.Device, "screencap", func() {
+						m.doneError(errors.Wrap(m.degrade(err), "minicap"))
+					})
+					return nil
+				}
 				return errors.Wrap(err, "prepare minicap")
 			}
-			go m.runScreenCaptureWithRotate() // TODO
+			m.warnSecureDisplay()
+			goLabeled(m.Device, "minicap", m.runScreenCaptureWithRotate)
 			return nil
 		})
 }
 
+// Stop also cancel the binaries downloading of a running Start
 func (m *minicapDaemon) Stop() error {
+	m.cancelMu.Lock()
+	if m.cancelStart != nil {
+		m.cancelStart()
+	}
+	m.cancelMu.Unlock()
 	return m.safeDo(_ACTION_STOP,
 		func() error {
 			m.quitC <- true
@@ -91,11 +327,15 @@ func (m *minicapDaemon) Stop() error {
 }
 
 // minicap may say resource is busy ..
-func (m *minicapDaemon) prepareSafe() (err error) {
+func (m *minicapDaemon) prepareSafe(ctx context.Context) (err error) {
 	n := 0
 	for {
-		err = m.prepare()
-		if err == nil || n >= 3 {
+		err = m.prepare(ctx)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		m.failures++
+		if n >= 3 || m.shouldDegrade() {
 			return
 		}
 		m.killMinicap()
@@ -107,38 +347,97 @@ func (m *minicapDaemon) prepareSafe() (err error) {
 // Check whether minicap is supported on the device
 // Check adb forward
 // For more information, see: https://github.com/openstf/minicap
-func (m *minicapDaemon) prepare() (err error) {
-	if err = m.pushFiles(); err != nil {
+func (m *minicapDaemon) prepare(ctx context.Context) (err error) {
+	if err = m.pushFiles(ctx, false); err != nil {
 		return
 	}
+	m.pushedAt = time.Now()
+	err = m.probe()
+	m.preparedAt = time.Now()
+	return
+}
+
+// probeBinary set binaryPath to the first minicap which works on the device
+func (m *minicapDaemon) probeBinary() error {
+	var binaryPath string
 	switch {
 	case m.checkMinicap() == nil:
-		m.binaryPath = "/data/local/tmp/minicap"
+		binaryPath = "/data/local/tmp/minicap"
 	case m.checkSlowMinicap() == nil:
-		m.binaryPath = "/data/local/tmp/slow-minicap"
+		binaryPath = "/data/local/tmp/slow-minicap"
 	default:
-		err = errors.New("no suitable screen capture method found")
-		return
+		return ErrNoCaptureMethod
 	}
-	return
+	m.configMu.Lock()
+	m.binaryPath = binaryPath
+	m.configMu.Unlock()
+	caps := m.detectCaps()
+	m.configMu.Lock()
+	m.caps = caps
+	layer := m.captureLayer
+	m.configMu.Unlock()
+	if layer != "" && !caps.has(captureLayerFlag) {
+		log.Println("minicap can not capture a layer, capture the whole display instead")
+	}
+	return nil
+}
+
+// captureLayerFlag is how some minicap forks select the layer (surface) to capture
+const captureLayerFlag = "-L"
+
+// SetCaptureLayer capture only the layer (surface) named name instead of the whole display.
+// Only a few minicap forks support it, on others it is ignored. It take effect at next (re)start of minicap
+func (m *minicapDaemon) SetCaptureLayer(name string) {
+	m.configMu.Lock()
+	m.captureLayer = name
+	m.configMu.Unlock()
+}
+
+// minicapCaps is the set of flags listed by minicap -h, eg "-Q" "-r"
+type minicapCaps map[string]bool
+
+func (c minicapCaps) has(flag string) bool {
+	return c[flag]
+}
+
+// parseMinicapCaps collect flags from the usage of minicap -h
+//
+//	-Q <value>:    JPEG quality (0-100).
+//	-r <value>:    Frame rate (frames/sec).
+func parseMinicapCaps(usage string) minicapCaps {
+	caps := make(minicapCaps)
+	for _, line := range strings.Split(usage, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || len(fields[0]) < 2 || fields[0][0] != '-' {
+			continue
+		}
+		caps[strings.TrimSuffix(fields[0], ":")] = true
+	}
+	return caps
+}
+
+// detectCaps run minicap -h, old builds without usage get no optional flags
+func (m *minicapDaemon) detectCaps() minicapCaps {
+	out, err := m.shell("LD_LIBRARY_PATH=/data/local/tmp", m.binaryPath, "-h", "2>&1")
+	if err != nil {
+		return minicapCaps{}
+	}
+	return parseMinicapCaps(out)
 }
 
 // first check the minicap -i output
 // then update device basic info
 // at last take an screenshot, it may take some time, but it is worth of time
 func (m *minicapDaemon) checkMinicap() error {
-	var mi minicapInfo
 	out, err := m.RunCommand("LD_LIBRARY_PATH=/data/local/tmp", "/data/local/tmp/minicap", "-i", "2>/dev/null")
 	if err != nil {
 		return errors.Wrap(err, "run minicap -i")
 	}
-	err = json.Unmarshal([]byte(out), &mi)
+	mi, err := parseMinicapInfo(out)
 	if err != nil {
 		return err
 	}
-	m.width = mi.Width
-	m.height = mi.Height
-	m.rotation = mi.Rotation
+	m.setInfo(mi)
 	data, err := m.takeScreenshot()
 	if err != nil {
 		return errors.Wrap(err, "check minicap")
@@ -151,19 +450,35 @@ func (m *minicapDaemon) checkMinicap() error {
 }
 
 func (m *minicapDaemon) checkSlowMinicap() error {
-	var mi minicapInfo
 	out, err := m.RunCommand("/data/local/tmp/slow-minicap", "-i", "2>/dev/null")
 	if err != nil {
 		return errors.Wrap(err, "run slow-minicap -i")
 	}
-	err = json.Unmarshal([]byte(out), &mi)
+	mi, err := parseMinicapInfo(out)
 	if err != nil {
 		return err
 	}
+	m.setInfo(mi)
+	return nil
+}
+
+func (m *minicapDaemon) setInfo(mi minicapInfo) {
+	m.info = DisplayInfo(mi)
 	m.width = mi.Width
 	m.height = mi.Height
-	m.rotation = mi.Rotation
-	return nil
+	m.setCurrentRotation(mi.Rotation)
+}
+
+// Info return the display info from minicap -i, available after Start
+func (m *minicapDaemon) Info() DisplayInfo {
+	return m.info
+}
+
+// warnSecureDisplay emit EventSecureDisplay, so users know why frames are black
+func (m *minicapDaemon) warnSecureDisplay() {
+	if m.info.IsSecureDisplay() {
+		emitEvent(m.events, EventSecureDisplay, "display is secure, frames may be black", nil)
+	}
 }
 
 // takeScreenshot output jpeg binary
@@ -188,60 +503,203 @@ func (m *minicapDaemon) isRemoteExists(path string) bool {
 	return err == nil
 }
 
-func (m *minicapDaemon) pushFiles() error {
-	props, err := m.Properties()
-	if err != nil {
-		return err
-	}
+// isEmulator check the properties set by android emulator
+func isEmulator(props map[string]string) bool {
+	return props["ro.kernel.qemu"] == "1" || props["ro.boot.qemu"] == "1"
+}
+
+// deviceAbiSdk return the abi and sdk to choose minicap binaries.
+// x86_64 emulator images may report ro.product.cpu.abi as x86 for compatibility,
+// so the preferred abi in ro.product.cpu.abilist is used for emulators
+func deviceAbiSdk(props map[string]string) (abi, sdk string, err error) {
 	abi, ok := props["ro.product.cpu.abi"]
+	if isEmulator(props) {
+		if abilist := strings.Split(props["ro.product.cpu.abilist"], ","); abilist[0] != "" {
+			abi, ok = strings.TrimSpace(abilist[0]), true
+		}
+	}
 	if !ok {
-		return errors.New("No ro.product.cpu.abi propery")
+		return "", "", errors.New("No ro.product.cpu.abi propery")
 	}
-	sdk, ok := props["ro.build.version.sdk"]
+	sdk, ok = props["ro.build.version.sdk"]
 	if !ok {
-		return errors.New("No ro.build.version.sdk propery")
+		return "", "", errors.New("No ro.build.version.sdk propery")
 	}
-	for _, filename := range []string{"minicap.so", "minicap"} {
-		dst := "/data/local/tmp/" + filename
-		if m.isRemoteExists(dst) {
-			continue
-		}
-		var urlStr string
-		var perms os.FileMode = 0644
-		baseUrl := "https://gohttp.nie.netease.com/openstf/vendor"
-		if filename == "minicap.so" {
-			urlStr = baseUrl + "/minicap/shared/android-" + sdk + "/" + abi + "/minicap.so"
-		} else {
-			perms = 0755
-			urlStr = baseUrl + "/minicap/bin/" + abi + "/minicap"
+	return
+}
+
+// minicapFileURL return the download url of minicap or minicap.so
+func minicapFileURL(filename, abi, sdk string) string {
+	for _, f := range minicapBinaries(abi, sdk) {
+		if f.name == filename {
+			return vendorBaseURL + "/" + f.path
 		}
-		err := PushFileFromHTTP(m.Device, dst, perms, urlStr)
+	}
+	return ""
+}
+
+// detectAbiSdk read abi and sdk from the device properties, properties are cached
+func (m *minicapDaemon) detectAbiSdk() (abi, sdk string, err error) {
+	if m.props == nil {
+		props, err := m.Properties()
 		if err != nil {
-			return err
+			return "", "", err
 		}
+		m.props = props
 	}
-	err = PushFileFromHTTP(m.Device, "/data/local/tmp/slow-minicap", 0755, "https://gohttp.nie.netease.com/yosemite/slow-minicap/"+abi+"/slow-minicap")
+	abi, sdk, err = deviceAbiSdk(m.props)
 	if err != nil {
-		return errors.Wrap(err, "push files")
+		return
+	}
+	m.abi, m.sdk = abi, sdk
+	return
+}
+
+// SetDownloadProgress set the callback to report minicap binaries downloading
+func (m *minicapDaemon) SetDownloadProgress(progress ProgressFunc) {
+	m.progress = progress
+}
+
+// DetectedABI return the abi used to choose minicap binaries, available after Start
+func (m *minicapDaemon) DetectedABI() string {
+	return m.abi
+}
+
+// DetectedSDK return the sdk used to choose minicap binaries, available after Start
+func (m *minicapDaemon) DetectedSDK() string {
+	return m.sdk
+}
+
+// ErrBinariesMissing is returned by Start when binaries are not on the device and pushing is disabled
+var ErrBinariesMissing = errors.New("minicap binaries missing")
+
+// checkBinaries return ErrBinariesMissing if any minicap file not exists
+func checkBinaries(exists func(path string) bool) error {
+	for _, filename := range []string{"minicap.so", "minicap"} {
+		dst := "/data/local/tmp/" + filename
+		if !exists(dst) {
+			return errors.Wrap(ErrBinariesMissing, dst)
+		}
 	}
 	return nil
 }
 
-// TODO(ssx): setQuality
+// SetNoPush forbid pushing binaries, Start fail with ErrBinariesMissing if they are not on the device
+func (m *minicapDaemon) SetNoPush(noPush bool) {
+	m.noPush = noPush
+}
+
+// pushFiles push minicap binaries for the device abi,
+// existing files are kept unless force is true
+func (m *minicapDaemon) pushFiles(ctx context.Context, force bool) error {
+	abi, sdk, err := m.detectAbiSdk()
+	if err != nil {
+		return err
+	}
+	if m.noPush {
+		return checkBinaries(m.exists)
+	}
+	version := abi + "/" + sdk
+	if !force && (m.forcePush || m.pushedVersion() != version) {
+		force = true // binaries on the device may be pushed for another abi
+	}
+	files := minicapBinaries(abi, sdk)
+	if err = provisionBinaries(ctx, m.binarySource, files, force, m.exists, m.push); err != nil {
+		return err
+	}
+	if err = m.push(ctx, versionMarker, 0644, []byte(version), ""); err != nil {
+		return errors.Wrap(err, "push version marker")
+	}
+	if m.fsys != nil || allEmbedded(files) {
+		return nil // no network, slow-minicap is not available
+	}
+	err = provisionBinaries(ctx, m.binarySource, []binaryFile{slowMinicapBinary(abi)}, force, m.exists, m.push)
+	return errors.Wrap(err, "push files")
+}
+
+// versionMarker record abi/sdk of the pushed binaries
+const versionMarker = "/data/local/tmp/minicap.version"
+
+// pushedVersion return abi/sdk of the binaries on the device, empty if unknown
+func (m *minicapDaemon) pushedVersion() string {
+	out, err := m.shell("cat", versionMarker)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+// pushData push data to dst, or download url to dst if data is nil
+func (m *minicapDaemon) pushData(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error {
+	if data != nil {
+		return PushFileFromBytes(m.Device, dst, perms, data)
+	}
+	return PushFileFromHTTPContext(ctx, m.Device, dst, perms, url, m.progress)
+}
+
+// SetForcePush always push binaries at Start even if they exist on the device.
+// Without it, existing binaries are replaced only when pushed for another abi or sdk
+func (m *minicapDaemon) SetForcePush(on bool) {
+	m.forcePush = on
+}
+
+// SetJPEGQuality set the jpeg quality (1-100) minicap encode frames with, 0 for the minicap default.
+// Ignored if the minicap build does not support -Q. If minicap is running, it will be restarted
+func (m *minicapDaemon) SetJPEGQuality(quality int) {
+	if quality < 0 || quality > 100 {
+		return
+	}
+	m.configMu.Lock()
+	m.jpegQuality = quality
+	m.configMu.Unlock()
+	m.restartIfStarted()
+}
+
+// SetQuality change the max size of frames.
+// If minicap is running, it will be restarted, otherwise it take effect at Start
 func (m *minicapDaemon) SetQuality(quality int) {
 	switch quality {
 	case QUALITY_1080P:
-		m.maxHeight, m.maxHeight = 1080, 1080
+		m.SetMaxSize(1080, 1080)
 	case QUALITY_720P:
-		m.maxHeight, m.maxHeight = 720, 720
+		m.SetMaxSize(720, 720)
 	case QUALITY_480P:
-		m.maxHeight, m.maxHeight = 480, 480
+		m.SetMaxSize(480, 480)
 	case QUALITY_240P:
-		m.maxHeight, m.maxHeight = 240, 240
-	default:
+		m.SetMaxSize(240, 240)
+	}
+}
+
+// SetMaxSize change the max size of frames, the aspect ratio of the display is kept.
+// If minicap is running, it will be restarted, otherwise it take effect at Start
+func (m *minicapDaemon) SetMaxSize(width, height int) {
+	if width <= 0 || height <= 0 {
 		return
 	}
-	m.rotationC <- m.rotation // force restart minicap
+	m.configMu.Lock()
+	m.maxWidth, m.maxHeight = width, height
+	m.configMu.Unlock()
+	m.restartIfStarted()
+}
+
+// restartIfStarted restart minicap with the current config, so a changed config take effect
+func (m *minicapDaemon) restartIfStarted() {
+	if m.IsStarted() {
+		m.SetRotation(m.currentRotation())
+	}
+}
+
+// currentRotation return the rotation minicap is (or will be) launched with
+func (m *minicapDaemon) currentRotation() int {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	return m.rotation
+}
+
+func (m *minicapDaemon) setCurrentRotation(r int) {
+	m.configMu.Lock()
+	m.rotation = r
+	m.configMu.Unlock()
 }
 
 func (m *minicapDaemon) SetRotation(r int) {
@@ -252,52 +710,318 @@ func (m *minicapDaemon) SetRotation(r int) {
 }
 
 func (m *minicapDaemon) runScreenCaptureWithRotate() {
-	m.killMinicap()
+	m.kill()
 	var err error
 	defer func() {
 		m.doneError(errors.Wrap(err, "minicap"))
 	}()
-	errC := GoFunc(m.runScreenCapture)
-	var needRestart bool
+	errC := GoFunc(m.capture)
+	var needRestart, suspended bool
+	var debounceC <-chan time.Time
+	attempts, launchTime := 0, time.Now()
 	for {
 		select {
 		case err = <-errC: // when normal exit, that is an error
-			if !needRestart {
+			if suspended {
+				errC, err = nil, nil // launch again when awaken
+				break
+			}
+			if isDisconnectedError(err) {
+				emitEvent(m.events, EventDeviceDisconnected, "adb connection closed, stop capturing", err)
+				err = errors.Wrap(ErrDeviceDisconnected, err.Error())
+				if m.onDisconnected != nil {
+					m.onDisconnected()
+				}
 				return
 			}
+			if time.Since(launchTime) > restartResetAfter {
+				attempts, m.failures = 0, 0
+			}
+			if !needRestart && !m.recoverCapture(err) {
+				m.failures++
+				if m.shouldDegrade() {
+					err = m.degrade(err)
+					return
+				}
+				m.configMu.Lock()
+				policy := m.restartPolicy
+				m.configMu.Unlock()
+				// with the fallback, minicap is relaunched until it is reached
+				if attempts >= policy.MaxAttempts && m.fallbackThreshold <= 0 {
+					return
+				}
+				backoff := policy.Backoff << uint(attempts)
+				if attempts < policy.MaxAttempts {
+					attempts++
+				}
+				emitEvent(m.events, EventMinicapRestart,
+					fmt.Sprintf("restart minicap in %v, failure %d", backoff, m.failures), err)
+				select {
+				case <-time.After(backoff):
+				case <-m.quitC:
+					err = nil
+					return
+				}
+			}
 			needRestart = false
 			err = nil
-			errC = GoFunc(m.runScreenCapture)
+			launchTime = time.Now()
+			errC = GoFunc(m.capture)
 		case r := <-m.rotationC:
+			m.setCurrentRotation(r)
+			m.configMu.Lock()
+			debounce := m.restartDebounce
+			m.configMu.Unlock()
+			if debounce > 0 {
+				debounceC = time.After(debounce) // wait for more changes
+				break
+			}
+			needRestart = true
+			m.restart()
+		case <-debounceC:
+			debounceC = nil
 			needRestart = true
-			m.rotation = r
-			m.killMinicap()
+			m.restart()
+		case suspended = <-m.suspendC:
+			if suspended {
+				needRestart = true
+				m.kill()
+			} else if errC == nil {
+				needRestart = false
+				launchTime = time.Now()
+				errC = GoFunc(m.capture)
+			}
+		case <-m.quitC:
+			m.kill()
+			return
+		}
+	}
+}
+
+// suspend kill minicap and keep it stopped until called with false
+func (m *minicapDaemon) suspend(on bool) error {
+	if !m.IsStarted() {
+		return ErrServiceNotStarted
+	}
+	select {
+	case m.suspendC <- on:
+		return nil
+	case <-time.After(time.Second):
+		return errors.New("minicap daemon not responding")
+	}
+}
+
+// restart kill minicap on purpose, it is launched again with the current config
+func (m *minicapDaemon) restart() {
+	if m.onRestart != nil {
+		m.onRestart()
+	}
+	m.kill()
+}
+
+// SetRestartDebounce collapse config changes within d into one minicap restart,
+// so rapid SetRotation and SetQuality calls do not restart minicap again and again.
+// 0 to restart on every change
+func (m *minicapDaemon) SetRestartDebounce(d time.Duration) {
+	m.configMu.Lock()
+	m.restartDebounce = d
+	m.configMu.Unlock()
+}
+
+// setDefaultRestartDebounce set the debounce to d unless SetRestartDebounce was called
+func (m *minicapDaemon) setDefaultRestartDebounce(d time.Duration) {
+	m.configMu.Lock()
+	if m.restartDebounce == 0 {
+		m.restartDebounce = d
+	}
+	m.configMu.Unlock()
+}
+
+// SetRestartPolicy set how to relaunch minicap when it quit unexpectedly.
+// Stop and rotation changes are never treated as unexpected
+func (m *minicapDaemon) SetRestartPolicy(policy RestartPolicy) {
+	m.configMu.Lock()
+	m.restartPolicy = policy
+	m.configMu.Unlock()
+}
+
+// SetScreencapFallback poll screencap every interval when minicap failed to start or quit threshold
+// times in a row, the frames are much slower but consumers still get them. minicap is relaunched
+// until then even beyond the RestartPolicy. 0 threshold to disable
+func (m *minicapDaemon) SetScreencapFallback(threshold int, interval time.Duration) {
+	m.fallbackThreshold = threshold
+	m.fallbackInterval = interval
+}
+
+// shouldDegrade return true when minicap failed enough times to fall back to screencap
+func (m *minicapDaemon) shouldDegrade() bool {
+	return m.fallbackThreshold > 0 && m.failures >= m.fallbackThreshold
+}
+
+// degrade fall back to screencap because of err of minicap, until quit
+func (m *minicapDaemon) degrade(err error) error {
+	emitEvent(m.events, EventDegradedMode, "minicap keep failing, fall back to screencap", err)
+	return m.pollScreencap()
+}
+
+// pollScreencap send screencap as jpeg frames until quit
+func (m *minicapDaemon) pollScreencap() error {
+	if m.onDegraded != nil {
+		m.onDegraded()
+	}
+	ticker := time.NewTicker(m.fallbackInterval)
+	defer ticker.Stop()
+	for {
+		img, err := m.screencap()
+		if err != nil {
+			return errors.Wrap(err, "screencap fallback")
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := jpeg.Encode(buf, img, nil); err != nil {
+			return errors.Wrap(err, "screencap fallback")
+		}
+		if m.frameSink != nil {
+			b := img.Bounds()
+			m.frameSink(Frame{
+				Data:     buf.Bytes(),
+				Time:     time.Now(),
+				Rotation: m.currentRotation(),
+				Width:    b.Dx(),
+				Height:   b.Dy(),
+			}, time.Now())
+		}
+		select {
+		case <-ticker.C:
+		case <-m.quitC:
+			return nil
+		}
+	}
+}
+
+// SetScreencapInterval set how often screencap is polled in ScreencapMode
+func (m *minicapDaemon) SetScreencapInterval(d time.Duration) {
+	if d > 0 {
+		m.screencapInterval = d
+	}
+}
+
+// runPNGScreencap send screencap as png frames until quit, used by ScreencapMode
+func (m *minicapDaemon) runPNGScreencap() {
+	var err error
+	defer func() {
+		m.doneError(errors.Wrap(err, "screencap"))
+	}()
+	ticker := time.NewTicker(m.screencapInterval)
+	defer ticker.Stop()
+	for {
+		var img image.Image
+		if img, err = m.screencap(); err != nil {
+			return
+		}
+		buf := bytes.NewBuffer(nil)
+		if err = png.Encode(buf, img); err != nil {
+			return
+		}
+		if m.frameSink != nil {
+			b := img.Bounds()
+			m.frameSink(Frame{
+				Data:     buf.Bytes(),
+				Time:     time.Now(),
+				Rotation: m.currentRotation(),
+				Width:    b.Dx(),
+				Height:   b.Dy(),
+				Format:   FormatPNG,
+			}, time.Now())
+		}
+		select {
+		case <-ticker.C:
 		case <-m.quitC:
-			m.killMinicap()
 			return
 		}
 	}
 }
 
+// recoverCapture try to fix the minicap launch error, return true if minicap should be relaunched.
+// minicap.so of another abi may be left by other devices, then push again (only once)
+func (m *minicapDaemon) recoverCapture(err error) bool {
+	if errors.Cause(err) != ErrMinicapLinkFailed || m.repushed {
+		return false
+	}
+	m.repushed = true
+	log.Println("minicap link failed, push binaries again:", err)
+	if er := m.repush(); er != nil {
+		log.Println("push minicap binaries:", er)
+		return false
+	}
+	return true
+}
+
+// buildCaptureArgs return the shell command to launch minicap.
+// Optional flags are only added when minicap -h listed them,
+// some builds emit nothing in socket mode without -r
+func (m *minicapDaemon) buildCaptureArgs() []string {
+	m.configMu.Lock()
+	maxWidth, maxHeight, rotation, quality := m.maxWidth, m.maxHeight, m.rotation, m.jpegQuality
+	binaryPath, caps, layer := m.binaryPath, m.caps, m.captureLayer
+	m.configMu.Unlock()
+	param := fmt.Sprintf("%dx%d@%dx%d/%d", m.width, m.height, maxWidth, maxHeight, rotation)
+	args := []string{"LD_LIBRARY_PATH=/data/local/tmp", binaryPath, "-P", param}
+	if quality > 0 && caps.has("-Q") {
+		args = append(args, "-Q", strconv.Itoa(quality))
+	}
+	if m.frameRate > 0 && caps.has("-r") {
+		args = append(args, "-r", strconv.Itoa(m.frameRate))
+	}
+	if layer != "" && caps.has(captureLayerFlag) {
+		args = append(args, captureLayerFlag, shellQuote(layer))
+	}
+	if m.streamMode == StdoutMode {
+		// logs go to stderr, drop them to keep stdout pure binary
+		return append(args, "2>/dev/null")
+	}
+	return append(args, "-S")
+}
+
 func (m *minicapDaemon) runScreenCapture() (err error) {
-	param := fmt.Sprintf("%dx%d@%dx%d/%d", m.width, m.height, m.maxWidth, m.maxHeight, m.rotation)
-	c, err := m.OpenCommand("LD_LIBRARY_PATH=/data/local/tmp", m.binaryPath, "-P", param, "-S")
+	args := m.buildCaptureArgs()
+	c, err := m.OpenCommand(args[0], args[1:]...)
 	if err != nil {
 		return
 	}
 	defer c.Close()
-	buf := bufio.NewReader(c)
+	if m.streamMode == StdoutMode {
+		return errors.Wrap(m.frameReader(c), "read minicap stdout")
+	}
+	return m.readMinicapOutput(c)
+}
+
+// readMinicapOutput consume minicap output until it quit
+// the last lines are kept in m.logs for diagnostics
+func (m *minicapDaemon) readMinicapOutput(rd io.Reader) error {
+	buf := bufio.NewReader(rd)
 
 	// Example output below --.
 	// WARNING: ...
 	// PID: 9355
 	// INFO: Using projection 720x1280@720x1280/0
 	// INFO: (jni/minicap/JpgEncoder.cpp:64) Allocating 2766852 bytes for JPG encoder
+	var output []string // before the PID line
 	for {
 		line, _, err := buf.ReadLine()
+		if err == io.EOF {
+			if len(output) == 0 {
+				return errors.Wrap(ErrMinicapLaunchFailed, "no output")
+			}
+			return errors.Wrap(ErrMinicapLaunchFailed, "output: "+strings.Join(output, " | "))
+		}
 		if err != nil {
 			return err
 		}
+		m.logs.Add(string(line))
+		output = append(output, string(line))
+		if isLinkerError(string(line)) {
+			return errors.Wrap(ErrMinicapLinkFailed, string(line))
+		}
 		if strings.HasPrefix(string(line), "WARNING") {
 			continue
 		}
@@ -305,15 +1029,48 @@ func (m *minicapDaemon) runScreenCapture() (err error) {
 			err = errors.New("expect PID: <pid> actually: " + strconv.Quote(string(line)))
 			return errors.Wrap(err, "run minicap")
 		}
+		if pid, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(string(line), "PID:", 2)[1])); err == nil {
+			m.setPID(pid)
+			defer m.setPID(0)
+		}
 		break
 	}
 	for {
-		_, _, err = buf.ReadLine()
+		line, _, err := buf.ReadLine()
 		if err != nil {
 			break
 		}
+		m.logs.Add(string(line))
+	}
+	lines := m.logs.Lines()
+	if len(lines) == 0 {
+		return errors.New("minicap quit")
 	}
-	return errors.New("minicap quit")
+	return errors.New("minicap quit, last output: " + strings.Join(lines, " | "))
+}
+
+func (m *minicapDaemon) setPID(pid int) {
+	m.pidMu.Lock()
+	m.pid = pid
+	m.pidMu.Unlock()
+}
+
+// MinicapPID return the pid of minicap on the device, parsed from its "PID:" output line.
+// alive is false when minicap is not running, pid is 0 then
+func (m *minicapDaemon) MinicapPID() (pid int, alive bool) {
+	m.pidMu.Lock()
+	defer m.pidMu.Unlock()
+	return m.pid, m.pid > 0
+}
+
+// LastLogLines return the latest output lines of minicap
+func (m *minicapDaemon) LastLogLines() []string {
+	return m.logs.Lines()
+}
+
+// SetLogLines set how many minicap output lines to keep
+func (m *minicapDaemon) SetLogLines(n int) {
+	m.logs.Resize(n)
 }
 
 func (m *minicapDaemon) killMinicap() error {
@@ -322,71 +1079,494 @@ func (m *minicapDaemon) killMinicap() error {
 	return nil
 }
 
+// CleanupStale kill all minicap processes left on the device, e.g. by a crashed host
+// before a reboot of it. The abstract socket is released by the kernel with the process,
+// so nothing else is left on the device
+func (m *minicapDaemon) CleanupStale() error {
+	return wrapMultiError(
+		m.killProc("minicap", syscall.SIGKILL),
+		m.killProc("slow-minicap", syscall.SIGKILL))
+}
+
+// SetCleanupOnStart make Start call CleanupStale and fail if it can not list processes
+func (m *minicapDaemon) SetCleanupOnStart(on bool) {
+	m.cleanupOnStart = on
+}
+
 // FIXME(ssx): maybe need to put into go-adb
 func (m *minicapDaemon) killProc(psName string, sig syscall.Signal) (err error) {
-	out, err := m.RunCommand("ps", "-C", psName)
+	// ps of android 8+ only list processes of the shell without -A,
+	// the old toolbox ps list all and do not know -A
+	out, err := m.shell("ps", "-A")
+	if err != nil || len(strings.Split(strings.TrimSpace(out), "\n")) <= 1 {
+		out, err = m.shell("ps")
+	}
 	if err != nil {
-		return
+		return errors.Wrap(err, "ps")
 	}
-	lines := strings.Split(strings.TrimSpace(out), "\n")
-	if len(lines) <= 1 {
-		return errors.New("No process named " + psName + " founded.")
+	for _, pid := range parsePids(out, psName) {
+		m.shell("kill", "-"+strconv.Itoa(int(sig)), pid)
 	}
-	var pidIndex int
+	return nil
+}
+
+// parsePids return pids of processes named exactly name in ps output
+func parsePids(out, name string) (pids []string) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	pidIndex := -1
 	for idx, val := range strings.Fields(lines[0]) {
 		if val == "PID" {
 			pidIndex = idx
 			break
 		}
 	}
+	if pidIndex == -1 {
+		return nil
+	}
 	for _, line := range lines[1:] {
 		fields := strings.Fields(line)
-		if !strings.Contains(line, psName) {
+		if len(fields) <= pidIndex || path.Base(fields[len(fields)-1]) != name {
 			continue
 		}
-		pid := fields[pidIndex]
-		m.RunCommand("kill", "-"+strconv.Itoa(int(sig)), pid)
+		pids = append(pids, fields[pidIndex])
 	}
 	return
 }
 
 type jpgTcpSucker struct {
 	port        int
-	conn        net.Conn
+	userConn    net.Conn // set by SetConn, used instead of the forward
 	quitC       chan bool
-	C           chan []byte
+	C           chan []byte // jpeg data of frames, FrameC has the metadata too
+	FrameC      chan Frame
 	forwardSpec adb.ForwardSpec
+	seq         uint64
+	rotationMu  sync.Mutex
+	rotation    int       // rotation of the last delivered frame, -1 if none
+	rotatedC    chan bool // closed and replaced when rotation changed
+	bannerMu    sync.Mutex
+	banner      *minicapBanner // of the current connection, nil before any
+	onDemand    bool           // only read from minicap when someone subscribed
+	sleepGap    time.Duration
+	clock       func() time.Time
+	stats       frameStats
+	checksum    bool
+	forward     func(adb.ForwardSpec) (int, error)
+	// forwardLocal is used instead of forward when forwardPortRange is set
+	forwardLocal     func(local, remote adb.ForwardSpec) error
+	removeForward    func(local adb.ForwardSpec) error
+	forwardPortRange [2]int
+	bindAddr         string
+	relay            *tcpRelay
+	// some minicap forks send 8 bytes timestamp after the frame size
+	timestampExt     bool
+	maxBufferedBytes int
+	buffered         bufferedBytes
+	retryDelay       time.Duration
+	maxRetryDelay    time.Duration
+	bitrate          bitrateController
+	pauseMu          sync.Mutex
+	paused           bool
+	pauseC           chan bool
+	jpegSize         bool
+	bannerTimeout    time.Duration
+	onBannerTimeout  func() // restart minicap, set by STFCapturer
+	validation       ValidationLevel
+	skipFrames       int
+	fpsMu            sync.Mutex
+	minInterval      time.Duration // host side fps cap, guarded by fpsMu
+	lastDelivered    time.Time
+	forwardedAt      time.Time
+	sink             FrameSink // every frame is delivered through it: C, FrameC, the subscribers and SetSink
+	annotate         AnnotateFunc
+	sizes            frameSizeTracker
+	events           chan Event
+	firstFrameMu     sync.Mutex
+	firstFrameAt     time.Time
+	restartMu        sync.Mutex
+	restartUntil     time.Time
+	maxInFlight      int       // block reading when so many frames in FrameC, 0 to drop instead
+	stoppedC         chan bool // closed by Stop to release a blocked deliver
+	retryMu          sync.Mutex
+	retryAttempt     int
+	nextRetryAt      time.Time
+	preferredFormat  FrameFormat
+	// negotiateFormat return the format of the frames after the banner, the sucker only read jpeg
+	negotiateFormat func(preferred FrameFormat, banner minicapBanner) FrameFormat
 
 	errorMixin
 	safeMixin
 	*adb.Device
+	*FrameHub
+}
+
+func newJpgTcpSucker(device *adb.Device) *jpgTcpSucker {
+	s := &jpgTcpSucker{
+		Device:        device,
+		C:             make(chan []byte, 3),
+		FrameC:        make(chan Frame, 3),
+		rotation:      -1,
+		rotatedC:      make(chan bool),
+		FrameHub:      newFrameHub(),
+		sleepGap:      defaultSleepGap,
+		clock:         time.Now,
+		retryDelay:    defaultRetryDelay,
+		maxRetryDelay: defaultMaxRetryDelay,
+		pauseC:        make(chan bool, 1),
+		bannerTimeout: defaultBannerTimeout,
+		validation:    ValidateSOI,
+		sizes:         frameSizeTracker{factor: defaultAnomalyFactor},
+	}
+	s.negotiateFormat = jpegOnly
+	s.sink = MultiSink{chanSink{s}, s.FrameHub}
+	s.forward = s.ForwardToFreePort
+	s.forwardLocal = s.Forward
+	s.removeForward = s.ForwardRemove
+	return s
 }
 
 func (s *jpgTcpSucker) Start() error {
+	return s.StartContext(context.Background())
+}
+
+// StartContext is Start whose forward, dial and read loop are cancelled when ctx done,
+// Wait then return ctx.Err(). Stop still make Wait return nil
+func (s *jpgTcpSucker) StartContext(ctx context.Context) error {
 	return s.safeDo(_ACTION_START, func() error {
 		s.resetError()
 		var err error
 		s.C = make(chan []byte, 3)
+		if s.maxInFlight > 0 {
+			s.FrameC = make(chan Frame, s.maxInFlight)
+		} else {
+			s.FrameC = make(chan Frame, 3)
+		}
 		s.quitC = make(chan bool, 1)
-		s.port, err = s.ForwardToFreePort(s.forwardSpec)
+		s.stoppedC = make(chan bool)
+		s.setRotation(-1)
+		s.resetLastFrame()
+		s.setBanner(nil)
+		s.pauseMu.Lock()
+		s.paused = false // paused by the degraded mode or Suspend of the last run
+		s.pauseMu.Unlock()
+		if s.userConn != nil {
+			goLabeled(s.Device, "sucker", func() { s.keepReadFromTcp(ctx) })
+			return nil
+		}
+		s.port, err = s.prepareForward(ctx)
 		if err != nil {
 			return err
 		}
-		go s.keepReadFromTcp()
+		s.forwardedAt = time.Now()
+		if s.bindAddr != "" {
+			s.relay, err = newTcpRelay(s.bindAddr, "127.0.0.1:"+strconv.Itoa(s.port))
+			if err != nil {
+				return errors.Wrap(err, "relay forward")
+			}
+		}
+		goLabeled(s.Device, "sucker", func() { s.keepReadFromTcp(ctx) })
 		return nil
 	})
 }
 
+const forwardMaxAttempts = 3
+
+// prepareForward forward minicap socket to a local port, retry when adb is busy.
+// Retries wait as reconnects do, see SetRetryDelay and SetMaxRetryDelay
+func (s *jpgTcpSucker) prepareForward(ctx context.Context) (port int, err error) {
+	fatal := func(err error) bool {
+		return isNoFreePort(err) || ctx.Err() != nil
+	}
+	err = retryWithBackoff(forwardMaxAttempts, s.retryBackoff, fatal, func() (err error) {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		port, err = s.forward(s.forwardSpec)
+		return
+	})
+	return
+}
+
+// SetForwardPortRange make the forward only use local ports in [lo, hi],
+// for environments where the firewall only allow some ports. Must be called before Start
+func (s *jpgTcpSucker) SetForwardPortRange(lo, hi int) error {
+	if lo <= 0 || hi > 65535 || lo > hi {
+		return fmt.Errorf("invalid forward port range %d-%d", lo, hi)
+	}
+	s.forwardPortRange = [2]int{lo, hi}
+	s.forward = s.forwardInRange
+	return nil
+}
+
+// forwardInRange forward remote to the first free local port in forwardPortRange
+func (s *jpgTcpSucker) forwardInRange(remote adb.ForwardSpec) (int, error) {
+	lo, hi := s.forwardPortRange[0], s.forwardPortRange[1]
+	for port := lo; port <= hi; port++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			continue
+		}
+		ln.Close()
+		local := adb.ForwardSpec{Protocol: adb.FProtocolTcp, PortOrName: strconv.Itoa(port)}
+		if err := s.forwardLocal(local, remote); err != nil {
+			return 0, err
+		}
+		return port, nil
+	}
+	return 0, &net.OpError{Op: "listen", Net: "tcp",
+		Err: fmt.Errorf("no free port in range %d-%d", lo, hi)}
+}
+
+// SetConn read the minicap stream from conn instead of the adb forward, e.g. a custom tunnel
+// or an in-memory pipe in tests. Start skip the forward, and the sucker quit when the stream
+// ended since conn can not be dialed again. Must be called before Start
+func (s *jpgTcpSucker) SetConn(conn net.Conn) {
+	s.userConn = conn
+}
+
+// dial connect to minicap through the forward, or return the conn of SetConn
+func (s *jpgTcpSucker) dial(ctx context.Context) (net.Conn, error) {
+	if s.userConn != nil {
+		return s.userConn, nil
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", "127.0.0.1:"+strconv.Itoa(s.port))
+}
+
+// SetBindAddress expose the forwarded minicap stream on addr (eg "0.0.0.0:1313" or "192.168.1.2:0")
+// through a relay, adb itself only listen on localhost. Must be called before Start
+func (s *jpgTcpSucker) SetBindAddress(addr string) {
+	s.bindAddr = addr
+}
+
+// RelayAddr return the address the relay listen on, empty if SetBindAddress not used
+func (s *jpgTcpSucker) RelayAddr() string {
+	if s.relay == nil {
+		return ""
+	}
+	return s.relay.Addr().String()
+}
+
+// isNoFreePort check if err happened when looking for a free local port,
+// retry can not help in that case
+func isNoFreePort(err error) bool {
+	opErr, ok := errors.Cause(err).(*net.OpError)
+	return ok && opErr.Op == "listen"
+}
+
+// SetOnDemand make the sucker connect to minicap only when there are subscribers.
+// minicap stop capture when no client connected, so this also save device power.
+// Must be called before Start
+func (s *jpgTcpSucker) SetOnDemand(on bool) {
+	s.onDemand = on
+}
+
+// SetSleepGap set how long the wall clock may jump before treated as the host slept,
+// the connection is always dead after sleep, so reconnect without waiting read error.
+// 0 to disable the detection, a gap under minSleepGap is raised to it. Must be called before Start
+func (s *jpgTcpSucker) SetSleepGap(gap time.Duration) {
+	switch {
+	case gap <= 0:
+		gap = 0
+	case gap < minSleepGap:
+		gap = minSleepGap
+	}
+	s.sleepGap = gap
+}
+
+// SetChecksum enable computing crc32 of every frame into Frame.Checksum, it cost some cpu
+func (s *jpgTcpSucker) SetChecksum(on bool) {
+	s.checksum = on
+}
+
+// SetTimestampExtension enable reading the microsecond timestamp which some minicap forks
+// send after every frame size, Frame.Time is then the device clock.
+// Do not enable it for the standard minicap, the stream can not be parsed
+func (s *jpgTcpSucker) SetTimestampExtension(on bool) {
+	s.timestampExt = on
+}
+
+// SetMaxBufferedBytes limit the total size of frames waiting in FrameC,
+// new frames are dropped when over the limit, but a frame is never dropped when FrameC is empty.
+// 0 means no limit
+func (s *jpgTcpSucker) SetMaxBufferedBytes(n int) {
+	s.maxBufferedBytes = n
+}
+
+// SetBlockingDelivery deliver every frame to C, when maxInFlight frames are not consumed
+// the sucker stop reading the socket until C has room again. 0 to drop frames when C is full (default).
+//
+// Host memory is bounded by maxInFlight frames plus the kernel socket buffers.
+// Once the socket is full minicap can not send, it keeps only the newest frame
+// and skip the older ones on the device, so frames are still lost, but on the device side.
+// Only works in SocketMode, must be called before Start
+func (s *jpgTcpSucker) SetBlockingDelivery(maxInFlight int) {
+	s.maxInFlight = maxInFlight
+}
+
+// SetRetryDelay set the wait before the second reconnect to minicap, it doubles for
+// every following failure up to SetMaxRetryDelay.
+// The first reconnect after a working connection is always immediate
+func (s *jpgTcpSucker) SetRetryDelay(d time.Duration) {
+	s.retryDelay = d
+}
+
+// SetMaxRetryDelay cap the wait between reconnects to minicap
+func (s *jpgTcpSucker) SetMaxRetryDelay(d time.Duration) {
+	s.maxRetryDelay = d
+}
+
+// retryBackoff return the wait before the reconnect after failures failures in a row
+func (s *jpgTcpSucker) retryBackoff(failures int) time.Duration {
+	if failures <= 1 {
+		return 0
+	}
+	delay := s.retryDelay
+	for i := 2; i < failures && delay < s.maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.maxRetryDelay {
+		delay = s.maxRetryDelay
+	}
+	return delay
+}
+
+// SetJPEGSize make Frame.Width and Frame.Height the real jpeg size instead of
+// the virtual size in the banner, which may be different with some device quirks
+func (s *jpgTcpSucker) SetJPEGSize(on bool) {
+	s.jpegSize = on
+}
+
+// ValidationLevel choose how strict frames are checked before delivered,
+// a stricter level cost more cpu but catch more broken frames
+type ValidationLevel int
+
+const (
+	// ValidateNone deliver whatever minicap send, fastest
+	ValidateNone ValidationLevel = iota
+	// ValidateSOI check the jpeg starts with 0xff,0xd8, cheap and catch a broken stream
+	ValidateSOI
+	// ValidateSOIAndEOI also check the jpeg ends with 0xff,0xd9, catch truncated frames
+	ValidateSOIAndEOI
+	// ValidateFull also check all the declared bytes are read and the jpeg size can be parsed,
+	// it scan the jpeg headers of every frame
+	ValidateFull
+)
+
+// validateJPEG check data which minicap declared as size bytes
+func validateJPEG(data []byte, size uint32, level ValidationLevel) error {
+	if level >= ValidateSOI && !bytes.HasPrefix(data, []byte("\xff\xd8")) {
+		return errors.New("jpeg format error, not starts with 0xff,0xd8")
+	}
+	if level >= ValidateSOIAndEOI && !bytes.HasSuffix(data, []byte("\xff\xd9")) {
+		return errors.New("jpeg format error, not ends with 0xff,0xd9")
+	}
+	if level >= ValidateFull {
+		if len(data) != int(size) {
+			return fmt.Errorf("jpeg truncated, expect %d bytes, got %d", size, len(data))
+		}
+		if _, _, err := JPEGDimensions(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetValidationLevel set how strict frames are checked, default ValidateSOI.
+// A frame failed the check break the connection like other stream errors
+func (s *jpgTcpSucker) SetValidationLevel(level ValidationLevel) {
+	s.validation = level
+}
+
+// SetPreferredFormat hint the format of frames wanted from minicap. minicap only output jpeg
+// for now, so jpeg is always used, Frame.Format tell the real format
+func (s *jpgTcpSucker) SetPreferredFormat(format FrameFormat) {
+	s.preferredFormat = format
+}
+
+// SetSink deliver every frame to sink too, besides C, FrameC and the subscribers.
+// Use MultiSink for more than one, nil to remove it. Must be called before Start
+func (s *jpgTcpSucker) SetSink(sink FrameSink) {
+	sinks := MultiSink{chanSink{s}, s.FrameHub}
+	if sink != nil {
+		sinks = append(sinks, sink)
+	}
+	s.sink = sinks
+}
+
+// SetMaxFPS drop frames on the host to deliver at most fps frames per second, 0 means no cap
+func (s *jpgTcpSucker) SetMaxFPS(fps float64) {
+	var interval time.Duration
+	if fps > 0 {
+		interval = time.Duration(float64(time.Second) / fps)
+	}
+	s.fpsMu.Lock()
+	s.minInterval = interval
+	s.fpsMu.Unlock()
+}
+
+// SetSkipInitialFrames discard the first n frames of every connection to minicap,
+// some devices send broken frames just after minicap launched.
+// The sucker reconnect on every minicap restart, so frames are skipped again after restart
+func (s *jpgTcpSucker) SetSkipInitialFrames(n int) {
+	s.skipFrames = n
+}
+
+// SetBannerTimeout set how long to wait for the banner after connected,
+// minicap is restarted on timeout because it usually did not attach. 0 means wait forever
+func (s *jpgTcpSucker) SetBannerTimeout(d time.Duration) {
+	s.bannerTimeout = d
+}
+
 func (s *jpgTcpSucker) Stop() error {
 	return s.safeDo(_ACTION_STOP, func() error {
+		if s.stoppedC != nil {
+			close(s.stoppedC)
+		}
 		s.quitC <- true
-		if s.conn != nil {
-			s.conn.Close()
+		if s.relay != nil {
+			s.relay.Close()
+			s.relay = nil
 		}
 		return s.Wait()
 	})
 }
 
+// Drain discard all frames buffered in FrameC and C without blocking
+// return the number of frames discarded from FrameC
+func (s *jpgTcpSucker) Drain() int {
+	n := 0
+	for {
+		select {
+		case <-s.FrameC:
+			n++
+		case <-s.C:
+		default:
+			return n
+		}
+	}
+}
+
+// bufferedBytes estimate the total size of frames in FrameC.
+// consumers receive from FrameC directly, so sizes are recorded in order
+// and popped when len(FrameC) shows some frames have been taken
+type bufferedBytes struct {
+	sizes []int
+	total int
+}
+
+func (b *bufferedBytes) sync(buffered int) {
+	for len(b.sizes) > buffered {
+		b.total -= b.sizes[0]
+		b.sizes = b.sizes[1:]
+	}
+}
+
+func (b *bufferedBytes) push(size int) {
+	b.sizes = append(b.sizes, size)
+	b.total += size
+}
+
 type errorBinaryReader struct {
 	rd  io.Reader
 	err error
@@ -405,23 +1585,223 @@ func (r *errorBinaryReader) ReadInto(datas ...interface{}) error {
 	return nil
 }
 
+// minicapBanner is the global header minicap send once after connected
+type minicapBanner struct {
+	Version       uint8
+	Length        uint8
+	Pid           uint32
+	RealWidth     uint32
+	RealHeight    uint32
+	VirtualWidth  uint32
+	VirtualHeight uint32
+	Orientation   uint8
+	Quirks        uint8
+}
+
+// bannerLayout describe the banner of a minicap version
+type bannerLayout struct {
+	length int // minimum length, bytes beyond it are skipped
+	parse  func(data []byte) minicapBanner
+}
+
+// bannerLayouts map banner version to its layout, add new versions here
+var bannerLayouts = map[uint8]bannerLayout{
+	1: {24, parseBannerV1},
+}
+
+// ErrUnsupportedFormat means minicap send frames in a format the sucker can not handle
+var ErrUnsupportedFormat = errors.New("unsupported frame format")
+
+// jpegOnly is the default format negotiation, minicap only output jpeg
+func jpegOnly(preferred FrameFormat, banner minicapBanner) FrameFormat {
+	return FormatJPEG
+}
+
+func parseBannerV1(data []byte) (b minicapBanner) {
+	le := binary.LittleEndian
+	b.Version, b.Length = data[0], data[1]
+	b.Pid = le.Uint32(data[2:])
+	b.RealWidth, b.RealHeight = le.Uint32(data[6:]), le.Uint32(data[10:])
+	b.VirtualWidth, b.VirtualHeight = le.Uint32(data[14:]), le.Uint32(data[18:])
+	b.Orientation, b.Quirks = data[22], data[23]
+	return
+}
+
+// readBanner read and check the banner according to its version
+func readBanner(rd io.Reader) (b minicapBanner, err error) {
+	head := make([]byte, 2) // version and length
+	if _, err = io.ReadFull(rd, head); err != nil {
+		return
+	}
+	layout, ok := bannerLayouts[head[0]]
+	if !ok {
+		return b, fmt.Errorf("bad banner: unsupported version %d", head[0])
+	}
+	if int(head[1]) < layout.length {
+		return b, fmt.Errorf("bad banner: length %d too short for version %d", head[1], head[0])
+	}
+	data := make([]byte, head[1])
+	copy(data, head)
+	if _, err = io.ReadFull(rd, data[2:]); err != nil {
+		return
+	}
+	b = layout.parse(data)
+	err = checkBanner(b.Version, b.RealWidth, b.RealHeight, b.VirtualWidth, b.VirtualHeight, b.Orientation)
+	return
+}
+
+// maxBannerSize is far beyond any real display, only used to catch garbage
+const maxBannerSize = 16384
+
+// checkBanner reject banner which is not sent by minicap.
+// minicap write all integers in little endian, which errorBinaryReader assumes,
+// so a mis-parsed banner usually ends with unreasonable numbers.
+func checkBanner(version uint8, rw, rh, vw, vh uint32, orientation uint8) error {
+	if _, ok := bannerLayouts[version]; !ok {
+		return fmt.Errorf("bad banner: unsupported version %d", version)
+	}
+	for _, v := range []uint32{rw, rh, vw, vh} {
+		if v == 0 || v > maxBannerSize {
+			return fmt.Errorf("bad banner: unreasonable size %dx%d@%dx%d", rw, rh, vw, vh)
+		}
+	}
+	if orientation > 3 {
+		return fmt.Errorf("bad banner: unknown orientation %d", orientation)
+	}
+	return nil
+}
+
+const (
+	defaultSleepGap   = 10 * time.Second
+	defaultRetryDelay = 500 * time.Millisecond
+	// defaultMaxRetryDelay is reached after 4 failures in a row with the default retry delay
+	defaultMaxRetryDelay = 4 * time.Second
+)
+
+var errHostSleep = errors.New("host sleep detected")
+
+const (
+	restartGrace        = 5 * time.Second
+	restartPollInterval = 100 * time.Millisecond
+)
+
+// expectRestart tell the sucker minicap is being restarted on purpose,
+// disconnects in the following restartGrace are not failures
+func (s *jpgTcpSucker) expectRestart() {
+	s.restartMu.Lock()
+	s.restartUntil = s.clock().Add(restartGrace)
+	s.restartMu.Unlock()
+}
+
+func (s *jpgTcpSucker) inRestart() bool {
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+	return s.clock().Before(s.restartUntil)
+}
+
+// ErrBannerTimeout is returned when the socket is connected but minicap send no banner
+var ErrBannerTimeout = errors.New("minicap banner read timeout")
+
+const defaultBannerTimeout = 5 * time.Second
+
+// minSleepGap keep the clock checking of watchHostSleep, every sleepGap/4, reasonable
+const minSleepGap = 4 * time.Millisecond
+
+// watchHostSleep return true when the wall clock jumped more than s.sleepGap.
+// monotonic clock stops while sleeping, so the wall clock is used here.
+func (s *jpgTcpSucker) watchHostSleep(doneC chan bool) bool {
+	ticker := time.NewTicker(s.sleepGap / 4)
+	defer ticker.Stop()
+	last := s.clock().Round(0)
+	for {
+		select {
+		case <-ticker.C:
+		case <-doneC:
+			return false
+		}
+		now := s.clock().Round(0)
+		if now.Sub(last) > s.sleepGap {
+			return true
+		}
+		last = now
+	}
+}
+
 // TODO(ssx): Do not add retry for now
-func (s *jpgTcpSucker) keepReadFromTcp() (err error) {
+func (s *jpgTcpSucker) keepReadFromTcp(ctx context.Context) (err error) {
+	// quitC is closed when Stop called or ctx done, every wait below select on it
+	quitC, exitC := make(chan bool), make(chan bool)
+	defer close(exitC)
+	go func() {
+		select {
+		case <-s.quitC:
+		case <-ctx.Done():
+		case <-exitC:
+			return
+		}
+		close(quitC)
+	}()
 	defer func() {
+		if err == nil {
+			err = ctx.Err()
+		}
 		s.doneError(errors.Wrap(err, "readFromTcp"))
 	}()
-	leftRetry := 10
+	leftRetry, failures := 10, 0
 	for {
-		select {
-		case err = <-GoFunc(s.readFromTcp):
-		case <-s.quitC:
+		if !s.waitResumed(quitC) || (s.onDemand && !s.waitSubscribers(quitC)) {
 			return nil
 		}
+		framesBefore := s.Stats().Frames
+		readCtx, cancel := context.WithCancel(ctx)
+		readC := GoFunc(func() error { return s.readFromTcp(readCtx) })
 		select {
-		case <-time.After(500 * time.Millisecond):
-		case <-s.quitC:
+		case err = <-readC:
+			cancel()
+		case <-quitC:
+			cancel() // close the conn, and wait readFromTcp to return
+			<-readC
 			return nil
 		}
+		if s.userConn != nil {
+			if errors.Cause(err) == io.EOF {
+				err = nil // the stream ended
+			}
+			return
+		}
+		if s.isPaused() || (s.onDemand && s.SubscriberCount() == 0) {
+			continue // disconnected because paused or nobody watching
+		}
+		if errors.Cause(err) == errHostSleep {
+			leftRetry = 10
+			continue
+		}
+		if s.inRestart() {
+			// minicap restarted on purpose, wait until it listen again
+			select {
+			case <-time.After(restartPollInterval):
+			case <-quitC:
+				return nil
+			}
+			continue
+		}
+		if errors.Cause(err) == ErrBannerTimeout && s.onBannerTimeout != nil {
+			s.onBannerTimeout()
+		}
+		if s.Stats().Frames > framesBefore {
+			failures = 0 // it worked for a while
+		}
+		failures++
+		// the first reconnect is immediate, most failures are transient
+		delay := s.retryBackoff(failures)
+		s.setReconnectState(failures, s.clock().Add(delay))
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-quitC:
+				return nil
+			}
+		}
 		if leftRetry <= 0 {
 			err = errors.New("jpgTcpSucker reach max retry(10)")
 			return
@@ -430,88 +1810,614 @@ func (s *jpgTcpSucker) keepReadFromTcp() (err error) {
 	}
 }
 
-func (s *jpgTcpSucker) readFromTcp() (err error) {
-	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(s.port))
+// ReconnectState return how many times in a row the connection to minicap failed
+// and when the next try is. attempt is 0 when connected
+func (s *jpgTcpSucker) ReconnectState() (attempt int, nextRetryAt time.Time) {
+	s.retryMu.Lock()
+	defer s.retryMu.Unlock()
+	return s.retryAttempt, s.nextRetryAt
+}
+
+func (s *jpgTcpSucker) setReconnectState(attempt int, nextRetryAt time.Time) {
+	s.retryMu.Lock()
+	s.retryAttempt, s.nextRetryAt = attempt, nextRetryAt
+	s.retryMu.Unlock()
+}
+
+func (s *jpgTcpSucker) readFromTcp(ctx context.Context) (err error) {
+	conn, err := s.dial(ctx)
 	if err != nil {
 		return
 	}
-	s.conn = conn
 	defer conn.Close()
+	doneC := make(chan bool)
+	defer close(doneC)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-doneC:
+		}
+	}()
+	if s.onDemand {
+		go func() {
+			if s.waitIdle(doneC) {
+				conn.Close()
+			}
+		}()
+	}
+	sleepC := make(chan bool, 1)
+	if s.sleepGap > 0 {
+		go func() {
+			if s.watchHostSleep(doneC) {
+				sleepC <- true
+				conn.Close()
+			}
+		}()
+	}
+	defer func() {
+		select {
+		case <-sleepC:
+			err = errHostSleep
+		default:
+		}
+	}()
 
-	var pid, rw, rh, vw, vh uint32
-	var version, unused, orientation, quirkFlag uint8
+	if s.bannerTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.bannerTimeout))
+	}
+	err = s.readFrames(conn)
+	return err
+}
 
-	rd := bufio.NewReader(conn)
-	binRd := errorBinaryReader{rd: rd}
-	err = binRd.ReadInto(&version, &unused, &pid, &rw, &rh, &vw, &vh, &orientation, &quirkFlag)
+// readFrames parse minicap banner and frames from rd until error
+func (s *jpgTcpSucker) readFrames(rd io.Reader) (err error) {
+	bufrd := bufio.NewReader(rd)
+	binRd := errorBinaryReader{rd: bufrd}
+	banner, err := readBanner(bufrd)
+	if netErr, ok := errors.Cause(err).(net.Error); ok && netErr.Timeout() {
+		return ErrBannerTimeout
+	}
 	if err != nil {
 		return err
 	}
+	s.setBanner(&banner)
+	format := s.negotiateFormat(s.preferredFormat, banner)
+	if format != FormatJPEG {
+		return errors.Wrapf(ErrUnsupportedFormat, "minicap send %s", format.MimeType())
+	}
+	if conn, ok := rd.(net.Conn); ok {
+		conn.SetReadDeadline(time.Time{}) // frames may pause when screen not changing
+	}
+	s.setReconnectState(0, time.Time{})
 
+	skipped := 0
 	for {
 		var size uint32
 		if err = binRd.ReadInto(&size); err != nil {
 			break
 		}
+		var timestamp uint64 // microseconds since epoch on the device
+		if s.timestampExt {
+			if err = binRd.ReadInto(&timestamp); err != nil {
+				break
+			}
+		}
 
-		lr := &io.LimitedReader{rd, int64(size)}
+		lr := &io.LimitedReader{R: bufrd, N: int64(size)}
 		buf := bytes.NewBuffer(nil)
 		_, err = io.Copy(buf, lr)
 		if err != nil {
 			break
 		}
-		if string(buf.Bytes()[:2]) != "\xff\xd8" {
-			err = errors.New("jpeg format error, not starts with 0xff,0xd8")
+		if err = validateJPEG(buf.Bytes(), size, s.validation); err != nil {
 			break
 		}
+		if skipped < s.skipFrames {
+			skipped++
+			continue
+		}
+		recvTime := time.Now()
+		frame := Frame{
+			Data:     buf.Bytes(),
+			Time:     recvTime,
+			Rotation: int(banner.Orientation) * 90,
+			Width:    int(banner.VirtualWidth),
+			Height:   int(banner.VirtualHeight),
+			Format:   format,
+		}
+		if s.timestampExt {
+			frame.Time = time.Unix(0, int64(timestamp)*int64(time.Microsecond))
+		}
+		if s.jpegSize {
+			if w, h, err := JPEGDimensions(frame.Data); err == nil {
+				frame.Width, frame.Height = w, h
+			}
+		}
+		if s.bitrate.enabled() {
+			frame.Data = recompress(frame.Data, s.bitrate.currentQuality())
+			s.bitrate.observe(len(frame.Data), recvTime)
+		}
+		if s.checksum {
+			frame.Checksum = crc32.ChecksumIEEE(frame.Data)
+		}
+		s.deliver(frame, recvTime)
+	}
+	return err
+}
+
+// deliver number the frame and send it to C and subscribers
+func (s *jpgTcpSucker) deliver(frame Frame, recvTime time.Time) {
+	s.fpsMu.Lock()
+	minInterval := s.minInterval
+	s.fpsMu.Unlock()
+	if minInterval > 0 && recvTime.Sub(s.lastDelivered) < minInterval {
+		return // over the fps cap
+	}
+	s.lastDelivered = recvTime
+	s.firstFrameMu.Lock()
+	if s.firstFrameAt.IsZero() {
+		s.firstFrameAt = recvTime
+	}
+	s.firstFrameMu.Unlock()
+	s.seq++
+	frame.Seq = s.seq
+	if avg := s.sizes.avg; s.sizes.check(len(frame.Data)) && s.events != nil {
 		select {
-		case s.C <- buf.Bytes(): // Maybe should use buffer instead
+		case s.events <- Event{Type: EventFrameSizeAnomaly, Time: recvTime, Seq: frame.Seq, Size: len(frame.Data),
+			Message: fmt.Sprintf("frame %d is %d bytes, average is %.0f", frame.Seq, len(frame.Data), avg)}:
 		default:
-			// image should not wait or it will stuck here
 		}
 	}
-	return err
+	if s.annotate != nil && frame.Format == FormatJPEG {
+		quality := defaultRecompressQuality
+		if s.bitrate.enabled() {
+			quality = s.bitrate.currentQuality()
+		}
+		frame.Data = annotateJPEG(frame, quality, s.annotate)
+		if s.checksum {
+			frame.Checksum = crc32.ChecksumIEEE(frame.Data)
+		}
+	}
+	s.stats.add(recvTime)
+	if s.sink.Deliver(frame) {
+		s.setRotation(frame.Rotation)
+	}
+}
+
+// chanSink send frames to FrameC and their data to C of the sucker,
+// it read the channels from the sucker as Start replace them
+type chanSink struct {
+	s *jpgTcpSucker
+}
+
+func (c chanSink) Deliver(frame Frame) bool {
+	s := c.s
+	select {
+	case s.C <- frame.Data:
+	default:
+	}
+	s.buffered.sync(len(s.FrameC))
+	if s.maxInFlight > 0 && s.stoppedC != nil {
+		// blocking here stop reading the socket, the device side feel the backpressure
+		select {
+		case s.FrameC <- frame:
+		case <-s.stoppedC:
+			return false
+		}
+	} else if s.maxBufferedBytes > 0 && len(s.buffered.sizes) > 0 && s.buffered.total+len(frame.Data) > s.maxBufferedBytes {
+		return false // a frame larger than the limit still pass when nothing is waiting
+	} else if !ChannelSink(s.FrameC).Deliver(frame) {
+		return false // image should not wait or it will stuck here
+	}
+	s.buffered.push(len(frame.Data))
+	return true
+}
+
+// setPaused stop connecting to minicap until resumed, failures while paused are not counted
+func (s *jpgTcpSucker) setPaused(paused bool) {
+	s.pauseMu.Lock()
+	s.paused = paused
+	s.pauseMu.Unlock()
+	select {
+	case s.pauseC <- true:
+	default:
+	}
+}
+
+func (s *jpgTcpSucker) isPaused() bool {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	return s.paused
+}
+
+// waitResumed block while paused, return false if quitC closed
+func (s *jpgTcpSucker) waitResumed(quitC chan bool) bool {
+	for s.isPaused() {
+		select {
+		case <-s.pauseC:
+		case <-quitC:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *jpgTcpSucker) setRotation(r int) {
+	s.rotationMu.Lock()
+	defer s.rotationMu.Unlock()
+	if s.rotation == r {
+		return
+	}
+	s.rotation = r
+	close(s.rotatedC)
+	s.rotatedC = make(chan bool)
+}
+
+func (s *jpgTcpSucker) setBanner(b *minicapBanner) {
+	s.bannerMu.Lock()
+	s.banner = b
+	s.bannerMu.Unlock()
+}
+
+// lastBanner return the banner minicap sent on the current connection
+func (s *jpgTcpSucker) lastBanner() (minicapBanner, bool) {
+	s.bannerMu.Lock()
+	defer s.bannerMu.Unlock()
+	if s.banner == nil {
+		return minicapBanner{}, false
+	}
+	return *s.banner, true
+}
+
+// lastRotation return the rotation of the last delivered frame, -1 if none,
+// and a channel closed when it changed
+func (s *jpgTcpSucker) lastRotation() (int, chan bool) {
+	s.rotationMu.Lock()
+	defer s.rotationMu.Unlock()
+	return s.rotation, s.rotatedC
 }
 
 type STFCapturer struct {
 	*minicapDaemon
 	*jpgTcpSucker
+	events      chan Event
+	maxDuration time.Duration
+	fpsFraction float64
+	autoRotate  time.Duration
+	cancelPoll  context.CancelFunc
+	ctxStopC    chan bool // closed by Stop to release the watcher of StartContext
+	ctxWatch    context.Context
+	ctxWatchC   chan bool // closed when the watcher of StartContext returned
+	watcher     *rotationWatcher
+	rotationOut chan int // latest rotation for RotationC
+	timerMu     sync.Mutex
+	stopTimer   *time.Timer
+	readMu      sync.Mutex
+	pending     *Frame     // frame not fit in the buffer of last ReadFrame
+	waitErrC    chan error // result of Wait, for ReadFrame
+	errMu       sync.Mutex
+	err         error // why the capturer stopped by itself
+
+	startRetryBackoff time.Duration
+}
+
+// NewSTFCapturer create a capturer of device, opts are applied in order
+func NewSTFCapturer(device *adb.Device, opts ...Option) *STFCapturer {
+	events := make(chan Event, 10)
+	m := newMinicapDaemon(nil, device)
+	m.events = events
+	sucker := newJpgTcpSucker(device)
+	sucker.events = events
+	m.frameSink = sucker.deliver
+	m.onDegraded = func() {
+		sucker.setPaused(true)
+	}
+	m.onRestart = sucker.expectRestart
+	sucker.onBannerTimeout = func() {
+		m.SetRotation(m.currentRotation()) // force restart minicap
+	}
+	s := &STFCapturer{
+		minicapDaemon: m,
+		jpgTcpSucker:  sucker,
+		events:        events,
+		rotationOut:   make(chan int, 1),
+
+		startRetryBackoff: defaultStartRetryBackoff,
+	}
+	m.onDisconnected = func() {
+		s.errMu.Lock()
+		s.err = ErrDeviceDisconnected
+		s.errMu.Unlock()
+		go s.Stop() // the sucker would retry a dead forward until max retry
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(s)
+		}
+	}
+	return s
+}
+
+// Suspend stop minicap so the device do no capture work during a long idle,
+// the forward is kept and the sucker reconnect as soon as Awaken called
+func (s *STFCapturer) Suspend() error {
+	s.jpgTcpSucker.setPaused(true) // before minicap killed, so the disconnect is not a failure
+	if err := s.minicapDaemon.suspend(true); err != nil {
+		s.jpgTcpSucker.setPaused(false)
+		return err
+	}
+	return nil
+}
+
+// Awaken launch minicap again after Suspend
+func (s *STFCapturer) Awaken() error {
+	if err := s.minicapDaemon.suspend(false); err != nil {
+		return err
+	}
+	s.jpgTcpSucker.setPaused(false)
+	return nil
 }
 
-func NewSTFCapturer(device *adb.Device) *STFCapturer {
-	return &STFCapturer{
-		minicapDaemon: newMinicapDaemon(nil, device),
-		jpgTcpSucker:  &jpgTcpSucker{Device: device},
+const defaultStartRetryBackoff = 500 * time.Millisecond
+
+// isFatalStartError tell if starting again can not help
+func isFatalStartError(err error) bool {
+	switch errors.Cause(err) {
+	case ErrNoCaptureMethod, ErrBinariesMissing, ErrMinicapLinkFailed, ErrDeviceDisconnected,
+		context.Canceled, context.DeadlineExceeded:
+		return true
 	}
+	return false
+}
+
+// StartWithRetry call StartContext with ctx up to maxAttempts times, the wait between attempts
+// start from 500ms and is doubled every time. Parts started by a failed attempt are stopped before
+// the next one. Errors retry can not fix, like ErrNoCaptureMethod, are returned without retry
+func (s *STFCapturer) StartWithRetry(ctx context.Context, maxAttempts int) (err error) {
+	backoff := s.startRetryBackoff
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = s.StartContext(ctx)
+		if err == nil || err == ErrServiceAlreadyStarted {
+			return
+		}
+		s.Stop() // minicap may be running when the forward failed
+		if isFatalStartError(err) || attempt == maxAttempts {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+	return
+}
+
+// Err return why the capturer stopped by itself, e.g. ErrDeviceDisconnected,
+// or the error of the ctx given to StartContext. nil while running or when stopped by Stop
+func (s *STFCapturer) Err() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
+}
+
+// Events return the channel of capturer events, events are dropped if not read in time
+func (s *STFCapturer) Events() <-chan Event {
+	return s.events
+}
+
+// SetStreamMode choose how frames are transferred, must be called before Start
+func (s *STFCapturer) SetStreamMode(mode StreamMode) {
+	s.minicapDaemon.streamMode = mode
+}
+
+// SetMaxDuration stop the capturer automatically when d elapsed since Start,
+// so a forgotten capture do not run forever. 0 means no limit
+func (s *STFCapturer) SetMaxDuration(d time.Duration) {
+	s.maxDuration = d
 }
 
 func (s *STFCapturer) Start() error {
-	err := s.minicapDaemon.Start()
+	return s.StartContext(context.Background())
+}
+
+// StartContext is Start whose preparation is cancelled when ctx done. After started,
+// the capturer is stopped when ctx done, then Wait return and Err is ctx.Err()
+func (s *STFCapturer) StartContext(ctx context.Context) error {
+	if err := s.start(ctx); err != nil {
+		return err
+	}
+	if ctx.Done() != nil {
+		stopC, watchC := make(chan bool), make(chan bool)
+		s.timerMu.Lock()
+		s.ctxStopC = stopC
+		s.ctxWatch, s.ctxWatchC = ctx, watchC
+		s.timerMu.Unlock()
+		go func() {
+			defer close(watchC)
+			select {
+			case <-ctx.Done():
+				s.errMu.Lock()
+				s.err = ctx.Err()
+				s.errMu.Unlock()
+				s.Stop()
+			case <-stopC:
+			}
+		}()
+	}
+	s.armMaxDuration()
+	s.applyAutoFPSCap()
+	if s.watcher != nil || s.autoRotate > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.timerMu.Lock()
+		s.cancelPoll = cancel
+		s.timerMu.Unlock()
+		if s.watcher != nil {
+			go s.watcher.run(ctx)
+		} else {
+			go s.minicapDaemon.pollRotation(ctx, s.autoRotate, s.rotationChanged)
+		}
+	}
+	return nil
+}
+
+// EnableRotationWatcher follow the device rotation with RotationWatcher.apk after Start,
+// dumpsys is polled every second instead if the apk can not run. Must be called before Start
+func (s *STFCapturer) EnableRotationWatcher() {
+	s.watcher = newRotationWatcher(s.minicapDaemon, s.autoRotate, s.rotationChanged)
+	s.minicapDaemon.setDefaultRestartDebounce(autoRotateDebounce)
+}
+
+// RotationC receive the device rotation when it changed, only the latest one is kept.
+// It works with EnableRotationWatcher or EnableAutoRotate
+func (s *STFCapturer) RotationC() <-chan int {
+	return s.rotationOut
+}
+
+// rotationChanged restart minicap with rotation r and publish it to RotationC
+func (s *STFCapturer) rotationChanged(r int) {
+	s.minicapDaemon.SetRotation(r)
+	select {
+	case <-s.rotationOut:
+	default:
+	}
+	select {
+	case s.rotationOut <- r:
+	default:
+	}
+}
+
+// autoRotateDebounce cover the screen rotate animation
+const autoRotateDebounce = 500 * time.Millisecond
+
+// EnableAutoRotate poll the device rotation every interval after Start and restart minicap
+// when it changed, so frames are always upright without a rotation watcher.
+// Restarts are debounced by 500ms unless SetRestartDebounce is called. Must be called before Start
+func (s *STFCapturer) EnableAutoRotate(interval time.Duration) {
+	s.autoRotate = interval
+	s.minicapDaemon.setDefaultRestartDebounce(autoRotateDebounce)
+}
+
+// SetAutoFPSCap cap the fps to fraction of the display refresh rate at Start,
+// 90Hz and 120Hz devices may send much more frames than needed. 0 to disable
+func (s *STFCapturer) SetAutoFPSCap(fraction float64) {
+	s.fpsFraction = fraction
+}
+
+func (s *STFCapturer) applyAutoFPSCap() {
+	if s.fpsFraction <= 0 {
+		return
+	}
+	rate, err := s.minicapDaemon.RefreshRate()
+	if err != nil {
+		log.Println("auto fps cap:", err)
+		return
+	}
+	s.jpgTcpSucker.SetMaxFPS(rate * s.fpsFraction)
+}
+
+// armMaxDuration start the timer to Stop when maxDuration reached
+func (s *STFCapturer) armMaxDuration() {
+	if s.maxDuration <= 0 {
+		return
+	}
+	s.timerMu.Lock()
+	defer s.timerMu.Unlock()
+	s.stopTimer = time.AfterFunc(s.maxDuration, func() {
+		emitEvent(s.events, EventMaxDurationReached,
+			fmt.Sprintf("max duration %v reached, stop capturing", s.maxDuration), nil)
+		s.Stop()
+	})
+}
+
+func (s *STFCapturer) start(ctx context.Context) error {
+	s.errMu.Lock()
+	s.err = nil
+	s.errMu.Unlock()
+	s.jpgTcpSucker.firstFrameMu.Lock()
+	s.jpgTcpSucker.firstFrameAt = time.Time{}
+	s.jpgTcpSucker.firstFrameMu.Unlock()
+	switch s.minicapDaemon.streamMode {
+	case StdoutMode:
+		s.minicapDaemon.frameReader = s.jpgTcpSucker.readFrames
+		return s.minicapDaemon.StartContext(ctx)
+	case ScreencapMode:
+		return s.minicapDaemon.StartContext(ctx)
+	}
+	err := s.minicapDaemon.StartContext(ctx)
 	if err != nil {
 		return err
 	}
-	if s.minicapDaemon.binaryPath == "/data/local/tmp/slow-minicap" {
-		s.jpgTcpSucker.forwardSpec = adb.ForwardSpec{adb.FProtocolTcp, "2016"}
-	} else {
-		s.jpgTcpSucker.forwardSpec = adb.ForwardSpec{adb.FProtocolAbstract, "minicap"}
+	s.jpgTcpSucker.forwardSpec = minicapForwardSpec(s.minicapDaemon.binaryPath)
+	return s.jpgTcpSucker.StartContext(ctx)
+}
+
+// minicapForwardSpec return the socket minicap at binaryPath listen on
+func minicapForwardSpec(binaryPath string) adb.ForwardSpec {
+	if binaryPath == "/data/local/tmp/slow-minicap" {
+		return adb.ForwardSpec{Protocol: adb.FProtocolTcp, PortOrName: "2016"}
 	}
-	return s.jpgTcpSucker.Start()
+	return adb.ForwardSpec{Protocol: adb.FProtocolAbstract, PortOrName: "minicap"}
 }
 
 func (s *STFCapturer) Stop() error {
+	s.timerMu.Lock()
+	if s.stopTimer != nil {
+		s.stopTimer.Stop()
+		s.stopTimer = nil
+	}
+	if s.cancelPoll != nil {
+		s.cancelPoll()
+		s.cancelPoll = nil
+	}
+	if s.ctxStopC != nil {
+		close(s.ctxStopC)
+		s.ctxStopC = nil
+	}
+	s.timerMu.Unlock()
+	if s.minicapDaemon.streamMode != SocketMode {
+		return s.minicapDaemon.Stop()
+	}
 	return wrapMultiError(
 		s.minicapDaemon.Stop(),
 		s.jpgTcpSucker.Stop())
 }
 
 func (s *STFCapturer) Wait() error {
+	if s.minicapDaemon.streamMode != SocketMode {
+		return s.minicapDaemon.Wait()
+	}
+	var err error
 	select {
-	case err := <-GoFunc(s.minicapDaemon.Wait):
-		return err
-	case err := <-GoFunc(s.jpgTcpSucker.Wait):
-		return err
+	case err = <-GoFunc(s.minicapDaemon.Wait):
+	case err = <-GoFunc(s.jpgTcpSucker.Wait):
+	}
+	// the sucker also quit on ctx, wait the watcher of StartContext stop the rest
+	s.timerMu.Lock()
+	ctx, watchC := s.ctxWatch, s.ctxWatchC
+	s.timerMu.Unlock()
+	if watchC != nil && ctx.Err() != nil {
+		<-watchC
 	}
+	return err
 	// return wrapMultiError(
 	// 	s.minicapDaemon.Wait(),
 	// 	s.jpgTcpSucker.Wait())
 }
+
+// WaitRotation block until a frame with rotation r has been delivered
+func (s *STFCapturer) WaitRotation(ctx context.Context, r int) error {
+	for {
+		rotation, rotatedC := s.jpgTcpSucker.lastRotation()
+		if rotation == r {
+			return nil
+		}
+		select {
+		case <-rotatedC:
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "wait rotation %d", r)
+		}
+	}
+}
@@ -2,10 +2,26 @@ package stf
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
 	"image/jpeg"
+	"image/png"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	adb "github.com/openatx/go-adb"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -27,3 +43,1677 @@ func TestSTFCapturer(t *testing.T) {
 	err = cap.Stop()
 	assert.NoError(t, err)
 }
+
+func TestSTFCapturerFrameC(t *testing.T) {
+	frames := [][]byte{makeJpeg(t, 72, 128, color.White), makeJpeg(t, 72, 128, color.Black)}
+	cap := startFakeCapturer(t, frames...)
+	defer cap.Stop()
+	for i, data := range frames {
+		select {
+		case frame := <-cap.FrameC:
+			assert.Equal(t, data, frame.Data)
+			assert.Equal(t, uint64(i+1), frame.Seq)
+			assert.Equal(t, FormatJPEG, frame.Format)
+			assert.Equal(t, 720, frame.Width)
+			assert.Equal(t, 1280, frame.Height)
+			assert.False(t, frame.Time.IsZero())
+		case <-time.After(2 * time.Second):
+			t.Fatal("no frame captured")
+		}
+		assert.Equal(t, data, <-cap.C, "C carry the same jpeg data")
+	}
+}
+
+func TestSuckerDrain(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	for i := 0; i < 3; i++ {
+		s.FrameC <- Frame{Data: []byte("\xff\xd8")}
+	}
+	assert.Equal(t, 3, s.Drain())
+	assert.Equal(t, 0, len(s.FrameC))
+	assert.Equal(t, 0, s.Drain())
+}
+
+func TestMinicapLogLines(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	m.SetLogLines(3)
+	output := strings.Join([]string{
+		"WARNING: linker: minicap has text relocations",
+		"PID: 9355",
+		"INFO: Using projection 720x1280@720x1280/0",
+		"INFO: (jni/minicap/JpgEncoder.cpp:64) Allocating 2766852 bytes for JPG encoder",
+		"ERROR: Unable to get frame",
+	}, "\n")
+	err := m.readMinicapOutput(strings.NewReader(output))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unable to get frame")
+	assert.Equal(t, []string{
+		"INFO: Using projection 720x1280@720x1280/0",
+		"INFO: (jni/minicap/JpgEncoder.cpp:64) Allocating 2766852 bytes for JPG encoder",
+		"ERROR: Unable to get frame",
+	}, m.LastLogLines())
+}
+
+// fakeJpeg is the smallest data accepted by jpgTcpSucker
+var fakeJpeg = []byte("\xff\xd8fake jpeg\xff\xd9")
+
+// fakeRawServer serve data to the first connection, return the listen port
+func fakeRawServer(t *testing.T, data []byte) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(data)
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// fakeMinicapServer serve banner and frames like minicap every 10ms, return the listen port
+func fakeMinicapServer(t *testing.T, orientation uint8, frames ...[]byte) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		writeMinicapBanner(conn, 720, 1280, orientation)
+		for _, data := range frames {
+			time.Sleep(10 * time.Millisecond)
+			if writeMinicapFrame(conn, data) != nil {
+				return
+			}
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestWaitRotation(t *testing.T) {
+	port := fakeMinicapServer(t, 1, fakeJpeg, fakeJpeg)
+	sucker := newJpgTcpSucker(nil)
+	sucker.port = port
+	cap := &STFCapturer{jpgTcpSucker: sucker}
+	go sucker.readFromTcp(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.NoError(t, cap.WaitRotation(ctx, 90))
+
+	frame := <-cap.FrameC
+	assert.Equal(t, 90, frame.Rotation)
+	assert.Equal(t, uint64(1), frame.Seq)
+	assert.Equal(t, frame.Data, <-cap.C, "C still carry the jpeg data")
+
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Error(t, cap.WaitRotation(ctx, 180))
+
+	doneC := make(chan error, 1)
+	go func() {
+		doneC <- cap.WaitRotation(context.Background(), 270)
+	}()
+	sucker.setRotation(270)
+	select {
+	case err := <-doneC:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("WaitRotation not woken by the rotation change")
+	}
+}
+
+func TestSTFCapturerRotate(t *testing.T) {
+	cap := NewSTFCapturer(dev, nil)
+	err := cap.Start()
+	assert.NoError(t, err)
+	defer cap.Stop()
+
+	cap.SetRotation(90)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, cap.WaitRotation(ctx, 90))
+}
+
+func TestSuckerOnDemand(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	acceptC := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			acceptC <- conn
+		}
+	}()
+
+	s := newJpgTcpSucker(nil)
+	s.port = ln.Addr().(*net.TCPAddr).Port
+	s.quitC = make(chan bool, 1)
+	s.SetOnDemand(true)
+	s.resetError()
+	go s.keepReadFromTcp(context.Background())
+	defer func() {
+		s.quitC <- true
+	}()
+
+	select {
+	case <-acceptC:
+		t.Fatal("should not connect without subscribers")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	subC := s.Subscribe()
+	var conn net.Conn
+	select {
+	case conn = <-acceptC:
+	case <-time.After(time.Second):
+		t.Fatal("should connect after subscribe")
+	}
+	writeMinicapBanner(conn, 720, 1280, 0)
+	writeMinicapFrame(conn, fakeJpeg)
+	select {
+	case frame := <-subC:
+		assert.Equal(t, fakeJpeg, frame.Data)
+	case <-time.After(time.Second):
+		t.Fatal("no frame received by subscriber")
+	}
+
+	s.Unsubscribe(subC)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err, "connection should be closed when nobody subscribed")
+}
+
+func TestCheckBanner(t *testing.T) {
+	assert.NoError(t, checkBanner(1, 1080, 1920, 720, 1280, 3))
+	assert.Error(t, checkBanner(2, 1080, 1920, 720, 1280, 0))
+	assert.Error(t, checkBanner(1, 0, 1920, 720, 1280, 0))
+	assert.Error(t, checkBanner(1, 1080, 1920, 720, 1280, 4))
+
+	// minicap is little endian, a big endian banner must not pass
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.BigEndian, []uint32{9355, 1080, 1920, 720, 1280})
+	var pid, rw, rh, vw, vh uint32
+	binRd := errorBinaryReader{rd: buf}
+	assert.NoError(t, binRd.ReadInto(&pid, &rw, &rh, &vw, &vh))
+	assert.Error(t, checkBanner(1, rw, rh, vw, vh, 0))
+}
+
+func TestSuckerGarbageBanner(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	s.port = fakeRawServer(t, []byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+	err := s.readFromTcp(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "bad banner")
+}
+
+func TestSuckerHostSleep(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		writeMinicapBanner(conn, 720, 1280, 0)
+		time.Sleep(5 * time.Second) // wedged connection
+	}()
+
+	var mu sync.Mutex
+	now := time.Now()
+	s := newJpgTcpSucker(nil)
+	s.port = ln.Addr().(*net.TCPAddr).Port
+	s.SetSleepGap(100 * time.Millisecond)
+	s.clock = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	errC := GoFunc(func() error { return s.readFromTcp(context.Background()) })
+	select {
+	case err := <-errC:
+		t.Fatalf("should not return before sleep: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	mu.Lock()
+	now = now.Add(time.Hour) // host wake up
+	mu.Unlock()
+	select {
+	case err := <-errC:
+		assert.Equal(t, errHostSleep, err)
+	case <-time.After(time.Second):
+		t.Fatal("host sleep not detected")
+	}
+}
+
+func TestParseMinicapInfo(t *testing.T) {
+	out := strings.Join([]string{
+		"WARNING: linker: /data/local/tmp/minicap has text relocations.",
+		`{`,
+		`    "id": 0,`,
+		`    "width": 1080,`,
+		`    "height": 1920,`,
+		`    "xdpi": 422.03,`,
+		`    "ydpi": 424.069,`,
+		`    "size": 5.19657,`,
+		`    "density": 3,`,
+		`    "fps": 60,`,
+		`    "secure": true,`,
+		`    "rotation": 90`,
+		`}`,
+		"INFO: (jni/minicap/minicap.cpp:120) {done}",
+	}, "\n")
+	mi, err := parseMinicapInfo(out)
+	assert.NoError(t, err)
+	assert.Equal(t, 1080, mi.Width)
+	assert.Equal(t, 1920, mi.Height)
+	assert.Equal(t, 90, mi.Rotation)
+	assert.True(t, mi.Secure)
+
+	_, err = parseMinicapInfo("ERROR: no display")
+	assert.Error(t, err)
+	_, err = parseMinicapInfo(`{"width": 1080, "name": "}"`)
+	assert.Error(t, err)
+}
+
+func TestStdoutMode(t *testing.T) {
+	cap := NewSTFCapturer(nil)
+	cap.SetStreamMode(StdoutMode)
+	m := cap.minicapDaemon
+	m.width, m.height = 1080, 1920
+	m.binaryPath = "/data/local/tmp/minicap"
+	assert.Equal(t, []string{"LD_LIBRARY_PATH=/data/local/tmp", "/data/local/tmp/minicap",
+		"-P", "1080x1920@720x720/0", "2>/dev/null"}, m.buildCaptureArgs())
+
+	// output of the minicap command
+	stdout := bytes.NewBuffer(nil)
+	writeMinicapBanner(stdout, 720, 1280, 0)
+	writeMinicapFrame(stdout, fakeJpeg)
+	writeMinicapFrame(stdout, fakeJpeg)
+	err := cap.jpgTcpSucker.readFrames(stdout)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 2, len(cap.FrameC))
+	frame := <-cap.FrameC
+	assert.Equal(t, fakeJpeg, frame.Data)
+
+	cap.SetStreamMode(SocketMode)
+	assert.Equal(t, "-S", m.buildCaptureArgs()[4])
+}
+
+func TestSetQualityBeforeStart(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	m.width, m.height = 1080, 1920
+	doneC := make(chan bool)
+	go func() {
+		m.SetQuality(QUALITY_480P)
+		close(doneC)
+	}()
+	select {
+	case <-doneC:
+	case <-time.After(time.Second):
+		t.Fatal("SetQuality blocked before Start")
+	}
+	assert.Equal(t, 480, m.maxWidth)
+	assert.Equal(t, 480, m.maxHeight)
+	assert.Equal(t, "1080x1920@480x480/0", m.buildCaptureArgs()[3])
+}
+
+func TestMinicapLinkFailed(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	pushed := 0
+	m.repush = func() error {
+		pushed++
+		return nil
+	}
+	output := `CANNOT LINK EXECUTABLE "/data/local/tmp/minicap": "/data/local/tmp/minicap.so" is 32-bit instead of 64-bit`
+	err := m.readMinicapOutput(strings.NewReader(output))
+	assert.Equal(t, ErrMinicapLinkFailed, errors.Cause(err))
+	assert.True(t, m.recoverCapture(err))
+	assert.Equal(t, 1, pushed)
+	assert.False(t, m.recoverCapture(err), "should only push again once")
+	assert.Equal(t, 1, pushed)
+
+	err = m.readMinicapOutput(strings.NewReader("PID: 9355\nINFO: quit"))
+	assert.NotEqual(t, ErrMinicapLinkFailed, errors.Cause(err))
+	m.repushed = false
+	assert.False(t, m.recoverCapture(err))
+	assert.Equal(t, 1, pushed)
+}
+
+func TestDeviceAbiSdkEmulator(t *testing.T) {
+	props := map[string]string{
+		"ro.kernel.qemu":         "1",
+		"ro.product.cpu.abi":     "x86",
+		"ro.product.cpu.abilist": "x86_64,x86",
+		"ro.build.version.sdk":   "28",
+	}
+	abi, sdk, err := deviceAbiSdk(props)
+	assert.NoError(t, err)
+	assert.Equal(t, "x86_64", abi)
+	assert.Equal(t, "28", sdk)
+	assert.True(t, strings.HasSuffix(minicapFileURL("minicap", abi, sdk), "/minicap/bin/x86_64/minicap"))
+	assert.True(t, strings.HasSuffix(minicapFileURL("minicap.so", abi, sdk), "/android-28/x86_64/minicap.so"))
+
+	delete(props, "ro.kernel.qemu")
+	abi, _, err = deviceAbiSdk(props)
+	assert.NoError(t, err)
+	assert.Equal(t, "x86", abi, "real devices use ro.product.cpu.abi")
+
+	props = map[string]string{"ro.boot.qemu": "1", "ro.product.cpu.abi": "x86", "ro.build.version.sdk": "23"}
+	abi, _, err = deviceAbiSdk(props)
+	assert.NoError(t, err)
+	assert.Equal(t, "x86", abi)
+
+	_, _, err = deviceAbiSdk(map[string]string{"ro.build.version.sdk": "23"})
+	assert.Error(t, err)
+}
+
+func TestMinicapRestartPolicy(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	m.events = make(chan Event, 10)
+	m.kill = func() error { return nil }
+	launches := 0
+	m.capture = func() error {
+		launches++
+		return errors.New("minicap quit")
+	}
+	m.SetRestartPolicy(RestartPolicy{MaxAttempts: 2, Backoff: 10 * time.Millisecond})
+	m.resetError()
+	m.quitC = make(chan bool, 1)
+	go m.runScreenCaptureWithRotate()
+
+	assert.Error(t, m.Wait())
+	assert.Equal(t, 3, launches)
+	assert.Equal(t, 2, len(m.events))
+	event := <-m.events
+	assert.Equal(t, EventMinicapRestart, event.Type)
+	assert.Error(t, event.Err)
+
+	// never restart by default
+	m.SetRestartPolicy(RestartPolicy{})
+	launches = 0
+	m.resetError()
+	go m.runScreenCaptureWithRotate()
+	assert.Error(t, m.Wait())
+	assert.Equal(t, 1, launches)
+}
+
+func TestDetectedAbiSdk(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	assert.Equal(t, "", m.DetectedABI())
+	m.props = map[string]string{
+		"ro.product.cpu.abi":   "arm64-v8a",
+		"ro.build.version.sdk": "25",
+	}
+	abi, sdk, err := m.detectAbiSdk()
+	assert.NoError(t, err)
+	assert.Equal(t, "arm64-v8a", abi)
+	assert.Equal(t, "25", sdk)
+	assert.Equal(t, "arm64-v8a", m.DetectedABI())
+	assert.Equal(t, "25", m.DetectedSDK())
+}
+
+func TestCheckBinaries(t *testing.T) {
+	files := map[string]bool{"/data/local/tmp/minicap": true}
+	exists := func(path string) bool {
+		return files[path]
+	}
+	err := checkBinaries(exists)
+	assert.Equal(t, ErrBinariesMissing, errors.Cause(err))
+	assert.Contains(t, err.Error(), "minicap.so")
+
+	files["/data/local/tmp/minicap.so"] = true
+	assert.NoError(t, checkBinaries(exists))
+}
+
+func TestSuckerChecksum(t *testing.T) {
+	stream := bytes.NewBuffer(nil)
+	writeMinicapBanner(stream, 720, 1280, 0)
+	writeMinicapFrame(stream, fakeJpeg)
+	writeMinicapFrame(stream, fakeJpeg)
+	data := stream.Bytes()
+
+	s := newJpgTcpSucker(nil)
+	s.readFrames(bytes.NewReader(data))
+	assert.Equal(t, uint32(0), (<-s.FrameC).Checksum)
+
+	s.SetChecksum(true)
+	s.Drain()
+	s.readFrames(bytes.NewReader(data))
+	assert.Equal(t, crc32.ChecksumIEEE(fakeJpeg), (<-s.FrameC).Checksum)
+}
+
+func TestPrepareForwardRetry(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	calls := 0
+	s.forward = func(spec adb.ForwardSpec) (int, error) {
+		calls++
+		if calls == 1 {
+			return 0, errors.New("adb: device busy")
+		}
+		return 7912, nil
+	}
+	port, err := s.prepareForward(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 7912, port)
+	assert.Equal(t, 2, calls)
+
+	// retries wait as reconnects, capped by the max retry delay
+	s.SetRetryDelay(time.Hour)
+	s.SetMaxRetryDelay(20 * time.Millisecond)
+	calls = 0
+	s.forward = func(spec adb.ForwardSpec) (int, error) {
+		calls++
+		if calls < forwardMaxAttempts {
+			return 0, errors.New("adb: device busy")
+		}
+		return 7912, nil
+	}
+	start := time.Now()
+	_, err = s.prepareForward(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, forwardMaxAttempts, calls)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 20*time.Millisecond && elapsed < time.Second, "waited %v", elapsed)
+
+	calls = 0
+	s.forward = func(spec adb.ForwardSpec) (int, error) {
+		calls++
+		return 0, &net.OpError{Op: "listen", Net: "tcp", Err: errors.New("too many open files")}
+	}
+	_, err = s.prepareForward(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls, "no free port should not retry")
+}
+
+func TestSuckerTimestampExtension(t *testing.T) {
+	deviceTime := time.Date(2017, 3, 1, 12, 0, 0, 1000, time.UTC)
+	stream := bytes.NewBuffer(nil)
+	writeMinicapBanner(stream, 720, 1280, 0)
+	binary.Write(stream, binary.LittleEndian, uint32(len(fakeJpeg)))
+	binary.Write(stream, binary.LittleEndian, uint64(deviceTime.UnixNano()/1000))
+	stream.Write(fakeJpeg)
+
+	s := newJpgTcpSucker(nil)
+	s.SetTimestampExtension(true)
+	assert.Equal(t, io.EOF, s.readFrames(stream))
+	frame := <-s.FrameC
+	assert.Equal(t, fakeJpeg, frame.Data)
+	assert.True(t, deviceTime.Equal(frame.Time))
+
+	// standard minicap stream still works without extension
+	stream.Reset()
+	writeMinicapBanner(stream, 720, 1280, 0)
+	writeMinicapFrame(stream, fakeJpeg)
+	s.SetTimestampExtension(false)
+	assert.Equal(t, io.EOF, s.readFrames(stream))
+	frame = <-s.FrameC
+	assert.Equal(t, fakeJpeg, frame.Data)
+	assert.WithinDuration(t, time.Now(), frame.Time, time.Second)
+}
+
+func TestSuckerMaxBufferedBytes(t *testing.T) {
+	bigJpeg := append([]byte("\xff\xd8"), make([]byte, 1000)...)
+	stream := bytes.NewBuffer(nil)
+	writeMinicapBanner(stream, 720, 1280, 0)
+	for i := 0; i < 3; i++ {
+		writeMinicapFrame(stream, bigJpeg)
+	}
+	data := stream.Bytes()
+
+	s := newJpgTcpSucker(nil)
+	s.SetMaxBufferedBytes(2500)
+	s.readFrames(bytes.NewReader(data))
+	assert.Equal(t, 2, len(s.FrameC), "third frame should be dropped by size")
+
+	<-s.FrameC
+	s.readFrames(bytes.NewReader(data))
+	assert.Equal(t, 2, len(s.FrameC))
+
+	s.Drain()
+	s.SetMaxBufferedBytes(500)
+	s.readFrames(bytes.NewReader(data))
+	assert.Equal(t, 1, len(s.FrameC), "a frame over the limit pass when nothing is buffered")
+
+	s.Drain()
+	s.SetMaxBufferedBytes(0)
+	s.readFrames(bytes.NewReader(data))
+	assert.Equal(t, 3, len(s.FrameC))
+}
+
+func TestSetSleepGap(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	s.SetSleepGap(time.Nanosecond)
+	assert.Equal(t, minSleepGap, s.sleepGap)
+	s.SetSleepGap(-time.Second)
+	assert.Equal(t, time.Duration(0), s.sleepGap)
+	s.SetSleepGap(time.Second)
+	assert.Equal(t, time.Second, s.sleepGap)
+
+	s.SetSleepGap(time.Nanosecond)
+	doneC := make(chan bool)
+	close(doneC)
+	assert.False(t, s.watchHostSleep(doneC), "no panic of a zero ticker")
+}
+
+func TestSuckerRetryBackoff(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	s.SetRetryDelay(100 * time.Millisecond)
+	s.SetMaxRetryDelay(time.Second)
+	var delays []time.Duration
+	for failures := 1; failures <= 7; failures++ {
+		delays = append(delays, s.retryBackoff(failures))
+	}
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{0, 100 * ms, 200 * ms, 400 * ms, 800 * ms, time.Second, time.Second}, delays)
+
+	assert.Equal(t, defaultMaxRetryDelay, newJpgTcpSucker(nil).retryBackoff(100), "no overflow")
+}
+
+func TestSuckerImmediateFirstRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	acceptC := make(chan time.Time, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			acceptC <- time.Now()
+			conn.Close() // minicap not ready
+		}
+	}()
+
+	s := newJpgTcpSucker(nil)
+	s.port = ln.Addr().(*net.TCPAddr).Port
+	s.quitC = make(chan bool, 1)
+	s.SetRetryDelay(200 * time.Millisecond)
+	s.resetError()
+	go s.keepReadFromTcp(context.Background())
+	defer func() {
+		s.quitC <- true
+	}()
+
+	var accepts []time.Time
+	for i := 0; i < 3; i++ {
+		select {
+		case tm := <-acceptC:
+			accepts = append(accepts, tm)
+		case <-time.After(time.Second):
+			t.Fatal("no reconnect")
+		}
+	}
+	assert.True(t, accepts[1].Sub(accepts[0]) < 100*time.Millisecond, "first retry should be immediate")
+	assert.True(t, accepts[2].Sub(accepts[1]) >= 200*time.Millisecond, "second retry should wait")
+}
+
+func TestScreencapFallback(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	m.events = make(chan Event, 10)
+	m.kill = func() error { return nil }
+	m.capture = func() error {
+		return errors.New("minicap quit")
+	}
+	m.screencap = func() (image.Image, error) {
+		return image.NewRGBA(image.Rect(0, 0, 72, 128)), nil
+	}
+	degraded := false
+	m.onDegraded = func() { degraded = true }
+	frameC := make(chan Frame, 10)
+	m.frameSink = func(f Frame, recvTime time.Time) {
+		frameC <- f
+	}
+	m.SetRestartPolicy(RestartPolicy{MaxAttempts: 5, Backoff: time.Millisecond})
+	m.SetScreencapFallback(2, 10*time.Millisecond)
+	m.resetError()
+	m.quitC = make(chan bool, 1)
+	go m.runScreenCaptureWithRotate()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case frame := <-frameC:
+			_, err := jpeg.Decode(bytes.NewReader(frame.Data))
+			assert.NoError(t, err)
+			assert.Equal(t, 72, frame.Width)
+		case <-time.After(time.Second):
+			t.Fatal("no frame from screencap fallback")
+		}
+	}
+	m.quitC <- true
+	assert.NoError(t, m.Wait())
+	assert.True(t, degraded)
+	assert.Equal(t, EventMinicapRestart, (<-m.events).Type)
+	assert.Equal(t, EventDegradedMode, (<-m.events).Type)
+}
+
+func TestScreencapFallbackDefaultPolicy(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	m.kill = func() error { return nil }
+	launches := int32(0)
+	m.capture = func() error {
+		atomic.AddInt32(&launches, 1)
+		return errors.New("minicap quit")
+	}
+	m.screencap = func() (image.Image, error) {
+		return image.NewRGBA(image.Rect(0, 0, 72, 128)), nil
+	}
+	frameC := make(chan Frame, 10)
+	m.frameSink = func(f Frame, recvTime time.Time) {
+		frameC <- f
+	}
+	m.SetScreencapFallback(3, 10*time.Millisecond) // RestartPolicy is left as default
+	m.resetError()
+	m.quitC = make(chan bool, 1)
+	go m.runScreenCaptureWithRotate()
+
+	select {
+	case <-frameC:
+	case <-time.After(time.Second):
+		t.Fatal("no frame from screencap fallback")
+	}
+	m.quitC <- true
+	assert.NoError(t, m.Wait())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&launches))
+}
+
+func TestScreencapFallbackStartFailed(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	m.props = map[string]string{
+		"ro.product.cpu.abi":   "arm64-v8a",
+		"ro.build.version.sdk": "25",
+	}
+	m.SetNoPush(true)
+	m.exists = func(path string) bool { return true }
+	m.shell = func(cmd string, args ...string) (string, error) {
+		return "", nil
+	}
+	probes := 0
+	m.probe = func() error {
+		probes++
+		return ErrNoCaptureMethod
+	}
+	m.screencap = func() (image.Image, error) {
+		return image.NewRGBA(image.Rect(0, 0, 72, 128)), nil
+	}
+	frameC := make(chan Frame, 10)
+	m.frameSink = func(f Frame, recvTime time.Time) {
+		frameC <- f
+	}
+	m.events = make(chan Event, 10)
+	m.SetScreencapFallback(2, 10*time.Millisecond)
+	assert.NoError(t, m.Start(), "degraded instead of failing")
+	select {
+	case <-frameC:
+	case <-time.After(time.Second):
+		t.Fatal("no frame from screencap fallback")
+	}
+	assert.NoError(t, m.Stop())
+	assert.Equal(t, 2, probes)
+	assert.Equal(t, EventDegradedMode, (<-m.events).Type)
+}
+
+func TestSuckerBannerTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // accept but send nothing, like a wedged device
+		}
+	}()
+
+	s := newJpgTcpSucker(nil)
+	s.port = ln.Addr().(*net.TCPAddr).Port
+	s.SetBannerTimeout(50 * time.Millisecond)
+	assert.Equal(t, ErrBannerTimeout, s.readFromTcp(context.Background()))
+
+	restartC := make(chan bool, 20)
+	s.onBannerTimeout = func() {
+		restartC <- true
+	}
+	s.resetError()
+	s.quitC = make(chan bool, 1)
+	s.retryDelay = 0
+	go s.keepReadFromTcp(context.Background())
+	select {
+	case <-restartC:
+	case <-time.After(time.Second):
+		t.Fatal("minicap not restarted after banner timeout")
+	}
+	s.quitC <- true
+	assert.NoError(t, s.Wait())
+}
+
+func TestForwardPortRange(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	assert.Error(t, s.SetForwardPortRange(0, 100))
+	assert.Error(t, s.SetForwardPortRange(2000, 1000))
+	assert.Error(t, s.SetForwardPortRange(1000, 70000))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	busy := ln.Addr().(*net.TCPAddr).Port
+	if busy >= 65535-10 {
+		t.Skip("no room for the range")
+	}
+
+	var local adb.ForwardSpec
+	assert.NoError(t, s.SetForwardPortRange(busy, busy+10))
+	s.forwardLocal = func(l, remote adb.ForwardSpec) error {
+		local = l
+		return nil
+	}
+	port, err := s.prepareForward(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, port > busy && port <= busy+10, "port %d not in range", port)
+	assert.Equal(t, strconv.Itoa(port), local.PortOrName)
+
+	assert.NoError(t, s.SetForwardPortRange(busy, busy))
+	_, err = s.prepareForward(context.Background())
+	assert.Error(t, err)
+}
+
+func TestQualityChangeReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var mu sync.Mutex
+	var stopC chan bool
+	m := newMinicapDaemon(nil, nil)
+	m.capture = func() error {
+		mu.Lock()
+		stopC = make(chan bool)
+		myStopC := stopC
+		mu.Unlock()
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		writeMinicapBanner(conn, 720, 1280, 0)
+		for {
+			select {
+			case <-myStopC:
+				return nil
+			case <-time.After(10 * time.Millisecond):
+				if writeMinicapFrame(conn, fakeJpeg) != nil {
+					return nil
+				}
+			}
+		}
+	}
+	m.kill = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopC != nil {
+			close(stopC)
+			stopC = nil
+		}
+		return nil
+	}
+	s := newJpgTcpSucker(nil)
+	s.port = ln.Addr().(*net.TCPAddr).Port
+	s.retryDelay = time.Hour
+	m.onRestart = s.expectRestart
+
+	m.safeDo(_ACTION_START, func() error {
+		m.resetError()
+		m.quitC = make(chan bool, 1)
+		go m.runScreenCaptureWithRotate()
+		return nil
+	})
+	defer m.Stop()
+	s.safeDo(_ACTION_START, func() error {
+		s.resetError()
+		s.quitC = make(chan bool, 1)
+		go s.keepReadFromTcp(context.Background())
+		return nil
+	})
+	defer s.Stop()
+
+	waitFrames := func(n uint64) {
+		deadline := time.Now().Add(2 * time.Second)
+		for s.Stats().Frames < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("frames not resumed, got %d, want %d", s.Stats().Frames, n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFrames(3)
+	// more restarts than the retry limit, none of them should count
+	for i := 0; i < 12; i++ {
+		if i%2 == 0 {
+			m.SetQuality(QUALITY_480P)
+		} else {
+			m.SetQuality(QUALITY_720P)
+		}
+		waitFrames(s.Stats().Frames + 3)
+	}
+	select {
+	case err := <-GoFunc(s.Wait):
+		t.Fatalf("sucker should keep running: %v", err)
+	default:
+	}
+	assert.Equal(t, s.Stats().Frames, s.seq, "seq continue across restarts")
+}
+
+func TestValidateJPEG(t *testing.T) {
+	good := makeJpeg(t, 8, 8, image.White.C)
+	tests := []struct {
+		name   string
+		data   []byte
+		size   uint32
+		reject ValidationLevel // lowest level which reject it, -1 for never
+	}{
+		{"good", good, uint32(len(good)), -1},
+		{"empty", nil, 0, ValidateSOI},
+		{"no soi", []byte("garbage\xff\xd9"), 9, ValidateSOI},
+		{"no eoi", good[:len(good)-2], uint32(len(good) - 2), ValidateSOIAndEOI},
+		{"short read", good, uint32(len(good) + 10), ValidateFull},
+		{"no sof", []byte(fakeJpeg), uint32(len(fakeJpeg)), ValidateFull},
+	}
+	levels := []ValidationLevel{ValidateNone, ValidateSOI, ValidateSOIAndEOI, ValidateFull}
+	for _, tt := range tests {
+		for _, level := range levels {
+			err := validateJPEG(tt.data, tt.size, level)
+			if tt.reject >= 0 && level >= tt.reject {
+				assert.Error(t, err, "%s at level %d", tt.name, level)
+			} else {
+				assert.NoError(t, err, "%s at level %d", tt.name, level)
+			}
+		}
+	}
+}
+
+func TestSuckerSkipInitialFrames(t *testing.T) {
+	stream := bytes.NewBuffer(nil)
+	writeMinicapBanner(stream, 720, 1280, 0)
+	for i := 1; i <= 4; i++ {
+		writeMinicapFrame(stream, []byte("\xff\xd8frame"+strconv.Itoa(i)+"\xff\xd9"))
+	}
+	data := stream.Bytes()
+
+	s := newJpgTcpSucker(nil)
+	s.SetSkipInitialFrames(2)
+	s.readFrames(bytes.NewReader(data))
+	assert.Equal(t, 2, len(s.FrameC))
+	frame := <-s.FrameC
+	assert.Equal(t, "\xff\xd8frame3\xff\xd9", string(frame.Data))
+	assert.Equal(t, uint64(1), frame.Seq)
+
+	s.Drain()
+	s.readFrames(bytes.NewReader(data)) // reconnected after minicap restart
+	assert.Equal(t, "\xff\xd8frame3\xff\xd9", string((<-s.FrameC).Data))
+}
+
+func TestSecureDisplay(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	m.events = make(chan Event, 10)
+	m.setInfo(minicapInfo{Width: 1080, Height: 1920})
+	assert.False(t, m.Info().IsSecureDisplay())
+	m.warnSecureDisplay()
+	assert.Equal(t, 0, len(m.events))
+
+	m.setInfo(minicapInfo{Width: 1080, Height: 1920, Secure: true, Rotation: 90})
+	assert.True(t, m.Info().IsSecureDisplay())
+	assert.Equal(t, 90, m.rotation)
+	m.warnSecureDisplay()
+	assert.Equal(t, EventSecureDisplay, (<-m.events).Type)
+}
+
+func TestRestartDebounce(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	var mu sync.Mutex
+	var stopC chan bool
+	launches, args := 0, ""
+	m.kill = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopC != nil {
+			close(stopC)
+			stopC = nil
+		}
+		return nil
+	}
+	m.capture = func() error {
+		mu.Lock()
+		launches++
+		args = strings.Join(m.buildCaptureArgs(), " ")
+		stopC = make(chan bool)
+		myStopC := stopC
+		mu.Unlock()
+		<-myStopC
+		return nil
+	}
+	m.SetRestartDebounce(100 * time.Millisecond)
+	m.safeDo(_ACTION_START, func() error {
+		m.resetError()
+		m.quitC = make(chan bool, 1)
+		go m.runScreenCaptureWithRotate()
+		return nil
+	})
+	defer m.Stop()
+
+	m.SetRotation(90)
+	m.SetQuality(QUALITY_480P)
+	m.SetRotation(180)
+	m.SetQuality(QUALITY_240P)
+	time.Sleep(300 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, launches, "changes should be collapsed into one restart")
+	assert.Contains(t, args, "@240x240/180", "the final config is applied")
+}
+
+func TestSuckerMaxFPS(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	s.SetMaxFPS(120 * 0.25)
+	now := time.Now()
+	for i := 0; i < 12; i++ { // 120Hz for 100ms
+		s.deliver(Frame{Data: fakeJpeg}, now.Add(time.Duration(i)*time.Second/120))
+	}
+	assert.Equal(t, uint64(3), s.Stats().Frames)
+	assert.Equal(t, uint64(3), s.seq)
+}
+
+func TestCleanupStale(t *testing.T) {
+	psOut := strings.Join([]string{
+		"USER           PID  PPID     VSZ    RSS WCHAN            ADDR S NAME",
+		"shell         4012     1   31488   2936 0                   0 S /data/local/tmp/minicap",
+		"shell         4100     1   31488   2936 0                   0 S minicap",
+		"shell         4200     1   12000   1000 0                   0 S /data/local/tmp/slow-minicap",
+		"u0_a12        5000   600  900000  80000 0                   0 S com.example.minicapviewer",
+	}, "\n")
+	m := newMinicapDaemon(nil, nil)
+	var killed []string
+	m.shell = func(cmd string, args ...string) (string, error) {
+		switch cmd {
+		case "ps":
+			return psOut, nil
+		case "kill":
+			killed = append(killed, args[1])
+		}
+		return "", nil
+	}
+	assert.NoError(t, m.CleanupStale())
+	assert.Equal(t, []string{"4012", "4100", "4200"}, killed)
+
+	m.shell = func(cmd string, args ...string) (string, error) {
+		return "", errors.New("device offline")
+	}
+	assert.Error(t, m.CleanupStale())
+}
+
+func TestPushFilesStaleVersion(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	m.props = map[string]string{
+		"ro.product.cpu.abi":   "arm64-v8a",
+		"ro.build.version.sdk": "25",
+	}
+	m.exists = func(path string) bool { return true }
+	marker := "x86/19" // pushed by an old run for another device
+	m.shell = func(cmd string, args ...string) (string, error) {
+		return marker + "\n", nil
+	}
+	var pushed []string
+	m.push = func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error {
+		pushed = append(pushed, dst)
+		if dst == versionMarker {
+			marker = string(data)
+		}
+		return nil
+	}
+	ctx := context.Background()
+	assert.NoError(t, m.pushFiles(ctx, false))
+	assert.Contains(t, pushed, "/data/local/tmp/minicap")
+	assert.Contains(t, pushed, "/data/local/tmp/minicap.so")
+	assert.Equal(t, "arm64-v8a/25", marker)
+
+	pushed = nil
+	assert.NoError(t, m.pushFiles(ctx, false))
+	assert.NotContains(t, pushed, "/data/local/tmp/minicap", "up to date binaries are kept")
+
+	pushed = nil
+	m.SetForcePush(true)
+	assert.NoError(t, m.pushFiles(ctx, false))
+	assert.Contains(t, pushed, "/data/local/tmp/minicap")
+}
+
+func TestMinicapLaunchFailed(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	err := m.readMinicapOutput(strings.NewReader(""))
+	assert.Equal(t, ErrMinicapLaunchFailed, errors.Cause(err))
+
+	err = m.readMinicapOutput(strings.NewReader("WARNING: linker: minicap has text relocations\n"))
+	assert.Equal(t, ErrMinicapLaunchFailed, errors.Cause(err))
+	assert.Contains(t, err.Error(), "text relocations")
+
+	err = m.readMinicapOutput(strings.NewReader("PID: 9355\nINFO: Using projection 720x1280@720x1280/0\n"))
+	assert.NotEqual(t, ErrMinicapLaunchFailed, errors.Cause(err), "died after launched")
+}
+
+func TestReadBanner(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	writeMinicapBanner(buf, 720, 1280, 1)
+	banner, err := readBanner(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(1), banner.Version)
+	assert.Equal(t, uint32(9355), banner.Pid)
+	assert.Equal(t, uint32(720), banner.VirtualWidth)
+	assert.Equal(t, uint32(1280), banner.RealHeight)
+	assert.Equal(t, uint8(1), banner.Orientation)
+
+	// a longer banner of the same version, extra fields are skipped
+	buf.Reset()
+	writeMinicapBanner(buf, 720, 1280, 0)
+	data := buf.Bytes()
+	data[1] = 28
+	rd := bytes.NewReader(append(data, 0, 0, 0, 0, 0xff))
+	_, err = readBanner(rd)
+	assert.NoError(t, err)
+	next, _ := rd.ReadByte()
+	assert.Equal(t, byte(0xff), next)
+
+	_, err = readBanner(bytes.NewReader([]byte{9, 24}))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported version 9")
+	_, err = readBanner(bytes.NewReader([]byte{1, 10}))
+	assert.Contains(t, err.Error(), "too short")
+}
+
+func TestReconnectState(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	doneC := make(chan bool)
+	defer close(doneC)
+	var healthy int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if atomic.LoadInt32(&healthy) == 0 {
+				conn.Close() // flaky link
+				continue
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				writeMinicapBanner(conn, 100, 200, 0)
+				<-doneC // connected without frames until the test ends
+			}(conn)
+		}
+	}()
+
+	s := newJpgTcpSucker(nil)
+	s.port = ln.Addr().(*net.TCPAddr).Port
+	s.quitC = make(chan bool, 1)
+	s.retryDelay = 30 * time.Millisecond
+	s.resetError()
+	attempt, next := s.ReconnectState()
+	assert.Equal(t, 0, attempt)
+	assert.True(t, next.IsZero())
+
+	go s.keepReadFromTcp(context.Background())
+	last := 0
+	deadline := time.Now().Add(2 * time.Second)
+	for last < 3 && time.Now().Before(deadline) {
+		attempt, next = s.ReconnectState()
+		assert.True(t, attempt >= last, "attempt went back from %d to %d", last, attempt)
+		if attempt > 1 {
+			assert.False(t, next.IsZero())
+		}
+		last = attempt
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.True(t, last >= 3, "attempt %d", last)
+
+	atomic.StoreInt32(&healthy, 1)
+	deadline = time.Now().Add(2 * time.Second)
+	for attempt != 0 && time.Now().Before(deadline) {
+		attempt, next = s.ReconnectState()
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 0, attempt)
+	assert.True(t, next.IsZero())
+	s.quitC <- true
+	assert.NoError(t, s.Wait())
+}
+
+func TestParseMinicapCaps(t *testing.T) {
+	usage := `Usage: /data/local/tmp/minicap [-h] [-n <name>]
+  -d <id>:       Display ID. (0)
+  -n <name>:     Change the name of the abtract unix domain socket. (minicap)
+  -P <value>:    Display projection (<w>x<h>@<w>x<h>/{0|90|180|270}).
+  -Q <value>:    JPEG quality (0-100).
+  -s:            Take a screenshot and output it to stdout. Needs -P.
+  -S:            Skip frames when they cannot be consumed quickly enough.
+  -r <value>:    Frame rate (frames/sec).
+  -h:            Show help.`
+	caps := parseMinicapCaps(usage)
+	for _, flag := range []string{"-d", "-n", "-P", "-Q", "-s", "-S", "-r", "-h"} {
+		assert.True(t, caps.has(flag), flag)
+	}
+	assert.False(t, caps.has("-t"))
+	assert.False(t, caps.has("Usage:"))
+	assert.Equal(t, 0, len(parseMinicapCaps("")))
+}
+
+func TestBuildCaptureArgsCaps(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	m.width, m.height = 1080, 1920
+	m.binaryPath = "/data/local/tmp/minicap"
+	base := "LD_LIBRARY_PATH=/data/local/tmp /data/local/tmp/minicap -P 1080x1920@720x720/0"
+	m.SetJPEGQuality(80)
+
+	for _, c := range []struct {
+		caps minicapCaps
+		mode StreamMode
+		args string
+	}{
+		{nil, SocketMode, base + " -S"},
+		{minicapCaps{"-r": true}, SocketMode, base + " -r 60 -S"},
+		{minicapCaps{"-Q": true}, SocketMode, base + " -Q 80 -S"},
+		{minicapCaps{"-Q": true, "-r": true}, SocketMode, base + " -Q 80 -r 60 -S"},
+		{minicapCaps{"-Q": true, "-r": true}, StdoutMode, base + " -Q 80 -r 60 2>/dev/null"},
+	} {
+		m.caps, m.streamMode = c.caps, c.mode
+		assert.Equal(t, c.args, strings.Join(m.buildCaptureArgs(), " "))
+	}
+
+	m.SetJPEGQuality(0)
+	m.caps, m.streamMode = minicapCaps{"-Q": true}, SocketMode
+	assert.Equal(t, base+" -S", strings.Join(m.buildCaptureArgs(), " "))
+}
+
+func TestDetectCaps(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	m.binaryPath = "/data/local/tmp/minicap"
+	var cmd string
+	m.shell = func(name string, args ...string) (string, error) {
+		cmd = name + " " + strings.Join(args, " ")
+		return "  -r <value>:    Frame rate (frames/sec).\n", nil
+	}
+	assert.True(t, m.detectCaps().has("-r"))
+	assert.Equal(t, "LD_LIBRARY_PATH=/data/local/tmp /data/local/tmp/minicap -h 2>&1", cmd)
+
+	m.shell = func(string, ...string) (string, error) {
+		return "", errors.New("closed")
+	}
+	assert.Equal(t, 0, len(m.detectCaps()))
+}
+
+func TestScreencapMode(t *testing.T) {
+	cap := NewSTFCapturer(nil, WithStreamMode(ScreencapMode))
+	cap.SetScreencapInterval(10 * time.Millisecond)
+	pushed := false
+	cap.minicapDaemon.push = func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error {
+		pushed = true
+		return nil
+	}
+	shots := 0
+	cap.minicapDaemon.screencap = func() (image.Image, error) {
+		shots++
+		img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+		img.Set(1, 1, color.RGBA{1, 2, 3, 255}) // jpeg would blur it
+		img.Set(2, 1, color.RGBA{uint8(shots), 0, 0, 255})
+		return img, nil
+	}
+	assert.NoError(t, cap.Start())
+
+	for i := 1; i <= 2; i++ {
+		select {
+		case frame := <-cap.FrameC:
+			assert.Equal(t, FormatPNG, frame.Format)
+			assert.Equal(t, uint64(i), frame.Seq)
+			assert.Equal(t, 4, frame.Width)
+			img, err := png.Decode(bytes.NewReader(frame.Data))
+			if !assert.NoError(t, err) {
+				break
+			}
+			assert.Equal(t, color.RGBA{1, 2, 3, 255}, color.RGBAModel.Convert(img.At(1, 1)))
+			assert.Equal(t, color.RGBA{uint8(i), 0, 0, 255}, color.RGBAModel.Convert(img.At(2, 1)))
+		case <-time.After(time.Second):
+			t.Fatal("no png frame")
+		}
+	}
+	assert.NoError(t, cap.Stop())
+	assert.False(t, pushed)
+}
+
+func TestBlockingDelivery(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	const total = 200
+	frameData := append(append([]byte{}, fakeJpeg...), make([]byte, 64*1024)...)
+	var written int32
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		writeMinicapBanner(conn, 100, 200, 0)
+		for i := 0; i < total; i++ {
+			if writeMinicapFrame(conn, frameData) != nil {
+				return
+			}
+			atomic.AddInt32(&written, 1)
+		}
+	}()
+
+	s := newJpgTcpSucker(nil)
+	s.forward = func(adb.ForwardSpec) (int, error) {
+		return ln.Addr().(*net.TCPAddr).Port, nil
+	}
+	s.SetBlockingDelivery(2)
+	assert.NoError(t, s.Start())
+
+	// nobody consume, the device side must be blocked long before all frames written
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 2, len(s.FrameC))
+	assert.True(t, atomic.LoadInt32(&written) < total, "written %d frames", atomic.LoadInt32(&written))
+
+	// slow consumer get every frame, the host never hold more than 2
+	for i := 1; i <= total; i++ {
+		assert.True(t, len(s.FrameC) <= 2)
+		select {
+		case frame := <-s.FrameC:
+			if frame.Seq != uint64(i) {
+				t.Fatalf("expect frame %d, got %d", i, frame.Seq)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("frame %d not received", i)
+		}
+	}
+	assert.Equal(t, int32(total), atomic.LoadInt32(&written))
+	s.Stop()
+}
+
+func TestBlockingDeliveryStop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		writeMinicapBanner(conn, 100, 200, 0)
+		for writeMinicapFrame(conn, fakeJpeg) == nil {
+		}
+	}()
+	s := newJpgTcpSucker(nil)
+	s.forward = func(adb.ForwardSpec) (int, error) {
+		return ln.Addr().(*net.TCPAddr).Port, nil
+	}
+	s.SetBlockingDelivery(1)
+	assert.NoError(t, s.Start())
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err = <-GoFunc(s.Stop):
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked by a full C")
+	}
+}
+
+func TestDeviceDisconnected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cap, _ := newDevicelessCapturer(t, ln.Addr().(*net.TCPAddr).Port)
+	cap.SetRestartPolicy(RestartPolicy{MaxAttempts: 10, Backoff: time.Millisecond})
+	transportC := make(chan bool)
+	var launches int32
+	cap.minicapDaemon.capture = func() error {
+		atomic.AddInt32(&launches, 1)
+		<-transportC
+		return &net.OpError{Op: "read", Net: "tcp", Err: net.ErrClosed}
+	}
+	cap.minicapDaemon.kill = func() error { return nil }
+	assert.NoError(t, cap.Start())
+	assert.Nil(t, cap.Err())
+
+	close(transportC) // the owner closed the adb connection
+	ln.Close()
+	select {
+	case err = <-GoFunc(cap.Wait):
+		assert.Equal(t, ErrDeviceDisconnected, errors.Cause(err))
+	case <-time.After(time.Second):
+		t.Fatal("capturer not quit after disconnected")
+	}
+	assert.Equal(t, ErrDeviceDisconnected, cap.Err())
+	assert.Equal(t, EventDeviceDisconnected, (<-cap.Events()).Type)
+	deadline := time.Now().Add(time.Second)
+	for (cap.minicapDaemon.IsStarted() || cap.jpgTcpSucker.IsStarted()) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, cap.jpgTcpSucker.IsStarted())
+	assert.False(t, cap.minicapDaemon.IsStarted())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&launches))
+	attempt, _ := cap.ReconnectState()
+	assert.True(t, attempt < 3, "sucker retried %d times", attempt)
+}
+
+func TestIsDisconnectedError(t *testing.T) {
+	assert.False(t, isDisconnectedError(nil))
+	assert.False(t, isDisconnectedError(errors.New("minicap quit")))
+	assert.False(t, isDisconnectedError(errors.New("minicap: connection refused")), "only typed errors count")
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	assert.True(t, isDisconnectedError(errors.Wrap(refused, "open command")))
+	assert.True(t, isDisconnectedError(&net.OpError{Op: "read", Net: "tcp", Err: net.ErrClosed}))
+	assert.True(t, isDisconnectedError(errors.Wrap(ErrDeviceDisconnected, "read")))
+}
+
+func TestSetCaptureLayer(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	m.width, m.height = 1080, 1920
+	m.binaryPath = "/data/local/tmp/minicap"
+	m.SetCaptureLayer("SurfaceView - com.example/.Main")
+	base := "LD_LIBRARY_PATH=/data/local/tmp /data/local/tmp/minicap -P 1080x1920@720x720/0"
+
+	m.caps = minicapCaps{"-r": true}
+	assert.Equal(t, base+" -r 60 -S", strings.Join(m.buildCaptureArgs(), " "))
+
+	m.caps = parseMinicapCaps("  -L <name>:    Capture the named layer only.\n  -r <value>:    Frame rate (frames/sec).")
+	assert.Equal(t, base+" -r 60 -L 'SurfaceView - com.example/.Main' -S", strings.Join(m.buildCaptureArgs(), " "))
+
+	m.SetCaptureLayer("")
+	assert.Equal(t, base+" -r 60 -S", strings.Join(m.buildCaptureArgs(), " "))
+}
+
+// TestConfigWhileCapturing is meant for go test -race, the setters race with the capture goroutine
+func TestConfigWhileCapturing(t *testing.T) {
+	cap, launches := newDevicelessCapturer(t, 0)
+	m := cap.minicapDaemon
+	assert.NoError(t, cap.Start())
+	defer cap.Stop()
+	doneC := make(chan bool)
+	go func() {
+		defer close(doneC)
+		for i := 0; i < 20; i++ {
+			m.SetCaptureLayer("layer")
+			m.SetRestartDebounce(0)
+			m.SetRestartPolicy(RestartPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+			cap.jpgTcpSucker.SetMaxFPS(30)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	waitLaunches := func(n int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for (len(launches.get()) < n || !launches.isRunning()) && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	for i, r := range []int{90, 180} {
+		waitLaunches(i + 1)
+		m.SetRotation(r) // restart minicap, which build its args again
+	}
+	<-doneC
+	waitLaunches(3)
+	assert.Len(t, launches.get(), 3)
+	assert.InDelta(t, 30, cap.Config().MaxFPS, 0.001)
+}
+
+func TestSuckerSetConn(t *testing.T) {
+	// a recorded minicap stream
+	recorded := bytes.NewBuffer(nil)
+	writeMinicapBanner(recorded, 720, 1280, 1)
+	for i := 0; i < 3; i++ {
+		writeMinicapFrame(recorded, fakeJpeg)
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		io.Copy(server, recorded)
+		server.Close()
+	}()
+	s := newJpgTcpSucker(nil)
+	s.forward = func(adb.ForwardSpec) (int, error) {
+		t.Error("forward should not be used")
+		return 0, errors.New("no forward")
+	}
+	s.SetConn(client)
+	assert.NoError(t, s.Start())
+	for i := 1; i <= 3; i++ {
+		select {
+		case frame := <-s.FrameC:
+			assert.Equal(t, uint64(i), frame.Seq)
+			assert.Equal(t, 90, frame.Rotation)
+			assert.Equal(t, fakeJpeg, frame.Data)
+		case <-time.After(time.Second):
+			t.Fatal("no frame from the pipe")
+		}
+	}
+	select {
+	case err := <-GoFunc(s.Wait):
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("sucker should quit when the stream ended")
+	}
+	s.Stop()
+}
+
+func TestSuckerStartContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go writeMinicapBanner(server, 720, 1280, 0)
+	s := newJpgTcpSucker(nil)
+	s.SetConn(client)
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, s.StartContext(ctx))
+	cancel()
+	select {
+	case err := <-GoFunc(s.Wait):
+		assert.Equal(t, context.Canceled, errors.Cause(err))
+	case <-time.After(time.Second):
+		t.Fatal("sucker should quit when ctx cancelled")
+	}
+	s.Stop()
+}
+
+func TestMinicapPID(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	pid, alive := m.MinicapPID()
+	assert.Equal(t, 0, pid)
+	assert.False(t, alive)
+
+	rd, w := io.Pipe()
+	doneC := make(chan error)
+	go func() {
+		doneC <- m.readMinicapOutput(rd)
+	}()
+	io.WriteString(w, "WARNING: linker: minicap has text relocations\nPID: 9355\nINFO: Using projection 720x1280@720x1280/0\n")
+	deadline := time.Now().Add(time.Second)
+	for !alive && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		pid, alive = m.MinicapPID()
+	}
+	assert.True(t, alive)
+	assert.Equal(t, 9355, pid)
+
+	w.Close() // minicap quit
+	assert.Error(t, <-doneC)
+	pid, alive = m.MinicapPID()
+	assert.Equal(t, 0, pid)
+	assert.False(t, alive)
+}
+
+func TestStartWithRetry(t *testing.T) {
+	cap, _ := newDevicelessCapturer(t, 0)
+	cap.startRetryBackoff = time.Millisecond
+	m := cap.minicapDaemon
+	var starts int32 // probed by Start, read by the forward of the sucker
+	m.probe = func() error {
+		atomic.AddInt32(&starts, 1)
+		m.configMu.Lock()
+		m.binaryPath = "/data/local/tmp/minicap" // a failed attempt may be still launching
+		m.configMu.Unlock()
+		return nil
+	}
+	cap.jpgTcpSucker.forward = func(adb.ForwardSpec) (int, error) {
+		if atomic.LoadInt32(&starts) <= 2 {
+			return 0, &net.OpError{Op: "listen", Net: "tcp", Err: errors.New("adb busy")}
+		}
+		return 0, nil
+	}
+	assert.NoError(t, cap.StartWithRetry(context.Background(), 5))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&starts))
+	assert.True(t, cap.jpgTcpSucker.IsStarted())
+	assert.Equal(t, ErrServiceAlreadyStarted, cap.StartWithRetry(context.Background(), 5))
+	assert.NoError(t, cap.Stop())
+
+	atomic.StoreInt32(&starts, -10)
+	err := cap.StartWithRetry(context.Background(), 3)
+	assert.Error(t, err)
+	assert.Equal(t, int32(-7), atomic.LoadInt32(&starts))
+	assert.False(t, cap.minicapDaemon.IsStarted())
+}
+
+func TestStartWithRetryCancelled(t *testing.T) {
+	cap, _ := newDevicelessCapturer(t, 0)
+	cap.startRetryBackoff = time.Millisecond
+	pushes := int32(0)
+	cap.minicapDaemon.push = func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error {
+		atomic.AddInt32(&pushes, 1)
+		<-ctx.Done() // a slow push is cancelled with the attempt
+		return ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	select {
+	case err := <-GoFunc(func() error { return cap.StartWithRetry(ctx, 5) }):
+		assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	case <-time.After(2 * time.Second):
+		t.Fatal("StartWithRetry not return after ctx done")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pushes))
+	assert.False(t, cap.minicapDaemon.IsStarted())
+}
+
+func TestStartWithRetryFatal(t *testing.T) {
+	cap, _ := newDevicelessCapturer(t, 0)
+	cap.startRetryBackoff = time.Millisecond
+	probes := 0
+	cap.minicapDaemon.probe = func() error {
+		probes++
+		return ErrNoCaptureMethod
+	}
+	err := cap.StartWithRetry(context.Background(), 5)
+	assert.Equal(t, ErrNoCaptureMethod, errors.Cause(err))
+	assert.Equal(t, 4, probes) // tried only by prepareSafe of the first attempt
+}
+
+func TestFrameFormat(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	s.SetPreferredFormat(FormatPNG)
+	buf := bytes.NewBuffer(nil)
+	writeMinicapBanner(buf, 720, 1280, 0)
+	writeMinicapFrame(buf, fakeJpeg)
+	assert.Error(t, s.readFrames(buf)) // EOF after the frame
+	frame := <-s.FrameC
+	assert.Equal(t, FormatJPEG, frame.Format, "png from minicap is not supported yet")
+
+	// the sucker refuse the stream instead of delivering garbage
+	var preferred FrameFormat
+	s.negotiateFormat = func(p FrameFormat, banner minicapBanner) FrameFormat {
+		preferred = p
+		return FormatPNG
+	}
+	buf.Reset()
+	writeMinicapBanner(buf, 720, 1280, 0)
+	writeMinicapFrame(buf, fakeJpeg)
+	err := s.readFrames(buf)
+	assert.Equal(t, ErrUnsupportedFormat, errors.Cause(err))
+	assert.Contains(t, err.Error(), "image/png")
+	assert.Equal(t, FormatPNG, preferred)
+	assert.Equal(t, 0, len(s.FrameC))
+}
+
+func TestStopAbortStart(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	m.props = map[string]string{
+		"ro.product.cpu.abi":   "arm64-v8a",
+		"ro.build.version.sdk": "25",
+	}
+	m.exists = func(path string) bool { return false }
+	m.shell = func(cmd string, args ...string) (string, error) {
+		return "", nil
+	}
+	pushingC := make(chan bool, 1)
+	m.push = func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error {
+		select {
+		case pushingC <- true:
+		default:
+		}
+		<-ctx.Done() // a download which never ends by itself
+		return ctx.Err()
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- m.Start()
+	}()
+	select {
+	case <-pushingC:
+	case <-time.After(time.Second):
+		t.Fatal("push not started")
+	}
+	assert.Equal(t, ErrServiceNotStarted, m.Stop(), "the failed Start left nothing to stop")
+	select {
+	case err := <-errC:
+		assert.Equal(t, context.Canceled, errors.Cause(err))
+	case <-time.After(3 * time.Second):
+		t.Fatal("Start not aborted by Stop")
+	}
+	assert.False(t, m.IsStarted())
+}
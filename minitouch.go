@@ -2,6 +2,7 @@ package stf
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,22 +26,123 @@ const (
 	TOUCH_UP
 )
 
+// MinitouchBanner is the header sent by minitouch after connected
+type MinitouchBanner struct {
+	Version     int
+	MaxContacts int
+	MaxX        int
+	MaxY        int
+	MaxPressure int
+	PID         int
+}
+
+// ScalePressure convert pressure between 0.0 and 1.0 to the range of the device
+func (b MinitouchBanner) ScalePressure(p float64) int {
+	if p < 0 {
+		p = 0
+	}
+	if p > 1 {
+		p = 1
+	}
+	return int(p*float64(b.MaxPressure) + 0.5)
+}
+
 type STFTouch struct {
 	cmdC       chan string
 	conn       net.Conn
+	bannerMu   sync.Mutex // guard maxX, maxY, rotation and banner
 	maxX, maxY int
 	rotation   int
+	banner     MinitouchBanner
+	pressure   float64 // between 0.0 and 1.0, scaled by the banner MaxPressure
+	keepAlive  time.Duration
+	events     chan Event
+	dial       func() error
+	restart    func() // launch minitouch again when it died
+	stopC      chan bool
+	quitC      chan bool // closed when drainCmd returned
+	shell      func(cmd string, args ...string) (string, error)
+	exists     func(path string) bool
+	push       func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error
+
+	healthMu sync.Mutex
+	healthy  bool
+	recMu    sync.Mutex
+	rec      io.Writer // RecordInput writes commands here
+
+	inputDevice string // passed by -d, empty to let minitouch choose
 
+	binarySource
 	*adb.Device
 	errorMixin
 	safeMixin
 }
 
+const (
+	defaultTouchKeepAlive = 5 * time.Second
+	defaultTouchPressure  = 0.5
+)
+
+var (
+	// ErrTouchStopped is returned by touch commands sent after Stop
+	ErrTouchStopped = errors.New("minitouch stopped")
+	// ErrTouchNotRunning is returned by touch commands sent after minitouch could not be reached
+	ErrTouchNotRunning = errors.New("minitouch not running")
+	// ErrTouchNotReady is returned by touch commands sent before the minitouch banner is read
+	ErrTouchNotReady = errors.New("minitouch banner not read yet")
+)
+
 func NewSTFTouch(device *adb.Device) *STFTouch {
-	return &STFTouch{
-		Device: device,
-		cmdC:   make(chan string, 0),
+	s := &STFTouch{
+		Device:    device,
+		cmdC:      make(chan string, 0),
+		keepAlive: defaultTouchKeepAlive,
+		pressure:  defaultTouchPressure,
+		events:    make(chan Event, 10),
 	}
+	s.dial = s.dialWithRetry
+	s.restart = s.relaunch
+	s.shell = s.RunCommand
+	s.exists = func(path string) bool {
+		return AdbFileExists(s.Device, path)
+	}
+	s.push = func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error {
+		if data != nil {
+			return PushFileFromBytes(s.Device, dst, perms, data)
+		}
+		return PushFileFromHTTPContext(ctx, s.Device, dst, perms, url, nil)
+	}
+	return s
+}
+
+// SetKeepAliveInterval set how often an empty commit is written to detect a dead socket, 0 to disable.
+// Must be called before Start
+func (s *STFTouch) SetKeepAliveInterval(d time.Duration) {
+	s.keepAlive = d
+}
+
+// SetPressure set the pressure between 0.0 and 1.0 of Down and Move, it is scaled to the
+// MaxPressure of the banner, so devices reporting no pressure always get 0
+func (s *STFTouch) SetPressure(p float64) {
+	s.pressure = p
+}
+
+// Events return the channel of touch events, events are dropped if not read in time
+func (s *STFTouch) Events() <-chan Event {
+	return s.events
+}
+
+// Healthy return false when the minitouch socket is not connected
+func (s *STFTouch) Healthy() bool {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	return s.healthy
+}
+
+func (s *STFTouch) setHealthy(ok bool) {
+	s.healthMu.Lock()
+	s.healthy = ok
+	s.healthMu.Unlock()
 }
 
 func (s *STFTouch) Start() error {
@@ -48,6 +151,9 @@ func (s *STFTouch) Start() error {
 		if err := s.prepare(); err != nil {
 			return err
 		}
+		s.detectInputDevice()
+		s.stopC = make(chan bool)
+		s.quitC = make(chan bool)
 		go s.runBinary()
 		go func() {
 			time.Sleep(time.Second)
@@ -59,15 +165,46 @@ func (s *STFTouch) Start() error {
 
 func (s *STFTouch) Stop() error {
 	return s.safeDo(_ACTION_STOP, func() error {
+		close(s.stopC)
 		s.killProc("minitouch", syscall.SIGKILL)
+		s.doneNilError()
 		return s.Wait()
 	})
 }
 
+// Banner return the minitouch banner, zero before connected
+func (s *STFTouch) Banner() MinitouchBanner {
+	s.bannerMu.Lock()
+	defer s.bannerMu.Unlock()
+	return s.banner
+}
+
 func (s *STFTouch) SetRotation(r int) {
+	s.bannerMu.Lock()
 	s.rotation = r
+	s.bannerMu.Unlock()
 }
 
+// setBanner set the banner read from minitouch, touch commands are accepted from now on
+func (s *STFTouch) setBanner(b MinitouchBanner) {
+	s.bannerMu.Lock()
+	s.banner = b
+	s.maxX, s.maxY = b.MaxX, b.MaxY
+	s.bannerMu.Unlock()
+}
+
+// bounds return the minitouch width and height of the screen as it is displayed,
+// ErrTouchNotReady before the banner is read
+func (s *STFTouch) bounds() (w, h float64, err error) {
+	s.bannerMu.Lock()
+	defer s.bannerMu.Unlock()
+	if s.maxX == 0 || s.maxY == 0 {
+		return 0, 0, ErrTouchNotReady
+	}
+	return s.width(), s.height(), nil
+}
+
+// width and height are called with bannerMu held
 func (s *STFTouch) width() float64 {
 	if s.rotation == 0 || s.rotation == 180 {
 		return float64(s.maxX)
@@ -140,40 +277,214 @@ func (s *STFTouch) coords(xP, yP float64) (x, y int) {
 	return int(w * xP), int(h * yP)
 }
 
-func (s *STFTouch) Down(index int, xP, yP float64) {
-	posX, posY := s.coords(xP, yP)
-	s.cmdC <- fmt.Sprintf("d %v %v %v 50", index, posX, posY)
+func (s *STFTouch) Down(index int, xP, yP float64) error {
+	cmd, err := s.downCmd(index, xP, yP)
+	if err != nil {
+		return err
+	}
+	return s.send(cmd)
 }
 
-func (s *STFTouch) Move(index int, xP, yP float64) {
+func (s *STFTouch) Move(index int, xP, yP float64) error {
+	cmd, err := s.moveCmd(index, xP, yP)
+	if err != nil {
+		return err
+	}
+	return s.send(cmd)
+}
+
+func (s *STFTouch) Up(index int) error {
+	return s.send(upCmd(index))
+}
+
+// send record a command and pass it to drainCmd, which commit it to minitouch
+func (s *STFTouch) send(cmd string) error {
+	s.recMu.Lock()
+	if s.rec != nil && writeInputEvent(s.rec, time.Now(), cmd) != nil {
+		s.rec = nil
+	}
+	s.recMu.Unlock()
+	return s.deliver(cmd)
+}
+
+// deliver pass cmd to drainCmd, an error is returned once Stop is called or drainCmd quit
+func (s *STFTouch) deliver(cmd string) error {
+	select {
+	case s.cmdC <- cmd:
+		return nil
+	case <-s.stopC:
+		return ErrTouchStopped
+	case <-s.quitC:
+		return ErrTouchNotRunning
+	}
+}
+
+func (s *STFTouch) downCmd(index int, xP, yP float64) (string, error) {
+	return s.contactCmd("d", index, xP, yP)
+}
+
+func (s *STFTouch) moveCmd(index int, xP, yP float64) (string, error) {
+	return s.contactCmd("m", index, xP, yP)
+}
+
+// contactCmd format a d or m command, ErrTouchNotReady is returned before the banner is read
+func (s *STFTouch) contactCmd(op string, index int, xP, yP float64) (string, error) {
+	s.bannerMu.Lock()
+	defer s.bannerMu.Unlock()
+	if s.maxX == 0 || s.maxY == 0 {
+		return "", ErrTouchNotReady
+	}
 	posX, posY := s.coords(xP, yP)
-	s.cmdC <- fmt.Sprintf("m %v %v %v 50", index, posX, posY)
+	return fmt.Sprintf("%s %v %v %v %v", op, index, posX, posY, s.banner.ScalePressure(s.pressure)), nil
+}
+
+func upCmd(index int) string {
+	return fmt.Sprintf("u %d", index)
+}
+
+// Tap touch (xP, yP) and release it. The error is not nil if the commands could not be
+// passed to minitouch, failures of minitouch itself are reported by Events and Wait
+func (s *STFTouch) Tap(xP, yP float64) error {
+	if err := s.Down(0, xP, yP); err != nil {
+		return err
+	}
+	return s.Up(0)
+}
+
+const swipeSteps = 10
+
+// Swipe move one contact from (x1P, y1P) to (x2P, y2P) in dur
+func (s *STFTouch) Swipe(x1P, y1P, x2P, y2P float64, dur time.Duration) error {
+	if err := s.Down(0, x1P, y1P); err != nil {
+		return err
+	}
+	for i := 1; i <= swipeSteps; i++ {
+		time.Sleep(dur / swipeSteps)
+		f := float64(i) / swipeSteps
+		if err := s.Move(0, x1P+(x2P-x1P)*f, y1P+(y2P-y1P)*f); err != nil {
+			return err
+		}
+	}
+	return s.Up(0)
+}
+
+// Text type text with the input command, minitouch only touches
+func (s *STFTouch) Text(text string) error {
+	return inputText(s.shell, text)
+}
+
+// KeyEvent press the key of keycode with the input command
+func (s *STFTouch) KeyEvent(keycode int) error {
+	return inputKeyEvent(s.shell, keycode)
 }
 
-func (s *STFTouch) Up(index int) {
-	s.cmdC <- fmt.Sprintf("u %d", index)
+// MultiTouch collect commands of several contacts, which are sent together on Commit
+type MultiTouch struct {
+	touch *STFTouch
+	cmds  []string
+	err   error // the first error of Down or Move, returned by Commit
+}
+
+// MultiTouch begin a batch of touch commands
+func (s *STFTouch) MultiTouch() *MultiTouch {
+	return &MultiTouch{touch: s}
+}
+
+func (m *MultiTouch) Down(index int, xP, yP float64) *MultiTouch {
+	return m.add(m.touch.downCmd(index, xP, yP))
+}
+
+func (m *MultiTouch) Move(index int, xP, yP float64) *MultiTouch {
+	return m.add(m.touch.moveCmd(index, xP, yP))
+}
+
+func (m *MultiTouch) add(cmd string, err error) *MultiTouch {
+	if err != nil {
+		if m.err == nil {
+			m.err = err
+		}
+		return m
+	}
+	m.cmds = append(m.cmds, cmd)
+	return m
+}
+
+func (m *MultiTouch) Up(index int) *MultiTouch {
+	m.cmds = append(m.cmds, upCmd(index))
+	return m
+}
+
+// Commit send all collected commands followed by one minitouch commit.
+// Nothing is sent if a Down or Move failed, its error is returned
+func (m *MultiTouch) Commit() error {
+	cmds, err := m.cmds, m.err
+	m.cmds, m.err = nil, nil
+	if err != nil {
+		return err
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	return m.touch.send(strings.Join(cmds, "\n"))
+}
+
+const pinchSteps = 10
+
+// Pinch move two contacts placed horizontally around (cx, cy) from fromDist to toDist apart.
+// Coordinates and distances are in minitouch units (0 to MaxX and MaxY of the banner) of the
+// screen as it is currently displayed, which are not always pixels.
+// ErrTouchNotReady is returned before the banner is read
+func (s *STFTouch) Pinch(cx, cy, fromDist, toDist int, dur time.Duration) error {
+	w, h, err := s.bounds()
+	if err != nil {
+		return err
+	}
+	pos := func(dist float64) (x0, x1, y float64) {
+		return (float64(cx) - dist/2) / w, (float64(cx) + dist/2) / w, float64(cy) / h
+	}
+	x0, x1, y := pos(float64(fromDist))
+	mt := s.MultiTouch()
+	if err := mt.Down(0, x0, y).Down(1, x1, y).Commit(); err != nil {
+		return err
+	}
+	for i := 1; i <= pinchSteps; i++ {
+		time.Sleep(dur / pinchSteps)
+		dist := float64(fromDist) + float64(toDist-fromDist)*float64(i)/pinchSteps
+		x0, x1, y = pos(dist)
+		if err := mt.Move(0, x0, y).Move(1, x1, y).Commit(); err != nil {
+			return err
+		}
+	}
+	return mt.Up(0).Up(1).Commit()
 }
 
 func (s *STFTouch) prepare() error {
-	dst := "/data/local/tmp/minitouch"
-	if AdbFileExists(s.Device, dst) {
+	if s.exists("/data/local/tmp/minitouch") {
 		return nil
 	}
 	props, err := s.Properties()
 	if err != nil {
 		return err
 	}
-	abi, ok := props["ro.product.cpu.abi"]
-	if !ok {
-		return errors.New("No ro.product.cpu.abi propery")
+	return s.pushFiles(context.Background(), props)
+}
+
+// pushFiles push minitouch for the device abi and sdk
+func (s *STFTouch) pushFiles(ctx context.Context, props map[string]string) error {
+	abi, sdk, err := deviceAbiSdk(props)
+	if err != nil {
+		return err
 	}
-	urlStr := "https://github.com/openstf/stf/raw/master/vendor/minitouch/" + abi + "/minitouch"
-	return PushFileFromHTTP(s.Device, dst, 0755, urlStr)
+	return provisionBinaries(ctx, s.binarySource, []binaryFile{minitouchBinary(abi, sdk)}, false, s.exists, s.push)
 }
 
+// runBinary run minitouch until it quit, drainCmd launch it again if it died
 func (s *STFTouch) runBinary() (err error) {
-	defer s.doneError(err)
-	c, err := s.OpenCommand("/data/local/tmp/minitouch")
+	args := []string{}
+	if s.inputDevice != "" {
+		args = append(args, "-d", s.inputDevice)
+	}
+	c, err := s.OpenCommand("/data/local/tmp/minitouch", args...)
 	if err != nil {
 		return
 	}
@@ -183,20 +494,74 @@ func (s *STFTouch) runBinary() (err error) {
 	return nil
 }
 
+// relaunch kill minitouch, which may be alive with a broken socket, and run it again
+func (s *STFTouch) relaunch() {
+	s.killProc("minitouch", syscall.SIGKILL)
+	go s.runBinary()
+}
+
+// reconnect dial minitouch again, it is launched again if the dial failed
+func (s *STFTouch) reconnect() error {
+	if err := s.dial(); err == nil {
+		return nil
+	}
+	log.Println("minitouch not reachable, launch it again")
+	s.restart()
+	return s.dial()
+}
+
 func (s *STFTouch) drainCmd() {
-	if err := s.dialWithRetry(); err != nil {
+	if s.quitC != nil {
+		defer close(s.quitC)
+	}
+	if err := s.dial(); err != nil {
 		s.doneError(errors.Wrap(err, "dial minitouch"))
 		return
 	}
-	for c := range s.cmdC {
-		c = strings.TrimSpace(c) + "\nc\n" // c: commit
+	s.setHealthy(true)
+	defer s.setHealthy(false)
+	var tickC <-chan time.Time
+	if s.keepAlive > 0 {
+		ticker := time.NewTicker(s.keepAlive)
+		defer ticker.Stop()
+		tickC = ticker.C
+	}
+	for {
+		var c string
+		select {
+		case cmd, ok := <-s.cmdC:
+			if !ok {
+				return
+			}
+			c = strings.TrimSpace(cmd) + "\nc\n" // c: commit
+		case <-tickC:
+			c = "c\n" // an empty commit, only to check the socket is alive
+		case <-s.stopC:
+			return
+		}
 		_, err := io.WriteString(s.conn, c)
+		if err == nil {
+			continue
+		}
+		s.conn.Close()
+		s.setHealthy(false)
+		select {
+		case <-s.stopC:
+			return // minitouch is killed by Stop
+		default:
+		}
+		emitEvent(s.events, EventTouchDisconnected, "minitouch socket is dead, reconnecting", err)
+		if err = s.reconnect(); err == nil {
+			// the command was lost with the old connection
+			_, err = io.WriteString(s.conn, c)
+		}
 		if err != nil {
 			s.doneError(errors.Wrap(err, "write command to minitouch tcp"))
-			s.conn.Close()
 			s.conn = nil
-			break
+			return
 		}
+		s.setHealthy(true)
+		emitEvent(s.events, EventTouchReconnected, "minitouch reconnected", nil)
 	}
 }
 
@@ -232,7 +597,7 @@ func (s *STFTouch) dialWithRetry() error {
 }
 
 func (s *STFTouch) dialTouch() error {
-	port, err := s.ForwardToFreePort(adb.ForwardSpec{adb.FProtocolAbstract, "minitouch"})
+	port, err := s.ForwardToFreePort(adb.ForwardSpec{Protocol: adb.FProtocolAbstract, PortOrName: "minitouch"})
 	if err != nil {
 		return err
 	}
@@ -240,20 +605,89 @@ func (s *STFTouch) dialTouch() error {
 	if err != nil {
 		return err
 	}
-	lineRd := lineFormatReader{bufrd: bufio.NewReader(s.conn)}
-	var flag string
-	var ver int
-	var maxContacts, maxPressure int
-	var pid int
-	lineRd.Scanf("%s %d", &flag, &ver)
-	lineRd.Scanf("%s %d %d %d %d", &flag, &maxContacts, &s.maxX, &s.maxY, &maxPressure)
-	if err := lineRd.Scanf("%s %d", &flag, &pid); err != nil {
+	banner, err := readMinitouchBanner(bufio.NewReader(s.conn))
+	if err != nil {
 		s.conn.Close()
 		return err
 	}
+	s.setBanner(banner)
 	return nil
 }
 
+// InputDevice return the touchscreen node passed to minitouch by -d,
+// empty if it was not detected and minitouch choose one itself
+func (s *STFTouch) InputDevice() string {
+	return s.inputDevice
+}
+
+// detectInputDevice find the touchscreen node with getevent, minitouch auto-detection is used if failed
+func (s *STFTouch) detectInputDevice() {
+	s.inputDevice = ""
+	out, err := s.shell("getevent", "-pl")
+	if err != nil {
+		log.Println("getevent -pl fail, let minitouch detect the touchscreen, err is", err)
+		return
+	}
+	s.inputDevice = parseTouchDevice(out)
+}
+
+// parseTouchDevice return the node of getevent -pl output reporting multi-touch positions,
+// devices with INPUT_PROP_DIRECT (touchscreens, not touchpads) are preferred
+func parseTouchDevice(out string) string {
+	var candidate, node string
+	var hasX, hasY, direct bool
+	done := func() bool {
+		if node == "" || !hasX || !hasY {
+			return false
+		}
+		if direct {
+			return true
+		}
+		if candidate == "" {
+			candidate = node
+		}
+		return false
+	}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "add device"):
+			if done() {
+				return node
+			}
+			node, hasX, hasY, direct = "", false, false, false
+			if idx := strings.Index(line, ":"); idx != -1 {
+				node = strings.TrimSpace(line[idx+1:])
+			}
+		case strings.Contains(line, "ABS_MT_POSITION_X"):
+			hasX = true
+		case strings.Contains(line, "ABS_MT_POSITION_Y"):
+			hasY = true
+		case strings.Contains(line, "INPUT_PROP_DIRECT"):
+			direct = true
+		}
+	}
+	if done() {
+		return node
+	}
+	return candidate
+}
+
+// readMinitouchBanner parse lines like
+//
+//	v 1
+//	^ 10 1079 1919 2048
+//	$ 12345
+func readMinitouchBanner(bufrd *bufio.Reader) (b MinitouchBanner, err error) {
+	lineRd := lineFormatReader{bufrd: bufrd}
+	lineRd.Scanf("v %d", &b.Version)
+	lineRd.Scanf("^ %d %d %d %d", &b.MaxContacts, &b.MaxX, &b.MaxY, &b.MaxPressure)
+	if err = lineRd.Scanf("$ %d", &b.PID); err != nil {
+		err = errors.Wrap(err, "read minitouch banner")
+	}
+	return
+}
+
 // FIXME(ssx): maybe need to put into go-adb
 func (s *STFTouch) killProc(psName string, sig syscall.Signal) (err error) {
 	out, err := s.RunCommand("ps", "-C", psName)
@@ -1,8 +1,15 @@
 package stf
 
 import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,3 +24,304 @@ func TestTouch(t *testing.T) {
 	err = touch.Wait()
 	assert.NoError(t, err)
 }
+
+func TestReadMinitouchBanner(t *testing.T) {
+	banner, err := readMinitouchBanner(bufio.NewReader(strings.NewReader("v 1\n^ 10 1079 1919 2048\n$ 12345\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, MinitouchBanner{Version: 1, MaxContacts: 10, MaxX: 1079, MaxY: 1919, MaxPressure: 2048, PID: 12345}, banner)
+
+	assert.Equal(t, 1024, banner.ScalePressure(0.5))
+	assert.Equal(t, 2048, banner.ScalePressure(1.5))
+	assert.Equal(t, 0, banner.ScalePressure(-1))
+
+	_, err = readMinitouchBanner(bufio.NewReader(strings.NewReader("v 1\n")))
+	assert.Error(t, err)
+}
+
+func TestPinch(t *testing.T) {
+	touch := &STFTouch{cmdC: make(chan string, 20), maxX: 1000, maxY: 2000, banner: MinitouchBanner{MaxPressure: 100}, pressure: 0.5}
+	assert.NoError(t, touch.Pinch(500, 1000, 200, 400, 0))
+	close(touch.cmdC)
+	var cmds []string
+	for c := range touch.cmdC {
+		cmds = append(cmds, c)
+	}
+	assert.Len(t, cmds, pinchSteps+2)
+	assert.Equal(t, "d 0 400 1000 50\nd 1 600 1000 50", cmds[0])
+	assert.Equal(t, "m 0 390 1000 50\nm 1 610 1000 50", cmds[1])
+	assert.Equal(t, "m 0 300 1000 50\nm 1 700 1000 50", cmds[pinchSteps])
+	assert.Equal(t, "u 0\nu 1", cmds[pinchSteps+1])
+
+	// screen displayed in landscape, pixels are (x, y) of the rotated screen
+	touch = &STFTouch{cmdC: make(chan string, 20), maxX: 1000, maxY: 2000, banner: MinitouchBanner{MaxPressure: 100}, pressure: 0.5, rotation: 90}
+	touch.Pinch(1000, 500, 200, 200, 0)
+	assert.Equal(t, "d 0 500 900 50\nd 1 500 1100 50", <-touch.cmdC)
+}
+
+func TestTouchNotReady(t *testing.T) {
+	touch := &STFTouch{cmdC: make(chan string, 20)}
+	assert.Equal(t, ErrTouchNotReady, touch.Pinch(500, 1000, 200, 400, 0))
+	assert.Equal(t, ErrTouchNotReady, touch.Tap(0.5, 0.5))
+	assert.Equal(t, ErrTouchNotReady, touch.Swipe(0.1, 0.5, 0.6, 0.5, 0))
+	assert.Equal(t, ErrTouchNotReady, touch.MultiTouch().Down(0, 0.5, 0.5).Up(0).Commit())
+	assert.Len(t, touch.cmdC, 0)
+
+	touch.setBanner(MinitouchBanner{MaxX: 1000, MaxY: 2000})
+	assert.NoError(t, touch.Tap(0.5, 0.5))
+	assert.Equal(t, "d 0 500 1000 0", <-touch.cmdC)
+}
+
+func TestTouchPressure(t *testing.T) {
+	touch := &STFTouch{cmdC: make(chan string, 20), maxX: 1000, maxY: 2000, banner: MinitouchBanner{MaxPressure: 2048}, pressure: defaultTouchPressure}
+	assert.NoError(t, touch.Down(0, 0.5, 0.5))
+	assert.NoError(t, touch.Move(0, 0.6, 0.5))
+	assert.Equal(t, "d 0 500 1000 1024", <-touch.cmdC)
+	assert.Equal(t, "m 0 600 1000 1024", <-touch.cmdC)
+
+	touch.SetPressure(1)
+	assert.NoError(t, touch.MultiTouch().Down(1, 0.5, 0.5).Move(0, 0.5, 0.5).Commit())
+	assert.Equal(t, "d 1 500 1000 2048\nm 0 500 1000 2048", <-touch.cmdC)
+
+	// no pressure reported by the device
+	touch.banner.MaxPressure = 0
+	assert.NoError(t, touch.Down(0, 0.5, 0.5))
+	assert.Equal(t, "d 0 500 1000 0", <-touch.cmdC)
+}
+
+func TestTouchKeepAlive(t *testing.T) {
+	touch := &STFTouch{cmdC: make(chan string), keepAlive: 10 * time.Millisecond, events: make(chan Event, 10), maxX: 100, maxY: 100}
+	touch.resetError()
+	linesC := make(chan string, 100)
+	var remotes []net.Conn
+	touch.dial = func() error {
+		local, remote := net.Pipe()
+		touch.conn = local
+		remotes = append(remotes, remote)
+		go func() {
+			scanner := bufio.NewScanner(remote)
+			for scanner.Scan() {
+				linesC <- scanner.Text()
+			}
+		}()
+		return nil
+	}
+	go touch.drainCmd()
+
+	assert.Equal(t, "c", <-linesC) // keepalive
+	assert.True(t, touch.Healthy())
+	remotes[0].Close()
+
+	select {
+	case ev := <-touch.Events():
+		assert.Equal(t, EventTouchDisconnected, ev.Type)
+		assert.Error(t, ev.Err)
+	case <-time.After(time.Second):
+		t.Fatal("dead socket not detected")
+	}
+	assert.Equal(t, EventTouchReconnected, (<-touch.Events()).Type)
+	assert.True(t, touch.Healthy())
+
+	touch.Up(0)
+	line := <-linesC
+	for line == "c" {
+		line = <-linesC
+	}
+	assert.Equal(t, "u 0", line)
+	close(touch.cmdC)
+}
+
+func TestTouchRestart(t *testing.T) {
+	touch := &STFTouch{cmdC: make(chan string), events: make(chan Event, 10), maxX: 100, maxY: 100, banner: MinitouchBanner{MaxPressure: 100}, pressure: 0.5}
+	touch.resetError()
+	linesC := make(chan string, 100)
+	var remotes []net.Conn
+	dead, restarts := false, 0
+	touch.dial = func() error {
+		if dead {
+			return errors.New("connection refused")
+		}
+		local, remote := net.Pipe()
+		touch.conn = local
+		remotes = append(remotes, remote)
+		go func() {
+			scanner := bufio.NewScanner(remote)
+			for scanner.Scan() {
+				linesC <- scanner.Text()
+			}
+		}()
+		return nil
+	}
+	touch.restart = func() {
+		restarts++
+		dead = false
+	}
+	go touch.drainCmd()
+	defer close(touch.cmdC)
+
+	touch.Down(0, 0.5, 0.5)
+	assert.Equal(t, "d 0 50 50 50", <-linesC)
+	assert.Equal(t, "c", <-linesC)
+
+	// minitouch died, the command is written to the relaunched one
+	touch.Up(0)
+	<-linesC
+	<-linesC
+	remotes[0].Close()
+	dead = true
+	touch.Up(0)
+	assert.Equal(t, "u 0", <-linesC)
+	assert.Equal(t, "c", <-linesC)
+	assert.Equal(t, 1, restarts)
+	assert.Len(t, remotes, 2)
+	assert.True(t, touch.Healthy())
+}
+
+func TestTouchReconnectFailed(t *testing.T) {
+	touch := &STFTouch{cmdC: make(chan string), quitC: make(chan bool), events: make(chan Event, 10), maxX: 100, maxY: 100}
+	touch.resetError()
+	remoteC := make(chan net.Conn, 1)
+	dials := 0
+	touch.dial = func() error {
+		dials++
+		if dials > 1 {
+			return errors.New("connection refused")
+		}
+		local, remote := net.Pipe()
+		touch.conn = local
+		remoteC <- remote
+		return nil
+	}
+	touch.restart = func() {}
+	go touch.drainCmd()
+
+	(<-remoteC).Close()
+	assert.NoError(t, touch.Up(0)) // taken by drainCmd, which fail to write it
+	assert.Error(t, touch.Wait())
+	done := make(chan error, 1)
+	go func() {
+		done <- touch.Tap(0.5, 0.5)
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrTouchNotRunning, err)
+	case <-time.After(time.Second):
+		t.Fatal("Tap blocked after minitouch quit")
+	}
+}
+
+func TestTouchPushFiles(t *testing.T) {
+	touch := NewSTFTouch(nil)
+	touch.exists = func(path string) bool { return false }
+	var urls []string
+	touch.push = func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error {
+		assert.Equal(t, "/data/local/tmp/minitouch", dst)
+		urls = append(urls, url)
+		return nil
+	}
+	ctx := context.Background()
+	assert.NoError(t, touch.pushFiles(ctx, map[string]string{"ro.product.cpu.abi": "armeabi-v7a", "ro.build.version.sdk": "23"}))
+	assert.NoError(t, touch.pushFiles(ctx, map[string]string{"ro.product.cpu.abi": "x86", "ro.build.version.sdk": "15"}))
+	assert.Equal(t, []string{
+		minitouchVendorURL + "/minitouch/armeabi-v7a/minitouch",
+		minitouchVendorURL + "/minitouch/x86/minitouch-nopie",
+	}, urls)
+	assert.Error(t, touch.pushFiles(ctx, map[string]string{}))
+}
+
+const sampleGetevent = `add device 1: /dev/input/event0
+  name:     "gpio-keys"
+  events:
+    KEY (0001): KEY_VOLUMEDOWN        KEY_VOLUMEUP          KEY_POWER
+  input props:
+    <none>
+add device 2: /dev/input/event1
+  name:     "hid-touchpad"
+  events:
+    ABS (0003): ABS_MT_SLOT           : value 0, min 0, max 4, fuzz 0, flat 0, resolution 0
+                ABS_MT_POSITION_X     : value 0, min 0, max 2000, fuzz 0, flat 0, resolution 0
+                ABS_MT_POSITION_Y     : value 0, min 0, max 1000, fuzz 0, flat 0, resolution 0
+  input props:
+    INPUT_PROP_POINTER
+add device 3: /dev/input/event3
+  name:     "synaptics_dsx"
+  events:
+    KEY (0001): KEY_WAKEUP            BTN_TOOL_FINGER
+    ABS (0003): ABS_MT_SLOT           : value 0, min 0, max 9, fuzz 0, flat 0, resolution 0
+                ABS_MT_TOUCH_MAJOR    : value 0, min 0, max 255, fuzz 0, flat 0, resolution 0
+                ABS_MT_POSITION_X     : value 0, min 0, max 1079, fuzz 0, flat 0, resolution 0
+                ABS_MT_POSITION_Y     : value 0, min 0, max 1919, fuzz 0, flat 0, resolution 0
+                ABS_MT_TRACKING_ID    : value 0, min 0, max 65535, fuzz 0, flat 0, resolution 0
+  input props:
+    INPUT_PROP_DIRECT
+add device 4: /dev/input/event4
+  name:     "qpnp_pon"
+  events:
+    KEY (0001): KEY_VOLUMEDOWN
+  input props:
+    <none>
+`
+
+func TestParseTouchDevice(t *testing.T) {
+	assert.Equal(t, "/dev/input/event3", parseTouchDevice(sampleGetevent))
+
+	// without a touchscreen, any device reporting multi-touch positions is used
+	noDirect := strings.Replace(sampleGetevent, "INPUT_PROP_DIRECT", "<none>", 1)
+	assert.Equal(t, "/dev/input/event1", parseTouchDevice(noDirect))
+
+	assert.Equal(t, "", parseTouchDevice("add device 1: /dev/input/event0\n  name: \"gpio-keys\"\n"))
+	assert.Equal(t, "", parseTouchDevice("getevent: permission denied"))
+}
+
+func TestDetectInputDevice(t *testing.T) {
+	touch := &STFTouch{}
+	var cmds []string
+	touch.shell = func(cmd string, args ...string) (string, error) {
+		cmds = append(cmds, strings.Join(append([]string{cmd}, args...), " "))
+		return sampleGetevent, nil
+	}
+	touch.detectInputDevice()
+	assert.Equal(t, []string{"getevent -pl"}, cmds)
+	assert.Equal(t, "/dev/input/event3", touch.InputDevice())
+
+	touch.shell = func(cmd string, args ...string) (string, error) {
+		return "", errors.New("device offline")
+	}
+	touch.detectInputDevice()
+	assert.Equal(t, "", touch.InputDevice())
+}
+
+func TestTapSwipe(t *testing.T) {
+	touch := &STFTouch{cmdC: make(chan string, 20), maxX: 1000, maxY: 2000, banner: MinitouchBanner{MaxPressure: 100}, pressure: 0.5}
+	assert.NoError(t, touch.Tap(0.5, 0.25))
+	assert.Equal(t, "d 0 500 500 50", <-touch.cmdC)
+	assert.Equal(t, "u 0", <-touch.cmdC)
+
+	assert.NoError(t, touch.Swipe(0.1, 0.5, 0.6, 0.5, 0))
+	close(touch.cmdC)
+	var cmds []string
+	for c := range touch.cmdC {
+		cmds = append(cmds, c)
+	}
+	assert.Len(t, cmds, swipeSteps+2)
+	assert.Equal(t, "d 0 100 1000 50", cmds[0])
+	assert.Equal(t, "m 0 150 1000 50", cmds[1])
+	assert.Equal(t, "m 0 600 1000 50", cmds[swipeSteps])
+	assert.Equal(t, "u 0", cmds[swipeSteps+1])
+}
+
+func TestTouchAfterStop(t *testing.T) {
+	touch := &STFTouch{cmdC: make(chan string), stopC: make(chan bool), maxX: 1000, maxY: 2000}
+	close(touch.stopC)
+	done := make(chan error, 1)
+	go func() {
+		done <- touch.Tap(0.5, 0.5)
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrTouchStopped, err)
+	case <-time.After(time.Second):
+		t.Fatal("Tap blocked after Stop")
+	}
+	assert.Equal(t, ErrTouchStopped, touch.Swipe(0.1, 0.5, 0.6, 0.5, 0))
+	assert.Equal(t, ErrTouchStopped, touch.MultiTouch().Down(0, 0.5, 0.5).Commit())
+}
@@ -0,0 +1,128 @@
+package stf
+
+import (
+	"io/fs"
+	"path"
+	"time"
+)
+
+// Option configure a STFCapturer created by NewSTFCapturer, nil options are ignored
+type Option func(*STFCapturer)
+
+// WithQuality is the same as SetQuality
+func WithQuality(quality int) Option {
+	return func(s *STFCapturer) {
+		s.minicapDaemon.SetQuality(quality)
+	}
+}
+
+// WithMaxSize is the same as SetMaxSize
+func WithMaxSize(width, height int) Option {
+	return func(s *STFCapturer) {
+		s.minicapDaemon.SetMaxSize(width, height)
+	}
+}
+
+// WithJPEGQuality is the same as SetJPEGQuality
+func WithJPEGQuality(quality int) Option {
+	return func(s *STFCapturer) {
+		s.minicapDaemon.SetJPEGQuality(quality)
+	}
+}
+
+// WithRotation set the rotation minicap start with
+func WithRotation(r int) Option {
+	return func(s *STFCapturer) {
+		s.minicapDaemon.setCurrentRotation(r)
+	}
+}
+
+// WithStreamMode is the same as SetStreamMode
+func WithStreamMode(mode StreamMode) Option {
+	return func(s *STFCapturer) {
+		s.SetStreamMode(mode)
+	}
+}
+
+// WithMaxFPS is the same as SetMaxFPS
+func WithMaxFPS(fps float64) Option {
+	return func(s *STFCapturer) {
+		s.jpgTcpSucker.SetMaxFPS(fps)
+	}
+}
+
+// WithAutoRotate is the same as EnableAutoRotate
+func WithAutoRotate(interval time.Duration) Option {
+	return func(s *STFCapturer) {
+		s.EnableAutoRotate(interval)
+	}
+}
+
+// WithBinaryDir is the same as SetBinaryDir
+func WithBinaryDir(dir string) Option {
+	return func(s *STFCapturer) {
+		s.minicapDaemon.SetBinaryDir(dir)
+	}
+}
+
+// WithBinaryFS is the same as SetBinaryFS
+func WithBinaryFS(fsys fs.FS) Option {
+	return func(s *STFCapturer) {
+		s.minicapDaemon.SetBinaryFS(fsys)
+	}
+}
+
+// WithVendorURL is the same as SetVendorURL
+func WithVendorURL(url string) Option {
+	return func(s *STFCapturer) {
+		s.minicapDaemon.SetVendorURL(url)
+	}
+}
+
+// WithBinaryCache is the same as SetBinaryCache
+func WithBinaryCache(dir string) Option {
+	return func(s *STFCapturer) {
+		s.minicapDaemon.SetBinaryCache(dir)
+	}
+}
+
+// CaptureConfig is a snapshot of the settings a STFCapturer is using
+type CaptureConfig struct {
+	MaxWidth    int `json:"maxWidth"`
+	MaxHeight   int `json:"maxHeight"`
+	JPEGQuality int `json:"jpegQuality"` // 0 means minicap default
+	Rotation    int `json:"rotation"`
+	// RotationLocked is false when the device rotation is followed by EnableAutoRotate or EnableRotationWatcher
+	RotationLocked bool       `json:"rotationLocked"`
+	SocketName     string     `json:"socketName"` // empty before Start
+	Backend        string     `json:"backend"`    // minicap binary on the device, empty before Start
+	StreamMode     StreamMode `json:"streamMode"`
+	MaxFPS         float64    `json:"maxFps"` // host side cap, 0 means no cap
+}
+
+// Config return the settings currently in effect
+func (s *STFCapturer) Config() CaptureConfig {
+	m, sucker := s.minicapDaemon, s.jpgTcpSucker
+	m.configMu.Lock()
+	cfg := CaptureConfig{
+		MaxWidth:       m.maxWidth,
+		MaxHeight:      m.maxHeight,
+		JPEGQuality:    m.jpegQuality,
+		Rotation:       m.rotation,
+		RotationLocked: s.autoRotate <= 0 && s.watcher == nil,
+		SocketName:     sucker.forwardSpec.PortOrName,
+		StreamMode:     m.streamMode,
+	}
+	binaryPath := m.binaryPath
+	m.configMu.Unlock()
+	if binaryPath != "" {
+		cfg.Backend = path.Base(binaryPath)
+	}
+	sucker.fpsMu.Lock()
+	minInterval := sucker.minInterval
+	sucker.fpsMu.Unlock()
+	if minInterval > 0 {
+		cfg.MaxFPS = float64(time.Second) / float64(minInterval)
+	}
+	return cfg
+}
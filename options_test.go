@@ -0,0 +1,46 @@
+package stf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig(t *testing.T) {
+	cap := NewSTFCapturer(nil)
+	assert.Equal(t, CaptureConfig{
+		MaxWidth:       720,
+		MaxHeight:      720,
+		RotationLocked: true,
+	}, cap.Config())
+
+	cap = NewSTFCapturer(nil,
+		WithQuality(QUALITY_1080P),
+		WithJPEGQuality(75),
+		WithRotation(90),
+		nil,
+		WithStreamMode(StdoutMode),
+		WithMaxFPS(10),
+		WithAutoRotate(time.Second))
+	cap.minicapDaemon.binaryPath = "/data/local/tmp/slow-minicap"
+	cfg := cap.Config()
+	assert.Equal(t, 1080, cfg.MaxWidth)
+	assert.Equal(t, 1080, cfg.MaxHeight)
+	assert.Equal(t, 75, cfg.JPEGQuality)
+	assert.Equal(t, 90, cfg.Rotation)
+	assert.False(t, cfg.RotationLocked)
+	assert.Equal(t, StdoutMode, cfg.StreamMode)
+	assert.InDelta(t, 10, cfg.MaxFPS, 0.001)
+	assert.Equal(t, "slow-minicap", cfg.Backend)
+}
+
+func TestConfigSocketName(t *testing.T) {
+	cap, _ := newDevicelessCapturer(t, 0)
+	assert.Equal(t, "", cap.Config().SocketName)
+	assert.NoError(t, cap.Start())
+	defer cap.Stop()
+	cfg := cap.Config()
+	assert.Equal(t, "minicap", cfg.SocketName)
+	assert.Equal(t, "minicap", cfg.Backend)
+}
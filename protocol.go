@@ -0,0 +1,59 @@
+package stf
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+)
+
+// writeBanner write b as the 24 bytes banner of version 1
+func writeBanner(w io.Writer, b minicapBanner) error {
+	return binary.Write(w, binary.LittleEndian, struct {
+		Version, Length                 uint8
+		Pid, RealW, RealH, VirtW, VirtH uint32
+		Orientation, Quirks             uint8
+	}{1, 24, b.Pid, b.RealWidth, b.RealHeight, b.VirtualWidth, b.VirtualHeight, b.Orientation, b.Quirks})
+}
+
+func writeMinicapFrame(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// WriteMinicapProtocol write frames to w in the minicap wire protocol (banner and frames),
+// so a parent process in any language can read them from a pipe like os.Stdout.
+// The banner is the one minicap sent, with the rotation of the first frame.
+// Block until ctx done and ctx.Err() is returned, the capturer stopped or write failed
+func (s *STFCapturer) WriteMinicapProtocol(ctx context.Context, w io.Writer) error {
+	C := s.Subscribe()
+	defer s.Unsubscribe(C)
+	bannerSent := false
+	for {
+		select {
+		case frame, ok := <-C:
+			if !ok {
+				return nil
+			}
+			if !bannerSent {
+				banner, ok := s.jpgTcpSucker.lastBanner()
+				if !ok { // not from minicap, e.g. ScreencapMode, frames are the real size
+					width, height := uint32(frame.Width), uint32(frame.Height)
+					banner = minicapBanner{RealWidth: width, RealHeight: height, VirtualWidth: width, VirtualHeight: height}
+				}
+				banner.Orientation = uint8(frame.Rotation / 90)
+				if err := writeBanner(w, banner); err != nil {
+					return err
+				}
+				bannerSent = true
+			}
+			if err := writeMinicapFrame(w, frame.Data); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package stf
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeMinicapBanner write a banner of a fake minicap, whose display is not scaled
+func writeMinicapBanner(w io.Writer, width, height uint32, orientation uint8) error {
+	return writeBanner(w, minicapBanner{Pid: 9355, RealWidth: width, RealHeight: height,
+		VirtualWidth: width, VirtualHeight: height, Orientation: orientation})
+}
+
+func TestWriteMinicapProtocol(t *testing.T) {
+	cap := newFakeCapturer(t)
+	cap.setBanner(&minicapBanner{Version: 1, Length: 24, Pid: 4321, RealWidth: 1080, RealHeight: 1920,
+		VirtualWidth: 720, VirtualHeight: 1280, Quirks: 2})
+	buf := bytes.NewBuffer(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := GoFunc(func() error {
+		return cap.WriteMinicapProtocol(ctx, buf)
+	})
+	waitSubscribed(t, cap, 1)
+	cap.pub(Frame{Data: fakeJpeg, Width: 720, Height: 1280, Rotation: 90})
+	cap.pub(Frame{Data: []byte("\xff\xd8second\xff\xd9"), Width: 720, Height: 1280, Rotation: 90})
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-errC)
+
+	s := newJpgTcpSucker(nil)
+	s.readFrames(buf)
+	assert.Equal(t, 2, len(s.FrameC))
+	banner, ok := s.lastBanner()
+	assert.True(t, ok)
+	assert.Equal(t, minicapBanner{Version: 1, Length: 24, Pid: 4321, RealWidth: 1080, RealHeight: 1920,
+		VirtualWidth: 720, VirtualHeight: 1280, Orientation: 1, Quirks: 2}, banner)
+	frame := <-s.FrameC
+	assert.Equal(t, fakeJpeg, frame.Data)
+	assert.Equal(t, 90, frame.Rotation)
+	assert.Equal(t, 720, frame.Width)
+	assert.Equal(t, "\xff\xd8second\xff\xd9", string((<-s.FrameC).Data))
+}
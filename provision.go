@@ -0,0 +1,301 @@
+package stf
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type embeddedKey struct {
+	abi, sdk string
+}
+
+type embeddedBinary struct {
+	minicap   []byte
+	minicapSo []byte
+	minitouch []byte
+}
+
+var (
+	embeddedMu       sync.RWMutex
+	embeddedBinaries = make(map[embeddedKey]embeddedBinary)
+)
+
+// RegisterEmbeddedBinary register minicap and minicap.so for devices of abi and sdk,
+// they are pushed instead of downloading. Use it with go:embed to work without network
+func RegisterEmbeddedBinary(abi, sdk string, data []byte, soData []byte) {
+	embeddedMu.Lock()
+	defer embeddedMu.Unlock()
+	bin := embeddedBinaries[embeddedKey{abi, sdk}]
+	bin.minicap, bin.minicapSo = data, soData
+	embeddedBinaries[embeddedKey{abi, sdk}] = bin
+}
+
+// RegisterEmbeddedMinitouch register minitouch for devices of abi, like RegisterEmbeddedBinary
+func RegisterEmbeddedMinitouch(abi string, data []byte) {
+	embeddedMu.Lock()
+	defer embeddedMu.Unlock()
+	bin := embeddedBinaries[embeddedKey{abi, ""}]
+	bin.minitouch = data
+	embeddedBinaries[embeddedKey{abi, ""}] = bin
+}
+
+// embeddedFile return the registered content of minicap, minicap.so or minitouch, nil if not registered
+func embeddedFile(filename, abi, sdk string) []byte {
+	embeddedMu.RLock()
+	defer embeddedMu.RUnlock()
+	if filename == "minitouch" {
+		return embeddedBinaries[embeddedKey{abi, ""}].minitouch
+	}
+	bin, ok := embeddedBinaries[embeddedKey{abi, sdk}]
+	if !ok {
+		return nil
+	}
+	if filename == "minicap.so" {
+		return bin.minicapSo
+	}
+	return bin.minicap
+}
+
+// where binaries are downloaded from when SetVendorURL and $GOSTF_VENDOR_URL are not set
+const (
+	vendorBaseURL        = "https://gohttp.nie.netease.com/openstf/vendor"
+	minitouchVendorURL   = "https://github.com/openstf/stf/raw/master/vendor"
+	slowMinicapVendorURL = "https://gohttp.nie.netease.com/yosemite"
+)
+
+// environment variables used when the vendor url or the binary cache are not set
+const (
+	EnvVendorURL   = "GOSTF_VENDOR_URL"
+	EnvBinaryCache = "GOSTF_BINARY_CACHE"
+)
+
+// ErrChecksumMismatch is returned when a binary does not match the checksum set by SetBinaryChecksum
+var ErrChecksumMismatch = errors.New("binary checksum mismatch")
+
+// binaryFile is one file to put into /data/local/tmp
+type binaryFile struct {
+	name   string // file name on the device
+	path   string // path relative to the vendor url or the local dir
+	perms  os.FileMode
+	data   []byte // embedded content, nil if not embedded
+	vendor string // default base url, vendorBaseURL if empty
+}
+
+// minicapBinaries return minicap and minicap.so for the abi and sdk
+func minicapBinaries(abi, sdk string) []binaryFile {
+	return []binaryFile{
+		{name: "minicap.so", path: "minicap/shared/android-" + sdk + "/" + abi + "/minicap.so", perms: 0644,
+			data: embeddedFile("minicap.so", abi, sdk)},
+		{name: "minicap", path: "minicap/bin/" + abi + "/minicap", perms: 0755,
+			data: embeddedFile("minicap", abi, sdk)},
+	}
+}
+
+// minitouchBinary return minitouch for the abi, devices before android 4.1 need the non-PIE build
+func minitouchBinary(abi, sdk string) binaryFile {
+	filename := "minitouch"
+	if n, err := strconv.Atoi(sdk); err == nil && n < 16 {
+		filename = "minitouch-nopie"
+	}
+	return binaryFile{name: "minitouch", path: "minitouch/" + abi + "/" + filename, perms: 0755,
+		data: embeddedFile("minitouch", abi, sdk), vendor: minitouchVendorURL}
+}
+
+// slowMinicapBinary return slow-minicap, the fallback of minicap for the abi
+func slowMinicapBinary(abi string) binaryFile {
+	return binaryFile{name: "slow-minicap", path: "slow-minicap/" + abi + "/slow-minicap", perms: 0755,
+		vendor: slowMinicapVendorURL}
+}
+
+// allEmbedded tell if all files are embedded, so they are pushed without network
+func allEmbedded(files []binaryFile) bool {
+	for _, f := range files {
+		if f.data == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// binarySource tell where binaries come from when they are not embedded
+type binarySource struct {
+	baseURL   string            // $GOSTF_VENDOR_URL or vendorBaseURL if empty
+	fsys      fs.FS             // read binaries from here instead of downloading
+	cacheDir  string            // $GOSTF_BINARY_CACHE if empty, no cache if both empty
+	checksums map[string]string // file name -> sha256 in hex
+}
+
+// SetBinaryDir read binaries from dir instead of downloading, files are laid out as on the vendor server,
+// e.g. dir/minicap/bin/arm64-v8a/minicap
+func (b *binarySource) SetBinaryDir(dir string) {
+	b.fsys = os.DirFS(dir)
+}
+
+// SetBinaryFS read binaries from fsys instead of downloading, laid out as SetBinaryDir.
+// An embed.FS can be used to work in air-gapped environments, use fs.Sub if the files are in a subdirectory
+func (b *binarySource) SetBinaryFS(fsys fs.FS) {
+	b.fsys = fsys
+}
+
+// SetBinaryChecksum check the sha256 (hex) of the binary named filename before pushing it
+func (b *binarySource) SetBinaryChecksum(filename, sum string) {
+	if b.checksums == nil {
+		b.checksums = make(map[string]string)
+	}
+	b.checksums[filename] = sum
+}
+
+// SetVendorURL download all binaries from a mirror, laid out as SetBinaryDir,
+// e.g. url/minitouch/arm64-v8a/minitouch and url/slow-minicap/arm64-v8a/slow-minicap
+func (b *binarySource) SetVendorURL(url string) {
+	b.baseURL = strings.TrimSuffix(url, "/")
+}
+
+// SetBinaryCache keep downloaded binaries in dir, so they are not downloaded again for other devices.
+// Every vendor url has its own sub directory, where files are laid out as SetBinaryDir.
+// DefaultBinaryCache is a good choice
+func (b *binarySource) SetBinaryCache(dir string) {
+	b.cacheDir = dir
+}
+
+// DefaultBinaryCache return ~/.go-stf/vendor
+func DefaultBinaryCache() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".go-stf", "vendor"), nil
+}
+
+func (b *binarySource) url(f binaryFile) string {
+	return b.vendor(f) + "/" + f.path
+}
+
+// vendor return the base url f is downloaded from
+func (b *binarySource) vendor(f binaryFile) string {
+	base := b.baseURL
+	if base == "" {
+		base = strings.TrimSuffix(os.Getenv(EnvVendorURL), "/")
+	}
+	if base == "" {
+		base = f.vendor
+	}
+	if base == "" {
+		base = vendorBaseURL
+	}
+	return base
+}
+
+func (b *binarySource) cache() string {
+	if b.cacheDir != "" {
+		return b.cacheDir
+	}
+	return os.Getenv(EnvBinaryCache)
+}
+
+// cachePath return where f is cached, files of different vendor urls never share a path
+func (b *binarySource) cachePath(f binaryFile) string {
+	return filepath.Join(b.cache(), checksum([]byte(b.vendor(f)))[:16], filepath.FromSlash(f.path))
+}
+
+// cached return the content of f from the cache, it is downloaded into the cache if missing
+// or not matching sum. The cache is only an optimization, failing to write it is not an error
+func (b *binarySource) cached(ctx context.Context, f binaryFile, url, sum string) ([]byte, error) {
+	path := b.cachePath(f)
+	if data, err := ioutil.ReadFile(path); err == nil && (sum == "" || checksum(data) == sum) {
+		return data, nil
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := download(ctx, buf, url, f.name, nil); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	if sum != "" && checksum(data) != sum {
+		return nil, errors.Wrap(ErrChecksumMismatch, f.name)
+	}
+	writeCache(path, data)
+	return data, nil
+}
+
+// writeCache write data to path through a temporary file in the same directory,
+// so readers and other processes writing the same file never see a partial one
+func writeCache(path string, data []byte) {
+	if os.MkdirAll(filepath.Dir(path), 0755) != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// checksum return the sha256 of data in hex
+func checksum(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// provisionBinaries push files into /data/local/tmp, existing files are kept unless force is true.
+// Files with a checksum or a cache are read into memory, so they are verified before pushing
+func provisionBinaries(ctx context.Context, src binarySource, files []binaryFile, force bool,
+	exists func(path string) bool, push func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error) error {
+	for _, f := range files {
+		dst := "/data/local/tmp/" + f.name
+		if !force && exists(dst) {
+			continue
+		}
+		data, url := f.data, src.url(f)
+		var err error
+		if data == nil && src.fsys != nil {
+			if data, err = fs.ReadFile(src.fsys, f.path); err != nil {
+				return errors.Wrap(err, "read local binary")
+			}
+		}
+		sum, verify := src.checksums[f.name]
+		if data == nil && src.cache() != "" {
+			if data, err = src.cached(ctx, f, url, sum); err != nil {
+				return err
+			}
+		}
+		if verify {
+			if data == nil {
+				buf := bytes.NewBuffer(nil)
+				if err = download(ctx, buf, url, f.name, nil); err != nil {
+					return err
+				}
+				data = buf.Bytes()
+			}
+			if checksum(data) != sum {
+				return errors.Wrap(ErrChecksumMismatch, f.name)
+			}
+		}
+		if err = push(ctx, dst, f.perms, data, url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
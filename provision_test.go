@@ -0,0 +1,211 @@
+package stf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// unregisterEmbedded remove what a test registered, other tests expect to download
+func unregisterEmbedded(abi, sdk string) {
+	embeddedMu.Lock()
+	defer embeddedMu.Unlock()
+	delete(embeddedBinaries, embeddedKey{abi, sdk})
+}
+
+func TestRegisterEmbeddedBinary(t *testing.T) {
+	assert.Nil(t, embeddedFile("minicap", "x86", "19"))
+	defer unregisterEmbedded("x86", "19")
+	RegisterEmbeddedBinary("x86", "19", []byte("fake minicap"), []byte("fake minicap.so"))
+	assert.Equal(t, []byte("fake minicap"), embeddedFile("minicap", "x86", "19"))
+	assert.Equal(t, []byte("fake minicap.so"), embeddedFile("minicap.so", "x86", "19"))
+	assert.Nil(t, embeddedFile("minicap", "x86", "21"))
+}
+
+func TestMinitouchBinary(t *testing.T) {
+	f := minitouchBinary("arm64-v8a", "25")
+	assert.Equal(t, "minitouch", f.name)
+	assert.Equal(t, "minitouch/arm64-v8a/minitouch", f.path)
+	assert.Equal(t, os.FileMode(0755), f.perms)
+
+	f = minitouchBinary("armeabi-v7a", "15")
+	assert.Equal(t, "minitouch", f.name)
+	assert.Equal(t, "minitouch/armeabi-v7a/minitouch-nopie", f.path)
+
+	assert.Nil(t, minitouchBinary("x86", "22").data)
+	defer unregisterEmbedded("x86", "")
+	RegisterEmbeddedMinitouch("x86", []byte("fake minitouch"))
+	assert.Equal(t, []byte("fake minitouch"), minitouchBinary("x86", "22").data)
+	assert.Nil(t, embeddedFile("minicap", "x86", ""), "minicap of the same abi is not registered")
+}
+
+func TestAllEmbedded(t *testing.T) {
+	files := minicapBinaries("x86", "19")
+	assert.False(t, allEmbedded(files))
+	files[1].data = []byte("fake minicap") // minicap.so still need the network
+	assert.False(t, allEmbedded(files))
+	files[0].data = []byte("fake minicap.so")
+	assert.True(t, allEmbedded(files))
+}
+
+type pushedFile struct {
+	perms os.FileMode
+	data  []byte
+	url   string
+}
+
+func TestProvisionBinaries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binaries")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "minitouch", "x86_64"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "minitouch", "x86_64", "minitouch"), []byte("local minitouch"), 0644)
+
+	pushed := make(map[string]pushedFile)
+	push := func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error {
+		pushed[dst] = pushedFile{perms, data, url}
+		return nil
+	}
+	exists := func(path string) bool { return false }
+	files := []binaryFile{minitouchBinary("x86_64", "28")}
+	ctx := context.Background()
+
+	var src binarySource
+	assert.NoError(t, provisionBinaries(ctx, src, files, false, exists, push))
+	assert.Nil(t, pushed["/data/local/tmp/minitouch"].data)
+	assert.Equal(t, minitouchVendorURL+"/minitouch/x86_64/minitouch", pushed["/data/local/tmp/minitouch"].url)
+
+	src.SetBinaryDir(dir)
+	assert.NoError(t, provisionBinaries(ctx, src, files, false, exists, push))
+	assert.Equal(t, []byte("local minitouch"), pushed["/data/local/tmp/minitouch"].data)
+
+	digest := sha256.Sum256([]byte("local minitouch"))
+	src.SetBinaryChecksum("minitouch", hex.EncodeToString(digest[:]))
+	assert.NoError(t, provisionBinaries(ctx, src, files, false, exists, push))
+	src.SetBinaryChecksum("minitouch", "00")
+	err = provisionBinaries(ctx, src, files, false, exists, push)
+	assert.Equal(t, ErrChecksumMismatch, errors.Cause(err))
+
+	// downloaded files are verified too
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("remote minitouch"))
+	}))
+	defer server.Close()
+	src = binarySource{baseURL: server.URL}
+	digest = sha256.Sum256([]byte("remote minitouch"))
+	src.SetBinaryChecksum("minitouch", hex.EncodeToString(digest[:]))
+	assert.NoError(t, provisionBinaries(ctx, src, files, false, exists, push))
+	assert.Equal(t, []byte("remote minitouch"), pushed["/data/local/tmp/minitouch"].data)
+
+	delete(pushed, "/data/local/tmp/minitouch")
+	exists = func(path string) bool { return true }
+	assert.NoError(t, provisionBinaries(ctx, src, files, false, exists, push))
+	assert.NotContains(t, pushed, "/data/local/tmp/minitouch", "existing files are kept")
+}
+
+func TestProvisionBinariesFromFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"minicap/bin/arm64-v8a/minicap":                    {Data: []byte("fs minicap")},
+		"minicap/shared/android-25/arm64-v8a/minicap.so":   {Data: []byte("fs minicap.so")},
+		"minicap/shared/android-24/arm64-v8a/minicap.so.x": {Data: []byte("other")},
+	}
+	pushed := make(map[string][]byte)
+	push := func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error {
+		pushed[dst] = data
+		return nil
+	}
+	exists := func(path string) bool { return false }
+
+	var src binarySource
+	src.SetBinaryFS(fsys)
+	assert.NoError(t, provisionBinaries(context.Background(), src, minicapBinaries("arm64-v8a", "25"), false, exists, push))
+	assert.Equal(t, []byte("fs minicap"), pushed["/data/local/tmp/minicap"])
+	assert.Equal(t, []byte("fs minicap.so"), pushed["/data/local/tmp/minicap.so"])
+
+	err := provisionBinaries(context.Background(), src, minicapBinaries("arm64-v8a", "24"), false, exists, push)
+	assert.Error(t, err, "missing files are not downloaded")
+}
+
+func TestProvisionBinariesCache(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/mirror/minitouch/mips/minitouch", r.URL.Path)
+		w.Write([]byte("remote minitouch"))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "go-stf-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pushed := make(map[string][]byte)
+	push := func(ctx context.Context, dst string, perms os.FileMode, data []byte, url string) error {
+		pushed[dst] = data
+		return nil
+	}
+	exists := func(path string) bool { return false }
+	files := []binaryFile{minitouchBinary("mips", "28")}
+	ctx := context.Background()
+
+	var src binarySource
+	src.SetVendorURL(server.URL + "/mirror/")
+	src.SetBinaryCache(dir)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, provisionBinaries(ctx, src, files, false, exists, push))
+		assert.Equal(t, []byte("remote minitouch"), pushed["/data/local/tmp/minitouch"])
+	}
+	assert.Equal(t, 1, requests, "the second device use the cache")
+	path := src.cachePath(files[0])
+	assert.Equal(t, dir, filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(path)))))
+	cached, _ := ioutil.ReadFile(path)
+	assert.Equal(t, []byte("remote minitouch"), cached)
+	tmps, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.tmp"))
+	assert.Empty(t, tmps)
+
+	// another mirror may serve other builds, it has its own cache
+	other := src
+	other.SetVendorURL(server.URL + "/other")
+	assert.NotEqual(t, path, other.cachePath(files[0]))
+
+	// a corrupted cache is downloaded again
+	ioutil.WriteFile(path, []byte("broken"), 0644)
+	src.SetBinaryChecksum("minitouch", checksum([]byte("remote minitouch")))
+	assert.NoError(t, provisionBinaries(ctx, src, files, false, exists, push))
+	assert.Equal(t, []byte("remote minitouch"), pushed["/data/local/tmp/minitouch"])
+	assert.Equal(t, 2, requests)
+
+	src.SetBinaryChecksum("minitouch", "00")
+	os.Remove(path)
+	err = provisionBinaries(ctx, src, files, false, exists, push)
+	assert.Equal(t, ErrChecksumMismatch, errors.Cause(err))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "mismatched downloads are not cached")
+}
+
+func TestVendorURLFromEnv(t *testing.T) {
+	f := minitouchBinary("mips", "28")
+	slow := slowMinicapBinary("mips")
+	var src binarySource
+	assert.Equal(t, "https://github.com/openstf/stf/raw/master/vendor/minitouch/mips/minitouch", src.url(f))
+	assert.Equal(t, slowMinicapVendorURL+"/slow-minicap/mips/slow-minicap", src.url(slow))
+	assert.Equal(t, vendorBaseURL+"/minicap/bin/mips/minicap", src.url(minicapBinaries("mips", "28")[1]))
+
+	os.Setenv(EnvVendorURL, "http://mirror.local/vendor/")
+	defer os.Unsetenv(EnvVendorURL)
+	assert.Equal(t, "http://mirror.local/vendor/minitouch/mips/minitouch", src.url(f))
+	assert.Equal(t, "http://mirror.local/vendor/slow-minicap/mips/slow-minicap", src.url(slow))
+	src.SetVendorURL("http://other.local")
+	assert.Equal(t, "http://other.local/minitouch/mips/minitouch", src.url(f))
+}
@@ -0,0 +1,260 @@
+package stf
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// recording format, all numbers are little endian
+//
+//	header: "STFR" version(uint8)
+//	banner: width(uint32) height(uint32) orientation(uint16), written with the first frame
+//	frame:  seq(uint64) time(int64 unix nano) rotation(uint16) format(uint8) width(uint32) height(uint32) size(uint32) data
+const (
+	recordMagic   = "STFR"
+	recordVersion = 2
+)
+
+// ErrBadRecording is returned by ReplayRaw or ReplayInput when the data is not written by RecordRaw or RecordInput
+var ErrBadRecording = errors.New("not a stf raw recording")
+
+// RecordBanner describe the screen of a RecordRaw recording when it started
+type RecordBanner struct {
+	Width       int // real width of the display in pixels
+	Height      int // real height of the display in pixels
+	Orientation int // rotation of the first frame, 0, 90, 180, 270
+}
+
+type recordBanner struct {
+	Width       uint32
+	Height      uint32
+	Orientation uint16
+}
+
+type recordHeader struct {
+	Seq      uint64
+	Time     int64
+	Rotation uint16
+	Format   uint8
+	Width    uint32
+	Height   uint32
+	Size     uint32
+}
+
+// RecordRaw write every frame into w until stop called, the recording can be replayed by ReplayRaw.
+// Recording stop silently when writing to w failed
+func (s *STFCapturer) RecordRaw(w io.Writer) (stop func(), err error) {
+	if _, err = io.WriteString(w, recordMagic); err != nil {
+		return nil, err
+	}
+	if err = binary.Write(w, binary.LittleEndian, uint8(recordVersion)); err != nil {
+		return nil, err
+	}
+	C := s.Subscribe()
+	doneC := make(chan bool)
+	go func() {
+		defer close(doneC)
+		bannerWritten := false
+		for frame := range C {
+			if !bannerWritten {
+				if binary.Write(w, binary.LittleEndian, s.recordBanner(frame)) != nil {
+					s.Unsubscribe(C)
+					return
+				}
+				bannerWritten = true
+			}
+			if writeRecordFrame(w, frame) != nil {
+				s.Unsubscribe(C)
+				return
+			}
+		}
+	}()
+	return func() {
+		s.Unsubscribe(C)
+		<-doneC
+	}, nil
+}
+
+// recordBanner take the display size from the minicap banner, frames are the real size without minicap
+func (s *STFCapturer) recordBanner(frame Frame) recordBanner {
+	width, height := uint32(frame.Width), uint32(frame.Height)
+	if banner, ok := s.jpgTcpSucker.lastBanner(); ok {
+		width, height = banner.RealWidth, banner.RealHeight
+	}
+	return recordBanner{Width: width, Height: height, Orientation: uint16(frame.Rotation)}
+}
+
+func writeRecordFrame(w io.Writer, f Frame) error {
+	header := recordHeader{
+		Seq:      f.Seq,
+		Time:     f.Time.UnixNano(),
+		Rotation: uint16(f.Rotation),
+		Format:   uint8(f.Format),
+		Width:    uint32(f.Width),
+		Height:   uint32(f.Height),
+		Size:     uint32(len(f.Data)),
+	}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	_, err := w.Write(f.Data)
+	return err
+}
+
+// ReplayRaw read a recording of RecordRaw and send the frames with the recorded interval.
+// The channel is closed at the end of the recording, when a frame is broken or when ctx done.
+// r is closed then if it is an io.Closer, e.g. the recording file
+func ReplayRaw(ctx context.Context, r io.Reader) (<-chan Frame, RecordBanner, error) {
+	closeReader := func() {
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	rd := bufio.NewReader(r)
+	magic := make([]byte, len(recordMagic)+1)
+	if _, err := io.ReadFull(rd, magic); err != nil {
+		closeReader()
+		return nil, RecordBanner{}, err
+	}
+	if string(magic[:len(recordMagic)]) != recordMagic || magic[len(recordMagic)] != recordVersion {
+		closeReader()
+		return nil, RecordBanner{}, ErrBadRecording
+	}
+	C := make(chan Frame)
+	var rb recordBanner
+	if err := binary.Read(rd, binary.LittleEndian, &rb); err != nil {
+		closeReader()
+		if err != io.EOF {
+			return nil, RecordBanner{}, err
+		}
+		close(C) // no frame recorded
+		return C, RecordBanner{}, nil
+	}
+	banner := RecordBanner{Width: int(rb.Width), Height: int(rb.Height), Orientation: int(rb.Orientation)}
+	go func() {
+		defer close(C)
+		defer closeReader()
+		var last time.Time
+		for {
+			var header recordHeader
+			if err := binary.Read(rd, binary.LittleEndian, &header); err != nil {
+				return
+			}
+			data := make([]byte, header.Size)
+			if _, err := io.ReadFull(rd, data); err != nil {
+				return
+			}
+			frame := Frame{
+				Data:     data,
+				Seq:      header.Seq,
+				Time:     time.Unix(0, header.Time),
+				Rotation: int(header.Rotation),
+				Format:   FrameFormat(header.Format),
+				Width:    int(header.Width),
+				Height:   int(header.Height),
+			}
+			if !last.IsZero() {
+				select {
+				case <-time.After(frame.Time.Sub(last)):
+				case <-ctx.Done():
+					return
+				}
+			}
+			last = frame.Time
+			select {
+			case C <- frame:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return C, banner, nil
+}
+
+// input recording format, all numbers are little endian
+//
+//	header: "STFI" version(uint8)
+//	event:  time(int64 unix nano) size(uint16) minitouch commands, which are committed together
+//
+// Times are taken from the same clock as frames of RecordRaw, so both recordings can be aligned
+const (
+	inputRecordMagic   = "STFI"
+	inputRecordVersion = 1
+)
+
+// RecordInput write every command sent to minitouch into w until stop called,
+// the recording can be replayed by ReplayInput. Recording stop silently when writing to w failed
+func (s *STFTouch) RecordInput(w io.Writer) (stop func(), err error) {
+	if _, err = io.WriteString(w, inputRecordMagic); err != nil {
+		return nil, err
+	}
+	if err = binary.Write(w, binary.LittleEndian, uint8(inputRecordVersion)); err != nil {
+		return nil, err
+	}
+	s.recMu.Lock()
+	s.rec = w
+	s.recMu.Unlock()
+	return func() {
+		s.recMu.Lock()
+		if s.rec == w {
+			s.rec = nil
+		}
+		s.recMu.Unlock()
+	}, nil
+}
+
+func writeInputEvent(w io.Writer, t time.Time, cmd string) error {
+	if err := binary.Write(w, binary.LittleEndian, t.UnixNano()); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(cmd))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, cmd)
+	return err
+}
+
+// ReplayInput send the commands of a RecordInput recording to minitouch with the recorded interval
+// divided by speed, speed 2 replay twice as fast. Return at the end of the recording
+func (s *STFTouch) ReplayInput(r io.Reader, speed float64) error {
+	if speed <= 0 {
+		speed = 1
+	}
+	rd := bufio.NewReader(r)
+	magic := make([]byte, len(inputRecordMagic)+1)
+	if _, err := io.ReadFull(rd, magic); err != nil {
+		return err
+	}
+	if string(magic[:len(inputRecordMagic)]) != inputRecordMagic || magic[len(inputRecordMagic)] != inputRecordVersion {
+		return ErrBadRecording
+	}
+	var last int64
+	for {
+		var t int64
+		if err := binary.Read(rd, binary.LittleEndian, &t); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var size uint16
+		if err := binary.Read(rd, binary.LittleEndian, &size); err != nil {
+			return err
+		}
+		cmd := make([]byte, size)
+		if _, err := io.ReadFull(rd, cmd); err != nil {
+			return err
+		}
+		if last != 0 {
+			time.Sleep(time.Duration(float64(t-last) / speed))
+		}
+		last = t
+		if err := s.deliver(string(cmd)); err != nil {
+			return err
+		}
+	}
+}
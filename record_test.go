@@ -0,0 +1,148 @@
+package stf
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordReplayRaw(t *testing.T) {
+	cap := newFakeCapturer(t)
+	buf := bytes.NewBuffer(nil)
+	stop, err := cap.RecordRaw(buf)
+	assert.NoError(t, err)
+	start := time.Now()
+	frames := []Frame{
+		{Data: fakeJpeg, Seq: 1, Time: start, Rotation: 90, Width: 720, Height: 1280},
+		{Data: []byte("\xff\xd8second\xff\xd9"), Seq: 2, Time: start.Add(50 * time.Millisecond), Rotation: 90, Width: 720, Height: 1280},
+		{Data: []byte("\x89PNG"), Seq: 3, Time: start.Add(60 * time.Millisecond), Rotation: 90, Width: 720, Height: 1280, Format: FormatPNG},
+	}
+	for _, f := range frames {
+		cap.pub(f)
+	}
+	stop()
+
+	C, banner, err := ReplayRaw(context.Background(), bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, RecordBanner{Width: 720, Height: 1280, Orientation: 90}, banner)
+	replayStart := time.Now()
+	var replayed []Frame
+	for f := range C {
+		replayed = append(replayed, f)
+	}
+	assert.True(t, time.Since(replayStart) >= 50*time.Millisecond, "keep the recorded cadence")
+	assert.Equal(t, len(frames), len(replayed))
+	for i := range frames {
+		assert.Equal(t, frames[i].Data, replayed[i].Data)
+		assert.Equal(t, frames[i].Seq, replayed[i].Seq)
+		assert.True(t, frames[i].Time.Equal(replayed[i].Time))
+		assert.Equal(t, frames[i].Rotation, replayed[i].Rotation)
+		assert.Equal(t, frames[i].Width, replayed[i].Width)
+		assert.Equal(t, frames[i].Format, replayed[i].Format)
+	}
+
+	_, _, err = ReplayRaw(context.Background(), strings.NewReader("GIF89a"))
+	assert.Equal(t, ErrBadRecording, err)
+
+	// nothing recorded
+	C, _, err = ReplayRaw(context.Background(), strings.NewReader(recordMagic+"\x02"))
+	assert.NoError(t, err)
+	_, ok := <-C
+	assert.False(t, ok)
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed chan bool
+}
+
+func (c *closeRecorder) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestReplayRawCancel(t *testing.T) {
+	cap := newFakeCapturer(t)
+	buf := bytes.NewBuffer(nil)
+	stop, err := cap.RecordRaw(buf)
+	assert.NoError(t, err)
+	start := time.Now()
+	cap.pub(Frame{Data: fakeJpeg, Seq: 1, Time: start, Width: 720, Height: 1280})
+	cap.pub(Frame{Data: fakeJpeg, Seq: 2, Time: start.Add(time.Hour), Width: 720, Height: 1280})
+	stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &closeRecorder{Reader: bytes.NewReader(buf.Bytes()), closed: make(chan bool)}
+	C, _, err := ReplayRaw(ctx, r)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), (<-C).Seq)
+	cancel() // while waiting an hour for the second frame
+	select {
+	case <-r.closed:
+	case <-time.After(time.Second):
+		t.Fatal("recording not closed after ctx cancelled")
+	}
+	_, ok := <-C
+	assert.False(t, ok)
+
+	// nobody read the frames
+	ctx, cancel = context.WithCancel(context.Background())
+	r = &closeRecorder{Reader: bytes.NewReader(buf.Bytes()), closed: make(chan bool)}
+	_, _, err = ReplayRaw(ctx, r)
+	assert.NoError(t, err)
+	cancel()
+	select {
+	case <-r.closed:
+	case <-time.After(time.Second):
+		t.Fatal("recording not closed after ctx cancelled")
+	}
+}
+
+func TestRecordReplayInput(t *testing.T) {
+	touch := &STFTouch{cmdC: make(chan string, 20), maxX: 1000, maxY: 2000, banner: MinitouchBanner{MaxPressure: 100}, pressure: 0.5}
+	buf := bytes.NewBuffer(nil)
+	stop, err := touch.RecordInput(buf)
+	assert.NoError(t, err)
+	touch.Down(0, 0.5, 0.5) // tap
+	touch.Up(0)
+	time.Sleep(50 * time.Millisecond)
+	touch.Down(0, 0.1, 0.5) // swipe
+	touch.MultiTouch().Move(0, 0.5, 0.5).Up(0).Commit()
+	stop()
+	touch.Down(0, 0, 0) // not recorded
+	close(touch.cmdC)
+	var sent []string
+	for cmd := range touch.cmdC {
+		sent = append(sent, cmd)
+	}
+	sent = sent[:len(sent)-1]
+
+	replay := func(speed float64) ([]string, time.Duration) {
+		touch := &STFTouch{cmdC: make(chan string, 20)}
+		start := time.Now()
+		assert.NoError(t, touch.ReplayInput(bytes.NewReader(buf.Bytes()), speed))
+		elapsed := time.Since(start)
+		close(touch.cmdC)
+		var cmds []string
+		for cmd := range touch.cmdC {
+			cmds = append(cmds, cmd)
+		}
+		return cmds, elapsed
+	}
+	cmds, elapsed := replay(1)
+	assert.Equal(t, []string{"d 0 500 1000 50", "u 0", "d 0 100 1000 50", "m 0 500 1000 50\nu 0"}, cmds)
+	assert.Equal(t, sent, cmds)
+	assert.True(t, elapsed >= 50*time.Millisecond, "keep the recorded timing")
+
+	cmds, elapsed = replay(10)
+	assert.Equal(t, sent, cmds)
+	assert.True(t, elapsed < 40*time.Millisecond, "speed up by 10, took %v", elapsed)
+
+	touch = &STFTouch{cmdC: make(chan string)}
+	assert.Equal(t, ErrBadRecording, touch.ReplayInput(strings.NewReader("STFR\x01"), 1))
+}
@@ -0,0 +1,110 @@
+package stf
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// tcpRelay accept connections on a chosen address and relay them to target.
+// adb forward always listen on localhost, the relay make the stream reachable from other interfaces
+type tcpRelay struct {
+	ln     net.Listener
+	target string
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	wg     sync.WaitGroup
+}
+
+func newTcpRelay(bindAddr, target string) (*tcpRelay, error) {
+	ln, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	r := &tcpRelay{
+		ln:     ln,
+		target: target,
+		conns:  make(map[net.Conn]bool),
+	}
+	r.wg.Add(1)
+	go r.serve()
+	return r, nil
+}
+
+// Addr return the address the relay listen on
+func (r *tcpRelay) Addr() net.Addr {
+	return r.ln.Addr()
+}
+
+func (r *tcpRelay) serve() {
+	defer r.wg.Done()
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.pipe(conn)
+		}()
+	}
+}
+
+func (r *tcpRelay) pipe(conn net.Conn) {
+	defer conn.Close()
+	upstream, err := net.Dial("tcp", r.target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	if !r.track(conn, upstream) {
+		return
+	}
+	defer r.untrack(conn, upstream)
+
+	doneC := make(chan bool, 2)
+	copyClose := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		dst.Close()
+		doneC <- true
+	}
+	go copyClose(upstream, conn)
+	go copyClose(conn, upstream)
+	<-doneC
+	<-doneC
+}
+
+// track remember the connections so Close can cut them, return false if relay already closed
+func (r *tcpRelay) track(conns ...net.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns == nil {
+		return false
+	}
+	for _, c := range conns {
+		r.conns[c] = true
+	}
+	return true
+}
+
+func (r *tcpRelay) untrack(conns ...net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range conns {
+		delete(r.conns, c)
+	}
+}
+
+// Close stop listening and close all relayed connections
+func (r *tcpRelay) Close() error {
+	err := r.ln.Close()
+	r.mu.Lock()
+	for c := range r.conns {
+		c.Close()
+	}
+	r.conns = nil
+	r.mu.Unlock()
+	r.wg.Wait()
+	return err
+}
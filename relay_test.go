@@ -0,0 +1,98 @@
+package stf
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	adb "github.com/openatx/go-adb"
+	"github.com/stretchr/testify/assert"
+)
+
+// externalIP return a non loopback ipv4 address of the host, or loopback if none
+func externalIP() string {
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+	}
+	return "127.0.0.1"
+}
+
+func helloServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "hello")
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+func TestTcpRelay(t *testing.T) {
+	ln := helloServer(t)
+	defer ln.Close()
+
+	ip := externalIP()
+	r, err := newTcpRelay(ip+":0", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ip, r.Addr().(*net.TCPAddr).IP.String())
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", r.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(conn)
+		conn.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+	}
+
+	assert.NoError(t, r.Close())
+	_, err = net.DialTimeout("tcp", r.Addr().String(), time.Second)
+	assert.Error(t, err)
+}
+
+func TestSuckerBindAddress(t *testing.T) {
+	ln := helloServer(t)
+	defer ln.Close()
+
+	s := newJpgTcpSucker(nil)
+	assert.Equal(t, "", s.RelayAddr())
+	s.forward = func(adb.ForwardSpec) (int, error) {
+		return ln.Addr().(*net.TCPAddr).Port, nil
+	}
+	ip := externalIP()
+	s.SetBindAddress(ip + ":0")
+	assert.NoError(t, s.Start())
+	addr := s.RelayAddr()
+	host, port, err := net.SplitHostPort(addr)
+	assert.NoError(t, err)
+	assert.Equal(t, ip, host)
+	assert.NotEqual(t, strconv.Itoa(s.port), port)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	assert.Equal(t, "hello", string(data))
+
+	s.Stop()
+	assert.Equal(t, "", s.RelayAddr())
+}
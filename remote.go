@@ -0,0 +1,127 @@
+package stf
+
+import (
+	"sync"
+
+	adb "github.com/openatx/go-adb"
+	"github.com/pkg/errors"
+)
+
+// ErrNoFrame is returned when the screen size is needed before the first frame arrived
+var ErrNoFrame = errors.New("no frame received yet")
+
+// RemoteControl view the screen with STFCapturer and send touches with STFTouch, or another
+// InputController set by SetInputController.
+// Coordinates of touches are pixels of the latest frame, so they follow the screen rotation
+type RemoteControl struct {
+	Capturer *STFCapturer
+	Touch    *STFTouch
+	Input    InputController // Touch unless SetInputController called
+
+	capture, input Servicer // started and stopped together
+	frameC         chan Frame
+
+	mu                  sync.Mutex
+	width, height, rota int
+	inputMu             sync.Mutex // touch commands of one gesture are not mixed
+
+	safeMixin
+}
+
+// NewRemoteControl create a remote control of device, opts are applied to the capturer
+func NewRemoteControl(device *adb.Device, opts ...Option) *RemoteControl {
+	capturer := NewSTFCapturer(device, opts...)
+	touch := NewSTFTouch(device)
+	return &RemoteControl{
+		Capturer: capturer,
+		Touch:    touch,
+		Input:    touch,
+		capture:  capturer,
+		input:    touch,
+	}
+}
+
+// SetInputController send input with c instead of minitouch, e.g. a ShellInput when minitouch
+// is not available. Must be called before Start
+func (r *RemoteControl) SetInputController(c InputController) {
+	r.Input, r.input = c, c
+}
+
+// Start the capturer and then the input, the capturer is stopped if the input failed to start
+func (r *RemoteControl) Start() error {
+	return r.safeDo(_ACTION_START, func() error {
+		if err := r.capture.Start(); err != nil {
+			return errors.Wrap(err, "start capturer")
+		}
+		if err := r.input.Start(); err != nil {
+			r.capture.Stop()
+			return errors.Wrap(err, "start input")
+		}
+		r.frameC = r.Capturer.Subscribe()
+		go r.followScreen(r.frameC)
+		return nil
+	})
+}
+
+// Stop both the input and the capturer
+func (r *RemoteControl) Stop() error {
+	return r.safeDo(_ACTION_STOP, func() error {
+		r.Capturer.Unsubscribe(r.frameC)
+		return wrapMultiError(r.input.Stop(), r.capture.Stop())
+	})
+}
+
+// Close stop the remote control if started
+func (r *RemoteControl) Close() error {
+	if !r.IsStarted() {
+		return nil
+	}
+	return r.Stop()
+}
+
+// Wait return when the capturer or the input quit
+func (r *RemoteControl) Wait() error {
+	select {
+	case err := <-GoFunc(r.capture.Wait):
+		return err
+	case err := <-GoFunc(r.input.Wait):
+		return err
+	}
+}
+
+// followScreen record size and rotation of every frame until C closed
+func (r *RemoteControl) followScreen(C chan Frame) {
+	for frame := range C {
+		r.mu.Lock()
+		r.width, r.height, r.rota = frame.Width, frame.Height, frame.Rotation
+		r.mu.Unlock()
+	}
+}
+
+// Screen return size and rotation of the latest frame
+func (r *RemoteControl) Screen() (width, height, rotation int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.width, r.height, r.rota
+}
+
+// percent convert pixels of the latest frame into the percents used by InputController
+func (r *RemoteControl) percent(x, y int) (xP, yP float64, err error) {
+	width, height, rotation := r.Screen()
+	if width == 0 || height == 0 {
+		return 0, 0, ErrNoFrame
+	}
+	r.Input.SetRotation(rotation)
+	return float64(x) / float64(width), float64(y) / float64(height), nil
+}
+
+// Tap touch (x, y) of the screen as shown in frames
+func (r *RemoteControl) Tap(x, y int) error {
+	r.inputMu.Lock()
+	defer r.inputMu.Unlock()
+	xP, yP, err := r.percent(x, y)
+	if err != nil {
+		return err
+	}
+	return r.Input.Tap(xP, yP)
+}
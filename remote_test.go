@@ -0,0 +1,98 @@
+package stf
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// funcServicer is a Servicer of functions, nil functions do nothing
+type funcServicer struct {
+	start, stop, wait func() error
+}
+
+func (f funcServicer) Start() error { return callOrNil(f.start) }
+func (f funcServicer) Stop() error  { return callOrNil(f.stop) }
+func (f funcServicer) Wait() error  { return callOrNil(f.wait) }
+
+func callOrNil(f func() error) error {
+	if f == nil {
+		return nil
+	}
+	return f()
+}
+
+func newFakeRemoteControl(t *testing.T, input Servicer) *RemoteControl {
+	frames := make([][]byte, 100)
+	for i := range frames {
+		frames[i] = fakeJpeg
+	}
+	cap := newFakeCapturer(t, frames...)
+	touch := &STFTouch{cmdC: make(chan string, 10), maxX: 1000, maxY: 2000, banner: MinitouchBanner{MaxPressure: 100}, pressure: 0.5}
+	return &RemoteControl{
+		Capturer: cap,
+		Touch:    touch,
+		Input:    touch,
+		capture: funcServicer{
+			start: func() error { startFake(cap); return nil },
+			stop:  cap.Stop,
+			wait:  cap.Wait,
+		},
+		input: input,
+	}
+}
+
+func TestRemoteControlTap(t *testing.T) {
+	r := newFakeRemoteControl(t, funcServicer{})
+	assert.Equal(t, ErrNoFrame, r.Tap(10, 10))
+	assert.NoError(t, r.Start())
+	defer r.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if width, _, _ := r.Screen(); width != 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	width, height, rotation := r.Screen()
+	assert.Equal(t, 720, width)
+	assert.Equal(t, 1280, height)
+	assert.Equal(t, 0, rotation)
+
+	assert.NoError(t, r.Tap(width/4, height/2))
+	assert.Equal(t, "d 0 250 1000 50", <-r.Touch.cmdC)
+	assert.Equal(t, "u 0", <-r.Touch.cmdC)
+
+	// rotation of frames is used to transform coordinates
+	r.mu.Lock()
+	r.width, r.height, r.rota = 1280, 720, 90
+	r.mu.Unlock()
+	assert.NoError(t, r.Tap(0, 360))
+	assert.Equal(t, "d 0 500 0 50", <-r.Touch.cmdC)
+	<-r.Touch.cmdC
+
+	assert.NoError(t, r.Close())
+	assert.False(t, r.IsStarted())
+}
+
+func TestRemoteControlStartRollback(t *testing.T) {
+	var stopped bool
+	r := newFakeRemoteControl(t, funcServicer{start: func() error { return errors.New("no minitouch") }})
+	capture := r.capture.(funcServicer)
+	r.capture = funcServicer{
+		start: capture.start,
+		stop: func() error {
+			stopped = true
+			return capture.stop()
+		},
+	}
+	err := r.Start()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no minitouch")
+	assert.True(t, stopped, "capturer is stopped when minitouch failed")
+	assert.False(t, r.IsStarted())
+	assert.False(t, r.Capturer.minicapDaemon.IsStarted())
+}
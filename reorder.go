@@ -0,0 +1,112 @@
+package stf
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Reorder release frames from C in Seq order, for consumers of async paths such as Process
+// which may deliver frames out of order. A missing Seq is waited for until window frames are
+// held or timeout elapsed, then it is skipped. Frames arriving after their Seq was released
+// or skipped are dropped. The channel is closed when ctx done or C closed
+func Reorder(ctx context.Context, C <-chan Frame, window int, timeout time.Duration) <-chan Frame {
+	if window <= 0 {
+		window = 1
+	}
+	outC := make(chan Frame)
+	go func() {
+		defer close(outC)
+		r := &reorderBuffer{window: window}
+		var waitSince time.Time // when the oldest held frame arrived
+		for {
+			var timeoutC <-chan time.Time
+			if len(r.held) > 0 {
+				timeoutC = time.After(timeout - time.Since(waitSince))
+			}
+			var ready []Frame
+			select {
+			case frame, ok := <-C:
+				if !ok {
+					for _, f := range r.flush() {
+						select {
+						case outC <- f:
+						case <-ctx.Done():
+							return
+						}
+					}
+					return
+				}
+				if len(r.held) == 0 {
+					waitSince = time.Now()
+				}
+				ready = r.push(frame)
+			case <-timeoutC:
+				ready = r.skip()
+			case <-ctx.Done():
+				return
+			}
+			if len(ready) > 0 {
+				waitSince = time.Now()
+			}
+			for _, f := range ready {
+				select {
+				case outC <- f:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return outC
+}
+
+// reorderBuffer hold frames until the frames before them arrived
+type reorderBuffer struct {
+	window int
+	next   uint64 // Seq to release next, 0 before the first release
+	held   []Frame
+}
+
+// push add frame and return the frames can be released in order
+func (r *reorderBuffer) push(frame Frame) []Frame {
+	if r.next != 0 && frame.Seq < r.next {
+		return nil // too late
+	}
+	r.held = append(r.held, frame)
+	sort.Slice(r.held, func(i, j int) bool { return r.held[i].Seq < r.held[j].Seq })
+	if r.next == 0 && len(r.held) < r.window {
+		return nil // the first frames may be shuffled too
+	}
+	if len(r.held) > r.window || r.next == 0 {
+		return r.skip()
+	}
+	return r.release()
+}
+
+// skip give up waiting for the missing frames and release from the oldest held frame
+func (r *reorderBuffer) skip() []Frame {
+	if len(r.held) == 0 {
+		return nil
+	}
+	r.next = r.held[0].Seq
+	return r.release()
+}
+
+func (r *reorderBuffer) release() (ready []Frame) {
+	for len(r.held) > 0 && r.held[0].Seq <= r.next {
+		if r.held[0].Seq == r.next {
+			ready = append(ready, r.held[0])
+			r.next++
+		}
+		r.held = r.held[1:]
+	}
+	return ready
+}
+
+// flush release all held frames in order
+func (r *reorderBuffer) flush() []Frame {
+	ready := r.held
+	r.held = nil
+	return ready
+}
@@ -0,0 +1,71 @@
+package stf
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func seqs(frames []Frame) []uint64 {
+	out := make([]uint64, 0, len(frames))
+	for _, f := range frames {
+		out = append(out, f.Seq)
+	}
+	return out
+}
+
+func TestReorderBuffer(t *testing.T) {
+	r := &reorderBuffer{window: 3}
+	var out []Frame
+	for _, seq := range []uint64{2, 1, 3, 5, 4, 7, 8, 9, 10, 6, 11} {
+		out = append(out, r.push(Frame{Seq: seq})...)
+	}
+	out = append(out, r.flush()...)
+	// 6 is waited for until 4 frames held, then skipped and dropped when it arrived
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 7, 8, 9, 10, 11}, seqs(out))
+}
+
+func TestReorder(t *testing.T) {
+	C := make(chan Frame)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outC := Reorder(ctx, C, 4, time.Second)
+	go func() {
+		for _, seq := range []uint64{3, 1, 2, 6, 4, 5, 8, 7, 9} {
+			C <- Frame{Seq: seq}
+		}
+		close(C)
+	}()
+	var out []Frame
+	for frame := range outC {
+		out = append(out, frame)
+	}
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9}, seqs(out))
+}
+
+func TestReorderTimeout(t *testing.T) {
+	C := make(chan Frame)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outC := Reorder(ctx, C, 10, 50*time.Millisecond)
+	C <- Frame{Seq: 1}
+	C <- Frame{Seq: 3} // 2 is lost
+	start := time.Now()
+	assert.Equal(t, uint64(1), (<-outC).Seq)
+	assert.Equal(t, uint64(3), (<-outC).Seq)
+	assert.True(t, time.Since(start) < time.Second)
+
+	C <- Frame{Seq: 2} // late
+	C <- Frame{Seq: 4}
+	select {
+	case frame := <-outC:
+		assert.Equal(t, uint64(4), frame.Seq)
+	case <-time.After(time.Second):
+		t.Fatal("frame 4 not released")
+	}
+	cancel()
+	_, ok := <-outC
+	assert.False(t, ok)
+}
@@ -3,6 +3,7 @@ package stf
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -13,7 +14,6 @@ import (
 	"time"
 
 	adb "github.com/openatx/go-adb"
-	"github.com/openatx/go-adb/wire"
 	"github.com/pkg/errors"
 )
 
@@ -27,55 +27,67 @@ type STFRotation struct {
 	mu          sync.Mutex
 	lastValue   int
 	subscribers map[chan int]bool
-	cmdConn     *wire.Conn
+	cmdConn     io.Closer
 	wg          sync.WaitGroup
 	stopped     bool
 	leftRetry   int
+	prepare     func() (pmPath string, err error)                       // install the apk
+	open        func(cmd string, args ...string) (io.ReadCloser, error) // run the watcher
 }
 
 func NewSTFRotation(d *adb.Device) *STFRotation {
-	return &STFRotation{
+	s := &STFRotation{
 		d:           d,
 		subscribers: make(map[chan int]bool),
 		leftRetry:   defaultRotationMaxRetry,
 		lastValue:   -1,
 	}
+	s.prepare = s.preparePackage
+	s.open = func(cmd string, args ...string) (io.ReadCloser, error) {
+		conn, err := s.d.OpenCommand(cmd, args...)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return s
 }
 
 // 0, 90, 180, 270
 func (s *STFRotation) Rotation() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.lastValue == -1 || s.stopped {
 		return 0, errors.New("Rotation not ready")
 	}
 	return s.lastValue, nil
 }
 
+// Start run the watcher in background, it is retried when it quit.
+// Subscribers are closed when it quit too often or Stop called
 func (s *STFRotation) Start() error {
-	pmPath, err := s.preparePackage()
+	pmPath, err := s.prepare()
 	if err != nil {
 		return err
 	}
 
+	s.wg.Add(1)
 	go func() {
-		var ok = true
-		for ok {
-			s.wg.Add(1)
+		defer s.wg.Done()
+		for {
 			err := s.consoleStartProcess(pmPath)
+			s.mu.Lock()
 			if err == nil {
 				s.leftRetry = defaultRotationMaxRetry
 			} else {
 				log.Printf("rotation run failed: %v, left retry %d", err, s.leftRetry)
 			}
-
-			s.mu.Lock()
 			s.leftRetry -= 1
 			if s.stopped || s.leftRetry <= 0 {
-				for subC := range s.subscribers {
-					s.Unsubscribe(subC)
-				}
-				ok = false
+				s.closeSubscribers()
+				s.mu.Unlock()
+				return
 			}
-			s.wg.Done()
 			s.mu.Unlock()
 		}
 	}()
@@ -86,10 +98,11 @@ func (s *STFRotation) Stop() error {
 	// cancel retry and wait until stop
 	s.mu.Lock()
 	s.stopped = true
+	conn := s.cmdConn
+	s.cmdConn = nil
 	s.mu.Unlock()
-	if s.cmdConn != nil {
-		s.cmdConn.Close()
-		s.cmdConn = nil
+	if conn != nil {
+		conn.Close()
 	}
 	s.wg.Wait()
 	return nil
@@ -103,21 +116,37 @@ func (s *STFRotation) Subscribe() chan int {
 	return C
 }
 
-// unsubscribe will also close channel
+// unsubscribe will also close channel, a channel already closed is ignored
 func (s *STFRotation) Unsubscribe(C chan int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.subscribers, C)
-	close(C)
+	s.unsubscribe(C)
+}
+
+// unsubscribe is Unsubscribe with s.mu held
+func (s *STFRotation) unsubscribe(C chan int) {
+	if s.subscribers[C] {
+		delete(s.subscribers, C)
+		close(C)
+	}
+}
+
+// closeSubscribers close all subscribers with s.mu held, they know the watcher quit
+func (s *STFRotation) closeSubscribers() {
+	for subC := range s.subscribers {
+		s.unsubscribe(subC)
+	}
 }
 
 func (s *STFRotation) pub(v int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.lastValue = v
 	for subC := range s.subscribers {
 		select {
 		case subC <- v:
 		case <-time.After(1 * time.Second):
-			s.Unsubscribe(subC)
+			s.unsubscribe(subC)
 		}
 	}
 }
@@ -130,11 +159,24 @@ func (s *STFRotation) preparePackage() (pmPath string, err error) {
 }
 
 func (s *STFRotation) consoleStartProcess(pmPath string) error {
-	fio, err := s.d.OpenCommand("CLASSPATH="+pmPath, "exec", "app_process", "/system/bin", defaultRotationPkgName+".RotationWatcher")
+	s.mu.Lock()
+	stopped := s.stopped
+	s.mu.Unlock()
+	if stopped {
+		return errors.New("rotation stopped")
+	}
+	fio, err := s.open("CLASSPATH="+pmPath, "exec", "app_process", "/system/bin", defaultRotationPkgName+".RotationWatcher")
 	if err != nil {
 		return errors.Wrap(err, "start rotation.apk")
 	}
+	s.mu.Lock()
 	s.cmdConn = fio
+	stopped = s.stopped // Stop called while opening
+	s.mu.Unlock()
+	if stopped {
+		fio.Close()
+		return errors.New("rotation stopped")
+	}
 	defer fio.Close()
 	readCount := 0
 	scanner := bufio.NewScanner(fio)
@@ -210,3 +252,65 @@ func (s *STFRotation) checkCmdOutput(name string, args ...string) (outStr string
 	}
 	return outStr[0:idx], err
 }
+
+const defaultRotationPollInterval = time.Second
+
+// rotationWatcher feed rotation changes into minicap, from RotationWatcher.apk
+// or by polling dumpsys when the apk can not run
+type rotationWatcher struct {
+	m            *minicapDaemon
+	newApk       func() *STFRotation
+	watchApk     func() (C chan int, stop func(), err error)
+	pollInterval time.Duration
+	onChange     func(r int) // restart minicap with rotation r
+}
+
+func newRotationWatcher(m *minicapDaemon, pollInterval time.Duration, onChange func(int)) *rotationWatcher {
+	if pollInterval <= 0 {
+		pollInterval = defaultRotationPollInterval
+	}
+	if onChange == nil {
+		onChange = m.SetRotation
+	}
+	w := &rotationWatcher{m: m, pollInterval: pollInterval, onChange: onChange}
+	w.newApk = func() *STFRotation {
+		return NewSTFRotation(m.Device)
+	}
+	w.watchApk = func() (chan int, func(), error) {
+		r := w.newApk()
+		C := r.Subscribe() // before Start, or a quick failure would be missed
+		if err := r.Start(); err != nil {
+			r.Unsubscribe(C)
+			return nil, nil, err
+		}
+		return C, func() { r.Stop() }, nil
+	}
+	return w
+}
+
+// run block until ctx is done, polling is used when the apk failed to start or quit
+func (w *rotationWatcher) run(ctx context.Context) error {
+	C, stop, err := w.watchApk()
+	if err == nil {
+		defer stop()
+		last := -1
+	loop:
+		for {
+			select {
+			case r, ok := <-C:
+				if !ok {
+					err = errors.New("rotation watcher quit")
+					break loop
+				}
+				if r != last {
+					last = r
+					w.onChange(r)
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	log.Printf("rotation watcher not available, poll dumpsys instead: %v", err)
+	return w.m.pollRotation(ctx, w.pollInterval, w.onChange)
+}
@@ -1,9 +1,16 @@
 package stf
 
 import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,3 +46,111 @@ func TestRotation(t *testing.T) {
 // 	t.Log(fio.Close())
 // 	time.Sleep(5 * time.Second)
 // }
+
+func TestRotationWatcher(t *testing.T) {
+	cap := NewSTFCapturer(nil)
+	cap.EnableRotationWatcher()
+	assert.False(t, cap.Config().RotationLocked)
+	apkC := make(chan int, 3)
+	cap.watcher.watchApk = func() (chan int, func(), error) {
+		return apkC, func() {}, nil
+	}
+	cap.minicapDaemon.shell = func(cmd string, args ...string) (string, error) {
+		return "SurfaceOrientation: 3", nil
+	}
+	cap.watcher.pollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cap.watcher.run(ctx)
+
+	apkC <- 90
+	assert.Equal(t, 90, <-cap.minicapDaemon.rotationC, "minicap is restarted")
+	assert.Equal(t, 90, <-cap.RotationC())
+
+	// the apk quit, dumpsys is polled instead
+	close(apkC)
+	assert.Equal(t, 270, <-cap.minicapDaemon.rotationC)
+	assert.Equal(t, 270, <-cap.RotationC())
+}
+
+func TestRotationWatcherNoApk(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	var changes []int
+	w := newRotationWatcher(m, 10*time.Millisecond, func(r int) { changes = append(changes, r) })
+	w.watchApk = func() (chan int, func(), error) {
+		return nil, nil, errors.New("no apk")
+	}
+	m.shell = func(cmd string, args ...string) (string, error) {
+		return "SurfaceOrientation: 1", nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, w.run(ctx))
+	assert.Equal(t, []int{90}, changes)
+}
+
+// newFakeSTFRotation run outputs one after another as the watcher, then fail to start it
+func newFakeSTFRotation(outputs ...string) *STFRotation {
+	r := NewSTFRotation(nil)
+	r.prepare = func() (string, error) {
+		return "/data/app/rotationwatcher.apk", nil
+	}
+	var mu sync.Mutex
+	r.open = func(cmd string, args ...string) (io.ReadCloser, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(outputs) == 0 {
+			return nil, errors.New("app_process failed")
+		}
+		out := outputs[0]
+		outputs = outputs[1:]
+		return ioutil.NopCloser(strings.NewReader(out)), nil
+	}
+	return r
+}
+
+func TestSTFRotationQuit(t *testing.T) {
+	r := newFakeSTFRotation("90\n")
+	subC := r.Subscribe()
+	assert.NoError(t, r.Start())
+	assert.Equal(t, 90, <-subC)
+	select {
+	case _, ok := <-subC:
+		assert.False(t, ok, "closed after the retries failed")
+	case <-time.After(time.Second):
+		t.Fatal("subscriber not closed")
+	}
+	r.Unsubscribe(subC) // already closed, no panic
+
+	stoppedC := GoFunc(r.Stop)
+	select {
+	case err := <-stoppedC:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked")
+	}
+}
+
+func TestRotationWatcherApkFailed(t *testing.T) {
+	m := newMinicapDaemon(nil, nil)
+	changesC := make(chan int, 10)
+	w := newRotationWatcher(m, 10*time.Millisecond, func(r int) { changesC <- r })
+	w.newApk = func() *STFRotation {
+		return newFakeSTFRotation("90\n")
+	}
+	m.shell = func(cmd string, args ...string) (string, error) {
+		return "SurfaceOrientation: 3", nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := GoFunc(func() error { return w.run(ctx) })
+	for _, want := range []int{90, 270} {
+		select {
+		case r := <-changesC:
+			assert.Equal(t, want, r)
+		case <-time.After(time.Second):
+			t.Fatalf("no rotation %d, dumpsys is not polled after the apk failed", want)
+		}
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-errC)
+}
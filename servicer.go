@@ -3,6 +3,7 @@ package stf
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -62,24 +63,33 @@ const (
 
 type safeMixin struct {
 	mu      sync.Mutex
-	started bool
+	started int32 // 1 if started, read atomically so IsStarted do not wait for a running Start or Stop
 }
 
 func (t *safeMixin) safeDo(action int, f func() error) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	if t.started && action == _ACTION_START {
+	started := atomic.LoadInt32(&t.started) == 1
+	if started && action == _ACTION_START {
 		return ErrServiceAlreadyStarted
 	}
-	if !t.started && action == _ACTION_STOP {
+	if !started && action == _ACTION_STOP {
 		return ErrServiceNotStarted
 	}
-	t.started = (action == _ACTION_START)
-	return f()
+	if action == _ACTION_START {
+		atomic.StoreInt32(&t.started, 1)
+	} else {
+		atomic.StoreInt32(&t.started, 0)
+	}
+	err := f()
+	if err != nil && action == _ACTION_START {
+		atomic.StoreInt32(&t.started, 0)
+	}
+	return err
 }
 
 func (t *safeMixin) IsStarted() bool {
-	return t.started
+	return atomic.LoadInt32(&t.started) == 1
 }
 
 // Mutex retry
@@ -141,27 +151,43 @@ func (t *safeMixin) IsStarted() bool {
 // Mixin helper to easy write Servicer
 type errorMixin struct {
 	errC chan error
-	once *sync.Once
-	wg   *sync.WaitGroup
+	mu   sync.Mutex
+	run  *errorRun
+}
+
+// errorRun is the result of one Start, Wait of the last run must not see the next one
+type errorRun struct {
+	once sync.Once
+	wg   sync.WaitGroup
 	err  error
 }
 
 // this func must be called before use other functions
 func (e *errorMixin) resetError() {
-	e.once = &sync.Once{}
-	e.wg = &sync.WaitGroup{}
-	e.wg.Add(1)
+	run := &errorRun{}
+	run.wg.Add(1)
+	e.mu.Lock()
+	e.run = run
+	e.mu.Unlock()
+}
+
+func (e *errorMixin) currentRun() *errorRun {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.run
 }
 
 func (e *errorMixin) Wait() error {
-	e.wg.Wait()
-	return e.err
+	run := e.currentRun()
+	run.wg.Wait()
+	return run.err
 }
 
 func (e *errorMixin) doneError(err error) {
-	e.once.Do(func() {
-		e.err = err
-		e.wg.Done()
+	run := e.currentRun()
+	run.once.Do(func() {
+		run.err = err
+		run.wg.Done()
 	})
 }
 
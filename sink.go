@@ -0,0 +1,86 @@
+package stf
+
+import "sync"
+
+// FrameSink receive frames read by the sucker, Deliver must not block the read path
+// and return whether the frame is accepted
+type FrameSink interface {
+	Deliver(Frame) bool
+}
+
+// ChannelSink send frames to the channel, frames are dropped when it is full
+type ChannelSink chan Frame
+
+func (C ChannelSink) Deliver(f Frame) bool {
+	select {
+	case C <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+// CallbackSink call the function for every frame on the read path, it should return fast
+type CallbackSink func(Frame)
+
+func (fn CallbackSink) Deliver(f Frame) bool {
+	fn(f)
+	return true
+}
+
+// RingSink keep the latest frames, older ones are overwritten
+type RingSink struct {
+	mu     sync.Mutex
+	frames []Frame
+	next   int
+	count  int
+}
+
+func NewRingSink(size int) *RingSink {
+	if size < 1 {
+		size = 1
+	}
+	return &RingSink{frames: make([]Frame, size)}
+}
+
+func (r *RingSink) Deliver(f Frame) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames[r.next] = f
+	r.next = (r.next + 1) % len(r.frames)
+	if r.count < len(r.frames) {
+		r.count++
+	}
+	return true
+}
+
+// Frames return the kept frames, the oldest first
+func (r *RingSink) Frames() []Frame {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	frames := make([]Frame, 0, r.count)
+	start := (r.next - r.count + len(r.frames)) % len(r.frames)
+	for i := 0; i < r.count; i++ {
+		frames = append(frames, r.frames[(start+i)%len(r.frames)])
+	}
+	return frames
+}
+
+// MultiSink deliver every frame to all sinks, accepted if any sink accepted it
+type MultiSink []FrameSink
+
+func (sinks MultiSink) Deliver(f Frame) bool {
+	accepted := false
+	for _, sink := range sinks {
+		if sink.Deliver(f) {
+			accepted = true
+		}
+	}
+	return accepted
+}
+
+// Deliver make FrameHub a FrameSink, frames are dropped for slow subscribers
+func (h *FrameHub) Deliver(f Frame) bool {
+	h.pub(f)
+	return true
+}
@@ -0,0 +1,69 @@
+package stf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelSink(t *testing.T) {
+	C := make(chan Frame, 1)
+	sink := ChannelSink(C)
+	assert.True(t, sink.Deliver(Frame{Seq: 1}))
+	assert.False(t, sink.Deliver(Frame{Seq: 2}), "full channel should not block")
+	assert.Equal(t, uint64(1), (<-C).Seq)
+}
+
+func TestCallbackSink(t *testing.T) {
+	var seqs []uint64
+	sink := CallbackSink(func(f Frame) {
+		seqs = append(seqs, f.Seq)
+	})
+	assert.True(t, sink.Deliver(Frame{Seq: 1}))
+	assert.True(t, sink.Deliver(Frame{Seq: 2}))
+	assert.Equal(t, []uint64{1, 2}, seqs)
+}
+
+func TestRingSink(t *testing.T) {
+	ring := NewRingSink(3)
+	assert.Equal(t, 0, len(ring.Frames()))
+	for i := 1; i <= 5; i++ {
+		ring.Deliver(Frame{Seq: uint64(i)})
+	}
+	var seqs []uint64
+	for _, f := range ring.Frames() {
+		seqs = append(seqs, f.Seq)
+	}
+	assert.Equal(t, []uint64{3, 4, 5}, seqs)
+}
+
+func TestMultiSink(t *testing.T) {
+	full := ChannelSink(make(chan Frame))
+	ring := NewRingSink(2)
+	hub := newFrameHub()
+	subC := hub.Subscribe()
+	sink := MultiSink{full, ring, hub}
+	assert.True(t, sink.Deliver(Frame{Seq: 1}))
+	assert.Equal(t, 1, len(ring.Frames()))
+	assert.Equal(t, uint64(1), (<-subC).Seq)
+	assert.False(t, MultiSink{full}.Deliver(Frame{Seq: 2}))
+}
+
+func TestSuckerSink(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	ring := NewRingSink(5)
+	s.SetSink(ring)
+	subC := s.Subscribe()
+	s.deliver(Frame{Data: fakeJpeg}, s.clock())
+	s.deliver(Frame{Data: fakeJpeg}, s.clock())
+	assert.Equal(t, 2, len(ring.Frames()))
+	assert.Equal(t, uint64(2), ring.Frames()[1].Seq)
+	assert.Equal(t, 2, len(s.FrameC))
+	assert.Equal(t, 2, len(s.C))
+	assert.Equal(t, uint64(1), (<-subC).Seq)
+
+	s.SetSink(nil)
+	s.deliver(Frame{Data: fakeJpeg}, s.clock())
+	assert.Equal(t, 2, len(ring.Frames()), "removed")
+	assert.Equal(t, 3, len(s.FrameC))
+}
@@ -0,0 +1,150 @@
+package stf
+
+import (
+	"sync"
+	"time"
+)
+
+// CaptureStats is a snapshot of the frame reading health
+type CaptureStats struct {
+	Frames uint64        // frames read since created
+	FPS    float64       // frames per second, averaged
+	Jitter time.Duration // variation of frame inter-arrival time
+}
+
+// frameStats measure the frames read from minicap
+type frameStats struct {
+	mu           sync.Mutex
+	frames       uint64
+	lastTime     time.Time
+	lastInterval time.Duration
+	avgInterval  float64 // in nanoseconds
+	jitter       float64 // in nanoseconds
+}
+
+// add record a frame arrived at t.
+// jitter is estimated like RFC 3550: J += (|D| - J) / 16,
+// D is the difference between two continuous inter-arrival intervals
+func (st *frameStats) add(t time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.frames++
+	if !st.lastTime.IsZero() {
+		interval := t.Sub(st.lastTime)
+		if st.avgInterval == 0 {
+			st.avgInterval = float64(interval)
+		} else {
+			st.avgInterval += (float64(interval) - st.avgInterval) / 16
+		}
+		if st.frames > 2 {
+			d := interval - st.lastInterval
+			if d < 0 {
+				d = -d
+			}
+			st.jitter += (float64(d) - st.jitter) / 16
+		}
+		st.lastInterval = interval
+	}
+	st.lastTime = t
+}
+
+func (st *frameStats) snapshot() CaptureStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stats := CaptureStats{
+		Frames: st.frames,
+		Jitter: time.Duration(st.jitter),
+	}
+	if st.avgInterval > 0 {
+		stats.FPS = float64(time.Second) / st.avgInterval
+	}
+	return stats
+}
+
+// streaming return true if a frame arrived within two expected frame intervals
+func (st *frameStats) streaming(now time.Time) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.avgInterval == 0 {
+		return false
+	}
+	return now.Sub(st.lastTime) <= time.Duration(2*st.avgInterval)
+}
+
+// Stats return a snapshot of frame reading statistics
+func (s *jpgTcpSucker) Stats() CaptureStats {
+	return s.stats.snapshot()
+}
+
+// FrameJitter return the variation of frame inter-arrival time,
+// a high jitter means the link is struggling even if fps looks fine
+func (s *jpgTcpSucker) FrameJitter() time.Duration {
+	return s.stats.snapshot().Jitter
+}
+
+// IsStreaming return true if frames are flowing, which means a frame arrived
+// within two frame intervals derived from the measured fps.
+// minicap only send frames when screen changed, so a static screen is not streaming
+func (s *jpgTcpSucker) IsStreaming() bool {
+	return s.stats.streaming(s.clock())
+}
+
+// StartupReport is how long each phase of Start took
+type StartupReport struct {
+	PushDuration      time.Duration // detect abi and push binaries
+	PrepareDuration   time.Duration // run minicap -i and check it works
+	ForwardDuration   time.Duration // forward the minicap socket, 0 in StdoutMode
+	FirstFrameLatency time.Duration // from Start called to the first frame, 0 before it arrived
+}
+
+// StartupTimings return the phases of the last Start, call it after Start
+func (s *STFCapturer) StartupTimings() StartupReport {
+	m, sucker := s.minicapDaemon, s.jpgTcpSucker
+	report := StartupReport{
+		PushDuration:    m.pushedAt.Sub(m.startedAt),
+		PrepareDuration: m.preparedAt.Sub(m.pushedAt),
+	}
+	if sucker.forwardedAt.After(m.preparedAt) {
+		report.ForwardDuration = sucker.forwardedAt.Sub(m.preparedAt)
+	}
+	sucker.firstFrameMu.Lock()
+	defer sucker.firstFrameMu.Unlock()
+	if sucker.firstFrameAt.After(m.startedAt) {
+		report.FirstFrameLatency = sucker.firstFrameAt.Sub(m.startedAt)
+	}
+	return report
+}
+
+const (
+	defaultAnomalyFactor = 10
+	anomalyWarmup        = 10 // frames before the average is trusted
+)
+
+// frameSizeTracker keep a rolling average of frame sizes and flag frames far from it,
+// a cheap sign of corruption or a mode change without decoding
+type frameSizeTracker struct {
+	factor float64 // 0 means disabled
+	frames int
+	avg    float64
+}
+
+// check record a frame of size bytes, return true if it is factor times smaller or larger than the average
+func (t *frameSizeTracker) check(size int) bool {
+	anomaly := false
+	if t.factor > 0 && t.frames >= anomalyWarmup {
+		anomaly = float64(size) > t.avg*t.factor || float64(size)*t.factor < t.avg
+	}
+	t.frames++
+	if t.avg == 0 {
+		t.avg = float64(size)
+	} else {
+		t.avg += (float64(size) - t.avg) / 16
+	}
+	return anomaly
+}
+
+// SetAnomalyFactor emit EventFrameSizeAnomaly for frames factor times smaller or larger
+// than the rolling average frame size. Default is 10, 0 to disable
+func (s *jpgTcpSucker) SetAnomalyFactor(factor float64) {
+	s.sizes.factor = factor
+}
@@ -0,0 +1,102 @@
+package stf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameJitter(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		now = now.Add(20 * time.Millisecond)
+		s.stats.add(now)
+	}
+	assert.Equal(t, time.Duration(0), s.FrameJitter())
+
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			now = now.Add(10 * time.Millisecond)
+		} else {
+			now = now.Add(30 * time.Millisecond)
+		}
+		s.stats.add(now)
+	}
+	jitter := s.FrameJitter()
+	assert.True(t, jitter > 15*time.Millisecond && jitter <= 20*time.Millisecond, "jitter %v", jitter)
+
+	stats := s.Stats()
+	assert.Equal(t, uint64(200), stats.Frames)
+	assert.Equal(t, jitter, stats.Jitter)
+}
+
+func TestIsStreaming(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	now := time.Now()
+	s.clock = func() time.Time { return now }
+	assert.False(t, s.IsStreaming())
+
+	for i := 0; i < 10; i++ {
+		now = now.Add(20 * time.Millisecond)
+		s.stats.add(now)
+	}
+	assert.InDelta(t, 50, s.Stats().FPS, 0.01)
+	now = now.Add(10 * time.Millisecond)
+	assert.True(t, s.IsStreaming())
+
+	now = now.Add(100 * time.Millisecond)
+	assert.False(t, s.IsStreaming())
+
+	s.stats.add(now)
+	assert.True(t, s.IsStreaming())
+}
+
+func TestStartupTimings(t *testing.T) {
+	port := fakeMinicapServer(t, 0, fakeJpeg, fakeJpeg)
+	cap, _ := newDevicelessCapturer(t, port)
+	assert.NoError(t, cap.Start())
+	defer cap.Stop()
+	<-cap.FrameC
+
+	report := cap.StartupTimings()
+	assert.True(t, report.PushDuration > 0, "%+v", report)
+	assert.True(t, report.PrepareDuration >= 10*time.Millisecond, "%+v", report)
+	assert.True(t, report.ForwardDuration >= 5*time.Millisecond, "%+v", report)
+	assert.True(t, report.FirstFrameLatency >= report.PushDuration+report.PrepareDuration+report.ForwardDuration,
+		"first frame is the last phase: %+v", report)
+}
+
+func TestFrameSizeAnomaly(t *testing.T) {
+	s := newJpgTcpSucker(nil)
+	s.events = make(chan Event, 10)
+	normal := make([]byte, 10000)
+	for i := 0; i < 20; i++ {
+		s.deliver(Frame{Data: normal}, time.Now())
+		s.Drain()
+	}
+	assert.Equal(t, 0, len(s.events))
+
+	s.deliver(Frame{Data: make([]byte, 500)}, time.Now())
+	s.deliver(Frame{Data: normal}, time.Now())
+	s.deliver(Frame{Data: make([]byte, 200000)}, time.Now())
+	if assert.Equal(t, 2, len(s.events)) {
+		ev := <-s.events
+		assert.Equal(t, EventFrameSizeAnomaly, ev.Type)
+		assert.Equal(t, uint64(21), ev.Seq)
+		assert.Equal(t, 500, ev.Size)
+		ev = <-s.events
+		assert.Equal(t, uint64(23), ev.Seq)
+	}
+
+	s.SetAnomalyFactor(0)
+	s.deliver(Frame{Data: make([]byte, 1)}, time.Now())
+	assert.Equal(t, 0, len(s.events))
+}
+
+func TestFrameSizeTrackerWarmup(t *testing.T) {
+	tr := frameSizeTracker{factor: 10}
+	assert.False(t, tr.check(100))
+	assert.False(t, tr.check(100000)) // too early to tell
+}
@@ -0,0 +1,5 @@
+// Package stfgrpc serve frames of a STFCapturer with grpc.
+// It is a sub-package so the core package do not depend on grpc
+package stfgrpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative screencapture.proto
@@ -0,0 +1,210 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: screencapture.proto
+
+package stfgrpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type FramesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FramesRequest) Reset() {
+	*x = FramesRequest{}
+	mi := &file_screencapture_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FramesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FramesRequest) ProtoMessage() {}
+
+func (x *FramesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_screencapture_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FramesRequest.ProtoReflect.Descriptor instead.
+func (*FramesRequest) Descriptor() ([]byte, []int) {
+	return file_screencapture_proto_rawDescGZIP(), []int{0}
+}
+
+type Frame struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Data          []byte                 `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	Seq           uint64                 `protobuf:"varint,2,opt,name=seq,proto3" json:"seq,omitempty"`
+	TimeUnixNano  int64                  `protobuf:"varint,3,opt,name=time_unix_nano,json=timeUnixNano,proto3" json:"time_unix_nano,omitempty"`
+	Rotation      int32                  `protobuf:"varint,4,opt,name=rotation,proto3" json:"rotation,omitempty"`
+	Width         int32                  `protobuf:"varint,5,opt,name=width,proto3" json:"width,omitempty"`
+	Height        int32                  `protobuf:"varint,6,opt,name=height,proto3" json:"height,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Frame) Reset() {
+	*x = Frame{}
+	mi := &file_screencapture_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Frame) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Frame) ProtoMessage() {}
+
+func (x *Frame) ProtoReflect() protoreflect.Message {
+	mi := &file_screencapture_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Frame.ProtoReflect.Descriptor instead.
+func (*Frame) Descriptor() ([]byte, []int) {
+	return file_screencapture_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Frame) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *Frame) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Frame) GetTimeUnixNano() int64 {
+	if x != nil {
+		return x.TimeUnixNano
+	}
+	return 0
+}
+
+func (x *Frame) GetRotation() int32 {
+	if x != nil {
+		return x.Rotation
+	}
+	return 0
+}
+
+func (x *Frame) GetWidth() int32 {
+	if x != nil {
+		return x.Width
+	}
+	return 0
+}
+
+func (x *Frame) GetHeight() int32 {
+	if x != nil {
+		return x.Height
+	}
+	return 0
+}
+
+var File_screencapture_proto protoreflect.FileDescriptor
+
+const file_screencapture_proto_rawDesc = "" +
+	"\n" +
+	"\x13screencapture.proto\x12\x03stf\"\x0f\n" +
+	"\rFramesRequest\"\x9d\x01\n" +
+	"\x05Frame\x12\x12\n" +
+	"\x04data\x18\x01 \x01(\fR\x04data\x12\x10\n" +
+	"\x03seq\x18\x02 \x01(\x04R\x03seq\x12$\n" +
+	"\x0etime_unix_nano\x18\x03 \x01(\x03R\ftimeUnixNano\x12\x1a\n" +
+	"\brotation\x18\x04 \x01(\x05R\brotation\x12\x14\n" +
+	"\x05width\x18\x05 \x01(\x05R\x05width\x12\x16\n" +
+	"\x06height\x18\x06 \x01(\x05R\x06height2;\n" +
+	"\rScreenCapture\x12*\n" +
+	"\x06Frames\x12\x12.stf.FramesRequest\x1a\n" +
+	".stf.Frame0\x01B&Z$github.com/BigWavelet/go-stf/stfgrpcb\x06proto3"
+
+var (
+	file_screencapture_proto_rawDescOnce sync.Once
+	file_screencapture_proto_rawDescData []byte
+)
+
+func file_screencapture_proto_rawDescGZIP() []byte {
+	file_screencapture_proto_rawDescOnce.Do(func() {
+		file_screencapture_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_screencapture_proto_rawDesc), len(file_screencapture_proto_rawDesc)))
+	})
+	return file_screencapture_proto_rawDescData
+}
+
+var file_screencapture_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_screencapture_proto_goTypes = []any{
+	(*FramesRequest)(nil), // 0: stf.FramesRequest
+	(*Frame)(nil),         // 1: stf.Frame
+}
+var file_screencapture_proto_depIdxs = []int32{
+	0, // 0: stf.ScreenCapture.Frames:input_type -> stf.FramesRequest
+	1, // 1: stf.ScreenCapture.Frames:output_type -> stf.Frame
+	1, // [1:2] is the sub-list for method output_type
+	0, // [0:1] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_screencapture_proto_init() }
+func file_screencapture_proto_init() {
+	if File_screencapture_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_screencapture_proto_rawDesc), len(file_screencapture_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_screencapture_proto_goTypes,
+		DependencyIndexes: file_screencapture_proto_depIdxs,
+		MessageInfos:      file_screencapture_proto_msgTypes,
+	}.Build()
+	File_screencapture_proto = out.File
+	file_screencapture_proto_goTypes = nil
+	file_screencapture_proto_depIdxs = nil
+}
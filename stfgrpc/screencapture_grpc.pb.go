@@ -0,0 +1,130 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: screencapture.proto
+
+package stfgrpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ScreenCapture_Frames_FullMethodName = "/stf.ScreenCapture/Frames"
+)
+
+// ScreenCaptureClient is the client API for ScreenCapture service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// ScreenCapture stream the screen of an android device
+type ScreenCaptureClient interface {
+	// Frames stream jpeg frames until the client cancel
+	Frames(ctx context.Context, in *FramesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Frame], error)
+}
+
+type screenCaptureClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewScreenCaptureClient(cc grpc.ClientConnInterface) ScreenCaptureClient {
+	return &screenCaptureClient{cc}
+}
+
+func (c *screenCaptureClient) Frames(ctx context.Context, in *FramesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Frame], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ScreenCapture_ServiceDesc.Streams[0], ScreenCapture_Frames_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[FramesRequest, Frame]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ScreenCapture_FramesClient = grpc.ServerStreamingClient[Frame]
+
+// ScreenCaptureServer is the server API for ScreenCapture service.
+// All implementations must embed UnimplementedScreenCaptureServer
+// for forward compatibility.
+//
+// ScreenCapture stream the screen of an android device
+type ScreenCaptureServer interface {
+	// Frames stream jpeg frames until the client cancel
+	Frames(*FramesRequest, grpc.ServerStreamingServer[Frame]) error
+	mustEmbedUnimplementedScreenCaptureServer()
+}
+
+// UnimplementedScreenCaptureServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedScreenCaptureServer struct{}
+
+func (UnimplementedScreenCaptureServer) Frames(*FramesRequest, grpc.ServerStreamingServer[Frame]) error {
+	return status.Errorf(codes.Unimplemented, "method Frames not implemented")
+}
+func (UnimplementedScreenCaptureServer) mustEmbedUnimplementedScreenCaptureServer() {}
+func (UnimplementedScreenCaptureServer) testEmbeddedByValue()                       {}
+
+// UnsafeScreenCaptureServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ScreenCaptureServer will
+// result in compilation errors.
+type UnsafeScreenCaptureServer interface {
+	mustEmbedUnimplementedScreenCaptureServer()
+}
+
+func RegisterScreenCaptureServer(s grpc.ServiceRegistrar, srv ScreenCaptureServer) {
+	// If the following call pancis, it indicates UnimplementedScreenCaptureServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ScreenCapture_ServiceDesc, srv)
+}
+
+func _ScreenCapture_Frames_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FramesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ScreenCaptureServer).Frames(m, &grpc.GenericServerStream[FramesRequest, Frame]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ScreenCapture_FramesServer = grpc.ServerStreamingServer[Frame]
+
+// ScreenCapture_ServiceDesc is the grpc.ServiceDesc for ScreenCapture service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ScreenCapture_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "stf.ScreenCapture",
+	HandlerType: (*ScreenCaptureServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Frames",
+			Handler:       _ScreenCapture_Frames_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "screencapture.proto",
+}
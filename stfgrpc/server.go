@@ -0,0 +1,52 @@
+package stfgrpc
+
+import (
+	stf "github.com/BigWavelet/go-stf"
+)
+
+// FrameSource is implemented by *stf.STFCapturer
+type FrameSource interface {
+	Subscribe() chan stf.Frame
+	Unsubscribe(C chan stf.Frame)
+}
+
+// Server implement ScreenCaptureServer, every Frames call get its own subscription.
+// When a client is slower than the device, new frames are dropped by the subscription
+// instead of blocking the capturer
+type Server struct {
+	UnimplementedScreenCaptureServer
+	source FrameSource
+}
+
+func NewServer(source FrameSource) *Server {
+	return &Server{source: source}
+}
+
+func (s *Server) Frames(req *FramesRequest, stream ScreenCapture_FramesServer) error {
+	C := s.source.Subscribe()
+	defer s.source.Unsubscribe(C)
+	for {
+		select {
+		case frame, ok := <-C:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(toMessage(frame)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil // client cancelled
+		}
+	}
+}
+
+func toMessage(f stf.Frame) *Frame {
+	return &Frame{
+		Data:         f.Data,
+		Seq:          f.Seq,
+		TimeUnixNano: f.Time.UnixNano(),
+		Rotation:     int32(f.Rotation),
+		Width:        int32(f.Width),
+		Height:       int32(f.Height),
+	}
+}
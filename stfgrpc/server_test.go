@@ -0,0 +1,76 @@
+package stfgrpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	stf "github.com/BigWavelet/go-stf"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type fakeSource struct {
+	mu sync.Mutex
+	C  chan stf.Frame
+}
+
+func (f *fakeSource) Subscribe() chan stf.Frame {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.C = make(chan stf.Frame, 3)
+	return f.C
+}
+
+func (f *fakeSource) Unsubscribe(C chan stf.Frame) {}
+
+func TestServerFrames(t *testing.T) {
+	source := &fakeSource{}
+	ln := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	RegisterScreenCaptureServer(srv, NewServer(source))
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return ln.Dial()
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := NewScreenCaptureClient(conn).Frames(ctx, &FramesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			source.mu.Lock()
+			C := source.C
+			source.mu.Unlock()
+			if C != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for i := 1; i <= 3; i++ {
+			source.C <- stf.Frame{Data: []byte("\xff\xd8jpeg\xff\xd9"), Seq: uint64(i), Rotation: 90}
+		}
+	}()
+	for i := 1; i <= 3; i++ {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, uint64(i), msg.Seq)
+		assert.Equal(t, int32(90), msg.Rotation)
+		assert.Equal(t, []byte("\xff\xd8jpeg\xff\xd9"), msg.Data)
+	}
+}
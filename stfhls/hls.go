@@ -0,0 +1,169 @@
+// Package stfhls write captured frames as HLS, MPEG-TS segments with a rolling m3u8 playlist,
+// so the stream can be served by any static file server or CDN.
+//
+// Frames are kept as jpeg (MJPEG in TS, private data stream), no video encoder is needed,
+// but only players supporting MJPEG (ffmpeg, VLC) can play it, browsers can not.
+package stfhls
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	stf "github.com/BigWavelet/go-stf"
+)
+
+const (
+	DefaultSegmentDuration = 2 * time.Second
+	DefaultPlaylistSize    = 5
+	PlaylistName           = "stream.m3u8"
+)
+
+type segment struct {
+	seq      int
+	name     string
+	duration time.Duration
+}
+
+// Segmenter cut frames into segments of SegmentDuration by the frame time,
+// only the last PlaylistSize segments are kept in the playlist and on disk
+type Segmenter struct {
+	Dir             string
+	SegmentDuration time.Duration
+	PlaylistSize    int
+
+	segments  []segment
+	seq       int
+	file      *os.File
+	bufw      *bufio.Writer
+	ts        *tsWriter
+	segStart  time.Time
+	lastFrame time.Time
+	epoch     time.Time // pts 0
+}
+
+func NewSegmenter(dir string) *Segmenter {
+	return &Segmenter{
+		Dir:             dir,
+		SegmentDuration: DefaultSegmentDuration,
+		PlaylistSize:    DefaultPlaylistSize,
+	}
+}
+
+// Run write frames from C until ctx done or C closed, then end the playlist
+func (s *Segmenter) Run(ctx context.Context, C <-chan stf.Frame) error {
+	for {
+		select {
+		case frame, ok := <-C:
+			if !ok {
+				return s.Close()
+			}
+			if err := s.Write(frame); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return s.Close()
+		}
+	}
+}
+
+// Write add frame to the current segment, a new segment is started when it is long enough
+func (s *Segmenter) Write(frame stf.Frame) error {
+	if s.epoch.IsZero() {
+		s.epoch = frame.Time
+	}
+	if s.file != nil && frame.Time.Sub(s.segStart) >= s.SegmentDuration {
+		if err := s.finishSegment(frame.Time.Sub(s.segStart)); err != nil {
+			return err
+		}
+		if err := s.writePlaylist(false); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		if err := s.startSegment(frame.Time); err != nil {
+			return err
+		}
+	}
+	s.lastFrame = frame.Time
+	pts := frame.Time.Sub(s.epoch).Nanoseconds() * 9 / 100000 // 90kHz
+	return s.ts.writeFrame(frame.Data, pts)
+}
+
+// Close finish the current segment and mark the playlist ended
+func (s *Segmenter) Close() error {
+	if s.file != nil {
+		// the last frame is shown for one frame interval at least, 1/30s is a guess
+		duration := s.lastFrame.Sub(s.segStart) + time.Second/30
+		if err := s.finishSegment(duration); err != nil {
+			return err
+		}
+	}
+	return s.writePlaylist(true)
+}
+
+func (s *Segmenter) startSegment(t time.Time) error {
+	s.seq++
+	name := fmt.Sprintf("segment%05d.ts", s.seq)
+	f, err := os.Create(filepath.Join(s.Dir, name))
+	if err != nil {
+		return err
+	}
+	s.file, s.segStart = f, t
+	s.bufw = bufio.NewWriter(f)
+	s.ts = newTsWriter(s.bufw)
+	return s.ts.writeTables()
+}
+
+func (s *Segmenter) finishSegment(duration time.Duration) error {
+	err := s.bufw.Flush()
+	if er := s.file.Close(); err == nil {
+		err = er
+	}
+	s.segments = append(s.segments, segment{
+		seq:      s.seq,
+		name:     filepath.Base(s.file.Name()),
+		duration: duration,
+	})
+	s.file = nil
+	for len(s.segments) > s.PlaylistSize && s.PlaylistSize > 0 {
+		os.Remove(filepath.Join(s.Dir, s.segments[0].name))
+		s.segments = s.segments[1:]
+	}
+	return err
+}
+
+// writePlaylist replace the playlist atomically, a server never serve a partial one
+func (s *Segmenter) writePlaylist(ended bool) error {
+	target := 1
+	for _, seg := range s.segments {
+		if d := int(math.Ceil(seg.duration.Seconds())); d > target {
+			target = d
+		}
+	}
+	lines := []string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		fmt.Sprintf("#EXT-X-TARGETDURATION:%d", target),
+	}
+	if len(s.segments) > 0 {
+		lines = append(lines, fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d", s.segments[0].seq))
+	}
+	for _, seg := range s.segments {
+		lines = append(lines, fmt.Sprintf("#EXTINF:%.3f,", seg.duration.Seconds()), seg.name)
+	}
+	if ended {
+		lines = append(lines, "#EXT-X-ENDLIST")
+	}
+	tmp := filepath.Join(s.Dir, "."+PlaylistName+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.Dir, PlaylistName))
+}
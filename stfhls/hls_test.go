@@ -0,0 +1,127 @@
+package stfhls
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	stf "github.com/BigWavelet/go-stf"
+	"github.com/stretchr/testify/assert"
+)
+
+var fakeJpeg = append([]byte{0xff, 0xd8}, bytes.Repeat([]byte{0x42}, 500)...)
+
+func TestSegmenter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stfhls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewSegmenter(dir)
+	s.SegmentDuration = time.Second
+	s.PlaylistSize = 3
+	C := make(chan stf.Frame)
+	go func() {
+		start := time.Now()
+		for i := 0; i < 50; i++ { // 5 seconds, 10 fps
+			C <- stf.Frame{Data: fakeJpeg, Seq: uint64(i + 1), Time: start.Add(time.Duration(i) * 100 * time.Millisecond)}
+		}
+		close(C)
+	}()
+	assert.NoError(t, s.Run(context.Background(), C))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, PlaylistName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:3
+#EXTINF:1.000,
+segment00003.ts
+#EXTINF:1.000,
+segment00004.ts
+#EXTINF:0.933,
+segment00005.ts
+#EXT-X-ENDLIST
+`, string(data))
+
+	_, err = os.Stat(filepath.Join(dir, "segment00002.ts"))
+	assert.True(t, os.IsNotExist(err), "old segment not removed")
+
+	ts, err := ioutil.ReadFile(filepath.Join(dir, "segment00003.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := checkTS(t, ts)
+	assert.Equal(t, 10, len(frames))
+	for _, frame := range frames {
+		assert.Equal(t, fakeJpeg, frame)
+	}
+}
+
+// checkTS validate packets and tables, return the payloads of the PES packets
+func checkTS(t *testing.T, ts []byte) (frames [][]byte) {
+	if !assert.Equal(t, 0, len(ts)%tsPacketSize) {
+		return
+	}
+	var pes []byte
+	for i := 0; i < len(ts); i += tsPacketSize {
+		pkt := ts[i : i+tsPacketSize]
+		assert.Equal(t, byte(0x47), pkt[0])
+		pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+		start := pkt[1]&0x40 != 0
+		payload := pkt[4:]
+		if pkt[3]&0x20 != 0 {
+			payload = payload[1+int(payload[0]):]
+		}
+		switch pid {
+		case 0, pmtPID:
+			assert.True(t, start)
+			length := int(payload[2]&0x0f)<<8 | int(payload[3])
+			section := payload[1 : 4+length]
+			assert.Equal(t, uint32(0), crc32MPEG(section), "bad crc of pid %d", pid)
+		case videoPID:
+			if start && pes != nil {
+				frames = append(frames, pes[14:])
+				pes = nil
+			}
+			pes = append(pes, payload...)
+		default:
+			t.Fatalf("unexpected pid %d", pid)
+		}
+	}
+	if pes != nil {
+		frames = append(frames, pes[14:])
+	}
+	assert.Equal(t, byte(0x00), ts[5], "segment should start with PAT")
+	return
+}
+
+func TestSegmenterCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stfhls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	C := make(chan stf.Frame, 1)
+	C <- stf.Frame{Data: fakeJpeg, Time: time.Now()}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	assert.NoError(t, NewSegmenter(dir).Run(ctx, C))
+	data, err := ioutil.ReadFile(filepath.Join(dir, PlaylistName))
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(data), "segment00001.ts"))
+	assert.True(t, strings.HasSuffix(string(data), "#EXT-X-ENDLIST\n"))
+}
@@ -0,0 +1,185 @@
+package stfhls
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// a minimal MPEG-TS muxer carrying jpeg frames as private data (stream type 0x06),
+// players with MJPEG support like ffmpeg and VLC can play it
+const (
+	tsPacketSize = 188
+	pmtPID       = 0x1000
+	videoPID     = 0x0100
+	streamType   = 0x06 // PES private data
+	pesStreamID  = 0xbd // private_stream_1
+)
+
+type tsWriter struct {
+	w  io.Writer
+	cc map[uint16]uint8 // continuity counter of every pid
+}
+
+func newTsWriter(w io.Writer) *tsWriter {
+	return &tsWriter{w: w, cc: make(map[uint16]uint8)}
+}
+
+func (t *tsWriter) header(pkt []byte, pid uint16, start bool, withAdaptation bool) {
+	pkt[0] = 0x47
+	pkt[1] = byte(pid>>8) & 0x1f
+	if start {
+		pkt[1] |= 0x40
+	}
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | t.cc[pid]&0x0f
+	if withAdaptation {
+		pkt[3] |= 0x20
+	}
+	t.cc[pid]++
+}
+
+// writeTables write PAT and PMT, every segment start with them so it can be played alone
+func (t *tsWriter) writeTables() error {
+	pat := []byte{
+		0x00, 0xb0, 13, // table id, section length
+		0x00, 0x01, 0xc1, 0x00, 0x00, // transport stream id, version, section numbers
+		0x00, 0x01, 0xe0 | pmtPID>>8, pmtPID & 0xff, // program 1 -> pmt pid
+	}
+	pmt := []byte{
+		0x02, 0xb0, 18,
+		0x00, 0x01, 0xc1, 0x00, 0x00,
+		0xe0 | videoPID>>8, videoPID & 0xff, // pcr pid
+		0xf0, 0x00, // no program info
+		streamType, 0xe0 | videoPID>>8, videoPID & 0xff, 0xf0, 0x00,
+	}
+	if err := t.writeSection(0, pat); err != nil {
+		return err
+	}
+	return t.writeSection(pmtPID, pmt)
+}
+
+func (t *tsWriter) writeSection(pid uint16, section []byte) error {
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32MPEG(section))
+	section = append(section, crc...)
+	pkt := make([]byte, tsPacketSize)
+	t.header(pkt, pid, true, false)
+	pkt[4] = 0x00 // pointer field
+	n := copy(pkt[5:], section)
+	for i := 5 + n; i < tsPacketSize; i++ {
+		pkt[i] = 0xff
+	}
+	_, err := t.w.Write(pkt)
+	return err
+}
+
+// writeFrame write data as one PES packet with pts, in 90kHz clock
+func (t *tsWriter) writeFrame(data []byte, pts int64) error {
+	pes := make([]byte, 0, len(data)+14)
+	pes = append(pes, 0x00, 0x00, 0x01, pesStreamID)
+	length := len(data) + 8
+	if length > 0xffff {
+		length = 0 // unbounded
+	}
+	pes = append(pes, byte(length>>8), byte(length))
+	pes = append(pes, 0x80, 0x80, 5) // marker, pts only, header length
+	pes = append(pes, encodePTS(pts)...)
+	pes = append(pes, data...)
+
+	for first := true; len(pes) > 0; first = false {
+		var af []byte // adaptation field without its length byte
+		hasAF := false
+		if first {
+			af = append([]byte{0x10}, encodePCR(pts)...) // every frame carry the pcr
+			hasAF = true
+		}
+		room := 184
+		if hasAF {
+			room -= 1 + len(af)
+		}
+		n := len(pes)
+		if n >= room {
+			n = room
+		} else {
+			// fill the packet with adaptation field stuffing
+			pad := room - n
+			switch {
+			case hasAF:
+				af = append(af, stuffing(pad)...)
+			case pad == 1:
+				hasAF = true // only the length byte
+			default:
+				af = append([]byte{0x00}, stuffing(pad-2)...)
+				hasAF = true
+			}
+		}
+		pkt := make([]byte, tsPacketSize)
+		t.header(pkt, videoPID, first, hasAF)
+		i := 4
+		if hasAF {
+			pkt[i] = byte(len(af))
+			copy(pkt[i+1:], af)
+			i += 1 + len(af)
+		}
+		copy(pkt[i:], pes[:n])
+		pes = pes[n:]
+		if _, err := t.w.Write(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stuffing(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = 0xff
+	}
+	return b
+}
+
+func encodePTS(pts int64) []byte {
+	return []byte{
+		0x20 | byte(pts>>29)&0x0e | 1,
+		byte(pts >> 22),
+		byte(pts>>14)&0xfe | 1,
+		byte(pts >> 7),
+		byte(pts<<1)&0xfe | 1,
+	}
+}
+
+// encodePCR encode the 90kHz base, the 27MHz extension is always 0
+func encodePCR(base int64) []byte {
+	return []byte{
+		byte(base >> 25),
+		byte(base >> 17),
+		byte(base >> 9),
+		byte(base >> 1),
+		byte(base<<7) | 0x7e,
+		0x00,
+	}
+}
+
+var crcTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+// crc32MPEG is the crc of PSI sections, not the same as hash/crc32
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
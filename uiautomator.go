@@ -0,0 +1,218 @@
+package stf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	adb "github.com/openatx/go-adb"
+	"github.com/pkg/errors"
+)
+
+const (
+	// uiautomatorPort is where the uiautomator2 server (github.com/openatx/uiautomator2) listen on the device
+	uiautomatorPort            = "9008"
+	defaultUiautomatorInterval = 200 * time.Millisecond
+	defaultUiautomatorQuality  = 80
+)
+
+// UiautomatorCapturer take screenshots with the uiautomator2 server running on the device.
+// It is slower than minicap but need no native binary, so it works on devices minicap
+// does not support yet. Every Frame is a jpeg
+type UiautomatorCapturer struct {
+	C        chan Frame
+	interval time.Duration
+	quality  int
+	seq      uint64
+	baseURL  func() (string, func() error, error) // forward the server port, return http://127.0.0.1:<port> and how to remove the forward
+	client   *http.Client
+	quitC    chan bool
+
+	*adb.Device
+	errorMixin
+	safeMixin
+}
+
+// NewUiautomatorCapturer create a capturer of device, the uiautomator2 server must be running
+func NewUiautomatorCapturer(device *adb.Device) *UiautomatorCapturer {
+	s := &UiautomatorCapturer{
+		C:        make(chan Frame, 3),
+		interval: defaultUiautomatorInterval,
+		quality:  defaultUiautomatorQuality,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		Device:   device,
+	}
+	s.baseURL = func() (string, func() error, error) {
+		return forwardUiautomator(s.Device)
+	}
+	return s
+}
+
+// SetInterval set the time between screenshots, it take effect at next Start
+func (s *UiautomatorCapturer) SetInterval(d time.Duration) {
+	if d > 0 {
+		s.interval = d
+	}
+}
+
+// SetJPEGQuality set the quality (1-100) of screenshots, it take effect at next Start
+func (s *UiautomatorCapturer) SetJPEGQuality(quality int) {
+	if quality > 0 && quality <= 100 {
+		s.quality = quality
+	}
+}
+
+// Frames return the channel of screenshots, the same as C
+func (s *UiautomatorCapturer) Frames() <-chan Frame {
+	return s.C
+}
+
+func (s *UiautomatorCapturer) Start() error {
+	return s.safeDo(_ACTION_START, func() error {
+		s.resetError()
+		baseURL, unforward, err := s.baseURL()
+		if err != nil {
+			return errors.Wrap(err, "forward uiautomator")
+		}
+		s.quitC = make(chan bool)
+		go s.run(baseURL, unforward)
+		return nil
+	})
+}
+
+func (s *UiautomatorCapturer) Stop() error {
+	return s.safeDo(_ACTION_STOP, func() error {
+		close(s.quitC)
+		return s.Wait()
+	})
+}
+
+// run take a screenshot every interval until Stop called, then remove the forward
+func (s *UiautomatorCapturer) run(baseURL string, unforward func() error) {
+	var err error
+	defer func() {
+		unforward()
+		s.doneError(err)
+	}()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		var data []byte
+		data, err = s.takeScreenshot(baseURL)
+		select {
+		case <-s.quitC:
+			err = nil
+			return
+		default:
+		}
+		if err != nil {
+			err = errors.Wrap(err, "uiautomator takeScreenshot")
+			return
+		}
+		s.seq++
+		frame := Frame{Data: data, Seq: s.seq, Time: time.Now(), Format: FormatJPEG}
+		frame.Width, frame.Height, _ = JPEGDimensions(data)
+		select {
+		case s.C <- frame:
+		case <-s.quitC:
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-s.quitC:
+			return
+		}
+	}
+}
+
+// takeScreenshot call the takeScreenshot jsonrpc method, which return a base64 jpeg
+func (s *UiautomatorCapturer) takeScreenshot(baseURL string) ([]byte, error) {
+	var result string
+	if err := uiautomatorCall(s.client, baseURL, "takeScreenshot", []interface{}{1, s.quality}, &result); err != nil {
+		return nil, err
+	}
+	if result == "" {
+		return nil, errors.New("empty screenshot")
+	}
+	return base64.StdEncoding.DecodeString(result)
+}
+
+// uiautomatorCall call method of the uiautomator2 server through its jsonrpc endpoint
+func uiautomatorCall(client *http.Client, baseURL, method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(baseURL+"/jsonrpc/0", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("jsonrpc %s: %s", method, resp.Status)
+	}
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return errors.Wrap(err, "decode jsonrpc reply")
+	}
+	if reply.Error != nil {
+		return errors.Errorf("jsonrpc %s: %d %s", method, reply.Error.Code, reply.Error.Message)
+	}
+	return json.Unmarshal(reply.Result, result)
+}
+
+// pingUiautomator return nil if the uiautomator2 server answer pong
+func pingUiautomator(client *http.Client, baseURL string) error {
+	resp, err := client.Get(baseURL + "/ping")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(data)) != "pong" {
+		return errors.Errorf("uiautomator ping: %s %q", resp.Status, data)
+	}
+	return nil
+}
+
+// forwardUiautomator forward the uiautomator2 server to a local port and return its url,
+// unforward remove the forward when the server is not used any more
+func forwardUiautomator(device *adb.Device) (baseURL string, unforward func() error, err error) {
+	port, err := device.ForwardToFreePort(adb.ForwardSpec{Protocol: adb.FProtocolTcp, PortOrName: uiautomatorPort})
+	if err != nil {
+		return "", nil, err
+	}
+	unforward = func() error {
+		return device.ForwardRemove(adb.ForwardSpec{Protocol: adb.FProtocolTcp, PortOrName: strconv.Itoa(port)})
+	}
+	return "http://127.0.0.1:" + strconv.Itoa(port), unforward, nil
+}
+
+// probeUiautomator return nil if the uiautomator2 server is running on device
+func probeUiautomator(device *adb.Device) error {
+	baseURL, unforward, err := forwardUiautomator(device)
+	if err != nil {
+		return errors.Wrap(err, "forward uiautomator")
+	}
+	defer unforward()
+	return pingUiautomator(&http.Client{Timeout: 3 * time.Second}, baseURL)
+}
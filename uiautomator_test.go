@@ -0,0 +1,87 @@
+package stf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeUiautomator(t *testing.T, reply func(method string) map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.Write([]byte("pong"))
+		case "/jsonrpc/0":
+			var req struct {
+				Method string `json:"method"`
+			}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			json.NewEncoder(w).Encode(reply(req.Method))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestUiautomatorCapturer(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 36, 64)), nil))
+	ts := newFakeUiautomator(t, func(method string) map[string]interface{} {
+		assert.Equal(t, "takeScreenshot", method)
+		return map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": base64.StdEncoding.EncodeToString(buf.Bytes())}
+	})
+	defer ts.Close()
+
+	s := NewUiautomatorCapturer(nil)
+	s.SetInterval(10 * time.Millisecond)
+	unforwards := 0
+	s.baseURL = func() (string, func() error, error) {
+		return ts.URL, func() error { unforwards++; return nil }, nil
+	}
+	assert.NoError(t, s.Start())
+	for seq := uint64(1); seq <= 2; seq++ {
+		select {
+		case frame := <-s.Frames():
+			assert.Equal(t, seq, frame.Seq)
+			assert.Equal(t, FormatJPEG, frame.Format)
+			assert.Equal(t, buf.Bytes(), frame.Data)
+			assert.Equal(t, 36, frame.Width)
+			assert.Equal(t, 64, frame.Height)
+		case <-time.After(3 * time.Second):
+			t.Fatal("no screenshot")
+		}
+	}
+	assert.NoError(t, s.Stop())
+	assert.Equal(t, 1, unforwards, "the forward is removed on Stop")
+
+	assert.NoError(t, pingUiautomator(http.DefaultClient, ts.URL))
+	assert.Error(t, pingUiautomator(http.DefaultClient, ts.URL+"/none"))
+}
+
+func TestUiautomatorCapturerError(t *testing.T) {
+	ts := newFakeUiautomator(t, func(method string) map[string]interface{} {
+		return map[string]interface{}{"jsonrpc": "2.0", "id": 1,
+			"error": map[string]interface{}{"code": -32001, "message": "uiautomation not connected"}}
+	})
+	defer ts.Close()
+
+	s := NewUiautomatorCapturer(nil)
+	unforwards := 0
+	s.baseURL = func() (string, func() error, error) {
+		return ts.URL, func() error { unforwards++; return nil }, nil
+	}
+	assert.NoError(t, s.Start())
+	err := s.Wait()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "uiautomation not connected")
+	}
+	assert.Equal(t, 1, unforwards, "the forward is removed when capturing failed")
+}
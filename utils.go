@@ -1,42 +1,135 @@
 package stf
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"image"
+	"image/png"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path"
+	"runtime/pprof"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	adb "github.com/openatx/go-adb"
 )
 
+// ProgressFunc is called during downloading, bytesTotal is -1 if unknown
+type ProgressFunc func(filename string, bytesDone, bytesTotal int64)
+
+// progressReader call progress after every Read
+type progressReader struct {
+	rd       io.Reader
+	filename string
+	done     int64
+	total    int64
+	progress ProgressFunc
+}
+
+func (r *progressReader) Read(p []byte) (n int, err error) {
+	n, err = r.rd.Read(p)
+	if n > 0 {
+		r.done += int64(n)
+		r.progress(r.filename, r.done, r.total)
+	}
+	return
+}
+
 func PushFileFromHTTP(d *adb.Device, dst string, perms os.FileMode, urlStr string) error {
+	return PushFileFromHTTPWithProgress(d, dst, perms, urlStr, nil)
+}
+
+// PushFileFromHTTPWithProgress is PushFileFromHTTP which report download progress, progress can be nil
+func PushFileFromHTTPWithProgress(d *adb.Device, dst string, perms os.FileMode, urlStr string, progress ProgressFunc) error {
+	return PushFileFromHTTPContext(context.Background(), d, dst, perms, urlStr, progress)
+}
+
+// PushFileFromHTTPContext is PushFileFromHTTPWithProgress which stop downloading when ctx done
+func PushFileFromHTTPContext(ctx context.Context, d *adb.Device, dst string, perms os.FileMode, urlStr string, progress ProgressFunc) error {
 	wc, err := d.OpenWrite(dst, perms, time.Now())
 	if err != nil {
 		return err
 	}
-	resp, err := http.Get(urlStr)
+	log.Printf("downloading to %s ...", dst)
+	if err = download(ctx, wc, urlStr, path.Base(dst), progress); err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// download write content of urlStr into w
+func download(ctx context.Context, w io.Writer, urlStr string, filename string, progress ProgressFunc) error {
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("http download <%s> status %v", urlStr, resp.Status)
 	}
-	defer resp.Body.Close()
-	log.Printf("downloading to %s ...", dst)
-	if _, err = io.Copy(wc, resp.Body); err != nil {
-		return err
+	var body io.Reader = resp.Body
+	if progress != nil {
+		body = &progressReader{
+			rd:       resp.Body,
+			filename: filename,
+			total:    resp.ContentLength,
+			progress: progress,
+		}
 	}
-	if err := wc.Close(); err != nil {
+	if _, err = io.Copy(w, body); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return err
 	}
 	return nil
 }
 
+// PushFileFromBytes write data to dst on the device
+func PushFileFromBytes(d *adb.Device, dst string, perms os.FileMode, data []byte) error {
+	wc, err := d.OpenWrite(dst, perms, time.Now())
+	if err != nil {
+		return err
+	}
+	if _, err = wc.Write(data); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+// Screencap take a screenshot with the screencap command, slow but works on all devices
+func Screencap(d *adb.Device) (image.Image, error) {
+	tmpFile := "/data/local/tmp/go-stf-screencap.png"
+	if _, err := AdbCheckOutput(d, "screencap", "-p", tmpFile); err != nil {
+		return nil, err
+	}
+	defer d.RunCommand("rm", tmpFile)
+	rd, err := d.OpenRead(tmpFile)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return png.Decode(rd)
+}
+
 func AdbCheckOutput(d *adb.Device, name string, args ...string) (outStr string, err error) {
 	args = append(args, ";", "echo", ":$?")
 	outStr, err = d.RunCommand(name, args...)
@@ -59,6 +152,22 @@ func AdbFileExists(d *adb.Device, path string) bool {
 	return err == nil
 }
 
+// retryWithBackoff call f until it succeed or attempts used up,
+// wait backoff(failures) before every retry, failures is the number of failed calls so far.
+// No more retry if fatal(err) return true, fatal can be nil
+func retryWithBackoff(attempts int, backoff func(failures int) time.Duration, fatal func(error) bool, f func() error) (err error) {
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff(i))
+		}
+		err = f()
+		if err == nil || (fatal != nil && fatal(err)) {
+			return
+		}
+	}
+	return
+}
+
 func GoFunc(f func() error) chan error {
 	ch := make(chan error)
 	go func() {
@@ -67,6 +176,19 @@ func GoFunc(f func() error) chan error {
 	return ch
 }
 
+// goLabeled run f in a new goroutine tagged with pprof labels of device and role,
+// goroutines started inside f inherit the labels, so goroutine dumps of a farm are readable
+func goLabeled(device *adb.Device, role string, f func()) {
+	serial := "unknown"
+	if device != nil {
+		serial = device.String()
+	}
+	labels := pprof.Labels("device", serial, "role", role)
+	go pprof.Do(context.Background(), labels, func(context.Context) {
+		f()
+	})
+}
+
 type multiError struct {
 	errs []error
 }
@@ -92,3 +214,48 @@ func wrapMultiError(errs ...error) error {
 	}
 	return merr
 }
+
+// lineRing keeps the last N lines written into it
+type lineRing struct {
+	mu    sync.Mutex
+	lines []string
+	size  int
+}
+
+func newLineRing(size int) *lineRing {
+	return &lineRing{size: size}
+}
+
+func (r *lineRing) Add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size <= 0 {
+		return
+	}
+	r.lines = append(r.lines, line)
+	if len(r.lines) > r.size {
+		r.lines = r.lines[len(r.lines)-r.size:]
+	}
+}
+
+func (r *lineRing) Resize(size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.size = size
+	if size <= 0 {
+		r.lines = nil
+	} else if len(r.lines) > size {
+		r.lines = r.lines[len(r.lines)-size:]
+	}
+}
+
+func (r *lineRing) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+// shellQuote quote s as one argument of the device shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
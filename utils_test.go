@@ -1,7 +1,16 @@
 package stf
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -21,3 +30,113 @@ func TestPushFileFromHTTP(t *testing.T) {
 	err := PushFileFromHTTP(dev, "/data/local/tmp/tt.txt", 0644, "")
 	assert.Error(t, err)
 }
+
+func TestProgressReader(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			w.Write(bytes.Repeat([]byte("m"), 1024))
+			w.(http.Flusher).Flush() // chunked, no content length
+		}
+	}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	var dones []int64
+	rd := &progressReader{
+		rd:       resp.Body,
+		filename: "minicap",
+		total:    resp.ContentLength,
+		progress: func(filename string, bytesDone, bytesTotal int64) {
+			assert.Equal(t, "minicap", filename)
+			assert.Equal(t, int64(-1), bytesTotal)
+			dones = append(dones, bytesDone)
+		},
+	}
+	_, err = io.Copy(ioutil.Discard, rd)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, dones)
+	for i := 1; i < len(dones); i++ {
+		assert.True(t, dones[i] > dones[i-1])
+	}
+	assert.Equal(t, int64(3*1024), dones[len(dones)-1])
+}
+
+func TestDownloadCancel(t *testing.T) {
+	releaseC := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-releaseC:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(releaseC)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error, 1)
+	go func() {
+		errC <- download(ctx, ioutil.Discard, ts.URL, "minicap", nil)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errC:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("download not cancelled")
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	var waits []int
+	backoff := func(failures int) time.Duration {
+		waits = append(waits, failures)
+		return 0
+	}
+	calls := 0
+	err := retryWithBackoff(3, backoff, nil, func() error {
+		calls++
+		return errors.New("busy")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []int{1, 2}, waits)
+
+	waits, calls = nil, 0
+	fatal := errors.New("fatal")
+	err = retryWithBackoff(3, backoff, func(err error) bool { return err == fatal }, func() error {
+		calls++
+		return fatal
+	})
+	assert.Equal(t, fatal, err)
+	assert.Equal(t, 1, calls)
+	assert.Empty(t, waits)
+}
+
+func TestGoLabeled(t *testing.T) {
+	doneC := make(chan bool)
+	defer close(doneC)
+	startedC := make(chan bool)
+	goLabeled(nil, "minicap", func() {
+		GoFunc(func() error { // labels are inherited
+			startedC <- true
+			<-doneC
+			return nil
+		})
+		<-doneC
+	})
+	<-startedC
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, pprof.Lookup("goroutine").WriteTo(buf, 1))
+	assert.Contains(t, buf.String(), `"role":"minicap"`)
+	assert.Contains(t, buf.String(), `"device":"unknown"`)
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "'StatusBar'", shellQuote("StatusBar"))
+	assert.Equal(t, `'it'\''s a layer'`, shellQuote("it's a layer"))
+}
@@ -0,0 +1,41 @@
+//go:build webp && cgo
+// +build webp,cgo
+
+package stf
+
+/*
+#cgo pkg-config: libwebp
+#include <stdlib.h>
+#include <webp/encode.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// EncodeWebP convert the frame to lossy webp with libwebp, quality is 0-100
+func (f Frame) EncodeWebP(quality int) ([]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(f.Data))
+	if err != nil {
+		return nil, errors.Wrap(err, "decode frame")
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+
+	var output *C.uint8_t
+	size := C.WebPEncodeRGBA((*C.uint8_t)(unsafe.Pointer(&rgba.Pix[0])),
+		C.int(b.Dx()), C.int(b.Dy()), C.int(rgba.Stride), C.float(quality), &output)
+	if size == 0 {
+		return nil, errors.New("webp encode failed")
+	}
+	defer C.WebPFree(unsafe.Pointer(output))
+	return C.GoBytes(unsafe.Pointer(output), C.int(size)), nil
+}
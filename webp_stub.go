@@ -0,0 +1,10 @@
+//go:build !webp || !cgo
+// +build !webp !cgo
+
+package stf
+
+// EncodeWebP convert the frame to lossy webp, quality is 0-100.
+// It needs libwebp, build with -tags webp to enable it, otherwise ErrWebPUnsupported is returned
+func (f Frame) EncodeWebP(quality int) ([]byte, error) {
+	return nil, ErrWebPUnsupported
+}
@@ -0,0 +1,47 @@
+//go:build webp && cgo
+// +build webp,cgo
+
+package stf
+
+import (
+	"image/color"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebPHandler(t *testing.T) {
+	cap := newFakeCapturer(t)
+	ts := httptest.NewServer(cap.WebPHandler(80))
+	defer ts.Close()
+
+	jpg := makeJpeg(t, 64, 48, color.RGBA{0, 0, 255, 255})
+	go func() {
+		waitSubscribed(t, cap, 1)
+		cap.pub(Frame{Data: jpg, Seq: 1})
+	}()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	part, err := multipart.NewReader(resp.Body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "image/webp", part.Header.Get("Content-Type"))
+	data, err := ioutil.ReadAll(part)
+	assert.NoError(t, err)
+	if assert.True(t, len(data) > 12) {
+		assert.Equal(t, "RIFF", string(data[0:4]))
+		assert.Equal(t, "WEBP", string(data[8:12]))
+	}
+}
@@ -0,0 +1,248 @@
+package stf
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// websocket opcodes, see RFC 6455
+const (
+	wsOpText   = 0x1
+	wsOpBinary = 0x2
+	wsOpClose  = 0x8
+	wsOpPing   = 0x9
+	wsOpPong   = 0xa
+)
+
+const (
+	wsGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessageSize = 1 << 16 // messages from the client are short text commands
+)
+
+// wsAccept do the websocket handshake and take over the connection
+func wsAccept(w http.ResponseWriter, r *http.Request) (*bufio.ReadWriter, io.Closer, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "websocket required", http.StatusBadRequest)
+		return nil, nil, errors.New("not a websocket request")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, nil, errors.New("response can not be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(digest[:]))
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return rw, conn, nil
+}
+
+// wsWriteMessage write an unfragmented and unmasked message, as a server does
+func wsWriteMessage(w *bufio.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// wsReadMessage read one frame sent by a client, fragmented messages are not supported
+func wsReadMessage(r *bufio.Reader) (opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(r, ext); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(r, ext); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > wsMaxMessageSize {
+		return 0, nil, errors.Errorf("websocket message too large: %d", length)
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(r, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// stfBanner is sent as "start <json>" when streaming is turned on, like the stf screen websocket
+type stfBanner struct {
+	Pid           int       `json:"pid"`
+	RealWidth     int       `json:"realWidth"`
+	RealHeight    int       `json:"realHeight"`
+	VirtualWidth  int       `json:"virtualWidth"`
+	VirtualHeight int       `json:"virtualHeight"`
+	Orientation   int       `json:"orientation"`
+	Quirks        stfQuirks `json:"quirks"`
+}
+
+type stfQuirks struct {
+	Dumb          bool `json:"dumb"`
+	AlwaysUpright bool `json:"alwaysUpright"`
+	Tear          bool `json:"tear"`
+}
+
+// WebSocketHandler serve frames like the screen websocket of openstf, so its canvas viewer can be used.
+// Frames are sent as binary messages after the client send "on" until "off".
+// "size WxH" change the max size of frames and "quality N" the jpeg quality
+func (s *STFCapturer) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw, conn, err := wsAccept(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		type message struct {
+			opcode  byte
+			payload []byte
+		}
+		msgC := make(chan message)
+		doneC := make(chan bool)
+		defer close(doneC)
+		go func() {
+			defer close(msgC)
+			for {
+				opcode, payload, err := wsReadMessage(rw.Reader)
+				if err != nil {
+					return
+				}
+				select {
+				case msgC <- message{opcode, payload}:
+				case <-doneC:
+					return
+				}
+			}
+		}()
+
+		var C chan Frame
+		defer func() {
+			if C != nil {
+				s.Unsubscribe(C)
+			}
+		}()
+		started := false
+		for {
+			select {
+			case msg, ok := <-msgC:
+				if !ok || msg.opcode == wsOpClose {
+					wsWriteMessage(rw.Writer, wsOpClose, nil)
+					return
+				}
+				if msg.opcode == wsOpPing {
+					wsWriteMessage(rw.Writer, wsOpPong, msg.payload)
+					continue
+				}
+				if msg.opcode != wsOpText {
+					continue
+				}
+				switch fields := strings.Fields(string(msg.payload)); {
+				case len(fields) == 1 && fields[0] == "on" && C == nil:
+					C, started = s.Subscribe(), false
+				case len(fields) == 1 && fields[0] == "off" && C != nil:
+					s.Unsubscribe(C)
+					C = nil
+				case len(fields) == 2 && fields[0] == "size":
+					var width, height int
+					if _, err := fmt.Sscanf(fields[1], "%dx%d", &width, &height); err == nil {
+						s.SetMaxSize(width, height)
+					}
+				case len(fields) == 2 && fields[0] == "quality":
+					if quality, err := strconv.Atoi(fields[1]); err == nil {
+						s.SetJPEGQuality(quality)
+					}
+				}
+			case frame, ok := <-C:
+				if !ok {
+					return
+				}
+				if !started {
+					data, _ := json.Marshal(s.stfBanner(frame))
+					if wsWriteMessage(rw.Writer, wsOpText, append([]byte("start "), data...)) != nil {
+						return
+					}
+					started = true
+				}
+				if wsWriteMessage(rw.Writer, wsOpBinary, frame.Data) != nil {
+					return
+				}
+			}
+		}
+	})
+}
+
+// stfBanner describe the stream of frame for the stf viewer
+func (s *STFCapturer) stfBanner(frame Frame) stfBanner {
+	pid, _ := s.MinicapPID()
+	info := s.Info()
+	realWidth, realHeight := info.Width, info.Height
+	if realWidth == 0 || realHeight == 0 {
+		realWidth, realHeight = frame.Width, frame.Height
+	}
+	return stfBanner{
+		Pid:           pid,
+		RealWidth:     realWidth,
+		RealHeight:    realHeight,
+		VirtualWidth:  frame.Width,
+		VirtualHeight: frame.Height,
+		Orientation:   frame.Rotation,
+	}
+}
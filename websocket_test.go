@@ -0,0 +1,122 @@
+package stf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// wsClient is a minimal websocket client, it masks messages as browsers do
+type wsClient struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, url string) *wsClient {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	rd := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	return &wsClient{conn: conn, rd: rd}
+}
+
+func (c *wsClient) send(text string) {
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | wsOpText, 0x80 | byte(len(text))}, mask...)
+	for i := 0; i < len(text); i++ {
+		frame = append(frame, text[i]^mask[i%4])
+	}
+	c.conn.Write(frame)
+}
+
+func (c *wsClient) read(t *testing.T) (byte, []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	opcode, payload, err := wsReadMessage(c.rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opcode, payload
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	cap := newFakeCapturer(t)
+	ts := httptest.NewServer(cap.WebSocketHandler())
+	defer ts.Close()
+
+	client := dialWebSocket(t, ts.URL)
+	defer client.conn.Close()
+	client.send("size 360x640")
+	client.send("quality 60")
+	client.send("on")
+	waitSubscribed(t, cap, 1)
+	cfg := cap.Config()
+	assert.Equal(t, 360, cfg.MaxWidth)
+	assert.Equal(t, 640, cfg.MaxHeight)
+	assert.Equal(t, 60, cfg.JPEGQuality)
+
+	cap.pub(Frame{Data: fakeJpeg, Width: 360, Height: 640, Rotation: 90})
+	opcode, payload := client.read(t)
+	assert.Equal(t, byte(wsOpText), opcode)
+	assert.True(t, strings.HasPrefix(string(payload), "start "))
+	var banner stfBanner
+	assert.NoError(t, json.Unmarshal(payload[len("start "):], &banner))
+	assert.Equal(t, 360, banner.VirtualWidth)
+	assert.Equal(t, 90, banner.Orientation)
+
+	opcode, payload = client.read(t)
+	assert.Equal(t, byte(wsOpBinary), opcode)
+	assert.Equal(t, fakeJpeg, payload)
+
+	client.send("off")
+	deadline := time.Now().Add(2 * time.Second)
+	for cap.SubscriberCount() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, cap.SubscriberCount())
+}
+
+func TestWebSocketMessageLength(t *testing.T) {
+	for _, size := range []int{10, 300, 70000} {
+		buf := bytes.NewBuffer(nil)
+		w := bufio.NewWriter(buf)
+		assert.NoError(t, wsWriteMessage(w, wsOpBinary, make([]byte, size)))
+		assert.Equal(t, byte(0x80|wsOpBinary), buf.Bytes()[0])
+		opcode, payload, err := wsReadMessage(bufio.NewReader(buf))
+		if size > wsMaxMessageSize {
+			assert.Error(t, err, "large messages are refused from clients")
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, byte(wsOpBinary), opcode)
+		assert.Len(t, payload, size)
+	}
+}
+
+func TestWebSocketHandlerNotUpgrade(t *testing.T) {
+	cap := newFakeCapturer(t)
+	ts := httptest.NewServer(cap.WebSocketHandler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}